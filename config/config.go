@@ -33,13 +33,21 @@ type Configuration struct {
 			Write time.Duration
 		}
 		Threads int
+		Sockets int
 	}
 	UDP struct {
-		Enabled bool
-		IP      string
-		Port    int
-		Threads int
-		ConnDB  struct {
+		Enabled    bool
+		IP         string
+		Port       int
+		Threads    int
+		Sockets    int
+		Batch      int
+		MaxPayload struct {
+			V4 int
+			V6 int
+		}
+		ConnDB struct {
+			Type     string
 			Validate bool
 			Size     uint64
 			Trim     time.Duration
@@ -47,15 +55,46 @@ type Configuration struct {
 		}
 	}
 	Numwant struct {
-		Default uint
-		Limit   uint
+		Default   uint
+		Limit     uint
+		SeedRatio float64
 	}
 	DB struct {
 		Type   string
+		Shards int
 		Backup struct {
-			Frequency time.Duration
-			Type      string
-			Path      string
+			Frequency   time.Duration
+			Type        string
+			Path        string
+			Compression string
+			Generations int
+		}
+		Redis struct {
+			Address     string
+			Password    string
+			Connections int
+		}
+		Postgres struct {
+			Address     string
+			Connections int
+		}
+		Disk struct {
+			Path  string
+			Cache int64
+			Sync  bool
+		}
+		Limits struct {
+			Peers   uint32
+			Address struct {
+				Swarm  uint32
+				Global uint32
+			}
+			Prefix int
+		}
+		Compact struct {
+			Interval time.Duration
+			Ratio    int
+			Budget   int
 		}
 		Trim   time.Duration
 		Expiry time.Duration
@@ -91,6 +130,14 @@ func (conf *Configuration) SetLogLevel(level LogLevel) {
 	}
 }
 
+// resolveEnv returns the value of the environment variable if value is formatted "ENV:VARIABLE".
+func resolveEnv(value string) string {
+	if strings.HasPrefix(value, "ENV:") {
+		return os.Getenv(strings.TrimPrefix(value, "ENV:"))
+	}
+	return value
+}
+
 var oneTimeSetup sync.Once
 
 // Parse updates logger and limits based on the configuration settings.
@@ -105,6 +152,8 @@ func (config *Configuration) Parse() error {
 	// set strings to lowercase
 	config.LogLevel = LogLevel(strings.ToLower(string(config.LogLevel)))
 	config.HTTP.Mode = strings.ToLower(config.HTTP.Mode)
+	config.DB.Backup.Compression = strings.ToLower(config.DB.Backup.Compression)
+	config.UDP.ConnDB.Type = strings.ToLower(config.UDP.ConnDB.Type)
 
 	// dev env check
 	if config.LogLevel.Debug() {
@@ -117,10 +166,36 @@ func (config *Configuration) Parse() error {
 	Logger = zap.New(zapcore.NewCore(zapcore.NewConsoleEncoder(cfg.EncoderConfig), zapcore.Lock(os.Stdout), loggerAtom))
 	config.SetLogLevel(config.LogLevel)
 
-	// resolve env vars for database backup path
-	if strings.HasPrefix(config.DB.Backup.Path, "ENV:") {
-		config.DB.Backup.Path = os.Getenv(strings.TrimPrefix(config.DB.Backup.Path, "ENV:"))
+	if config.Numwant.SeedRatio < 0 || config.Numwant.SeedRatio > 1 {
+		return errors.New("numwant.seedratio must be between 0 and 1")
+	}
+	if config.DB.Limits.Prefix < 0 || config.DB.Limits.Prefix > 128 {
+		return errors.New("db.limits.prefix must be between 0 and 128")
+	}
+	if (config.DB.Limits.Address.Swarm > 0 || config.DB.Limits.Address.Global > 0) && config.DB.Type != "gomap" && config.DB.Type != "gomap-sharded" {
+		return errors.New("db.limits.address is only enforced by the gomap databases")
+	}
+	switch config.UDP.ConnDB.Type {
+	case "", "map":
+	case "hmac":
+		if config.UDP.ConnDB.Expiry < time.Second {
+			return errors.New("udp.conndb.expiry must be at least 1s for hmac connection ids")
+		}
+	default:
+		return errors.New("udp.conndb.type must be map or hmac")
+	}
+	if config.UDP.MaxPayload.V4 < 0 || config.UDP.MaxPayload.V6 < 0 {
+		return errors.New("udp.maxpayload must not be negative")
 	}
+	if config.DB.Compact.Interval > 0 && config.DB.Compact.Ratio < 2 {
+		return errors.New("db.compact.ratio must be at least 2")
+	}
+
+	// resolve env vars for database addresses
+	config.DB.Backup.Path = resolveEnv(config.DB.Backup.Path)
+	config.DB.Redis.Address = resolveEnv(config.DB.Redis.Address)
+	config.DB.Redis.Password = resolveEnv(config.DB.Redis.Password)
+	config.DB.Postgres.Address = resolveEnv(config.DB.Postgres.Address)
 
 	// resolve paths
 	home, err := os.UserHomeDir()
@@ -129,6 +204,7 @@ func (config *Configuration) Parse() error {
 	}
 	config.Path.Pid = strings.ReplaceAll(config.Path.Pid, "~", home)
 	config.Path.Log = strings.ReplaceAll(config.Path.Log, "~", home)
+	config.DB.Disk.Path = strings.ReplaceAll(config.DB.Disk.Path, "~", home)
 
 	// If $PORT var set override port for appengines (like heroku)
 	if appenginePort := os.Getenv("PORT"); appenginePort != "" {
@@ -1,15 +1,11 @@
 package pools
 
-import (
-	"github.com/crimist/trakx/bencoding"
-	"github.com/crimist/trakx/tracker/storage"
-)
+import "github.com/crimist/trakx/bencoding"
 
 var (
 	Peerlists4   *Pool[[]byte]
 	Peerlists6   *Pool[[]byte]
 	Dictionaries *Pool[*bencoding.Dictionary]
-	Peers        *Pool[*storage.Peer]
 )
 
 func Initialize(numwantLimit int) {
@@ -37,8 +33,4 @@ func Initialize(numwantLimit int) {
 	}, func(dictionary *bencoding.Dictionary) {
 		dictionary.Reset()
 	})
-
-	Peers = NewPool[*storage.Peer](func() any {
-		return new(storage.Peer)
-	}, nil)
 }
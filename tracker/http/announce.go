@@ -21,6 +21,11 @@ type announceParams struct {
 	hash     string
 	peerid   string
 	numwant  string
+	key      string
+
+	uploaded   string
+	downloaded string
+	left       string
 }
 
 func (t *HTTPTracker) announce(conn net.Conn, vals *announceParams, ip netip.Addr) {
@@ -44,9 +49,14 @@ func (t *HTTPTracker) announce(conn net.Conn, vals *announceParams, ip netip.Add
 	}
 	copy(peerid[:], vals.peerid)
 
+	key := storage.ParseKey(vals.key)
+
 	// get if stop before continuing
 	if vals.event == "stopped" {
-		t.peerdb.Drop(hash, peerid)
+		if err := t.peerdb.Drop(hash, peerid, ip, key); err != nil {
+			t.clientError(conn, err.Error())
+			return
+		}
 		conn.Write(httpSuccessBytes)
 		return
 	}
@@ -77,13 +87,42 @@ func (t *HTTPTracker) announce(conn net.Conn, vals *announceParams, ip netip.Add
 		}
 	}
 
+	// transfer counters
+	var transfer storage.Transfer
+	if transfer.Uploaded, err = parseCounter(vals.uploaded); err != nil {
+		t.clientError(conn, "Invalid uploaded")
+		return
+	}
+	if transfer.Downloaded, err = parseCounter(vals.downloaded); err != nil {
+		t.clientError(conn, "Invalid downloaded")
+		return
+	}
+	if transfer.Left, err = parseCounter(vals.left); err != nil {
+		t.clientError(conn, "Invalid left")
+		return
+	}
+
 	peerComplete := false
 	if vals.event == "completed" || vals.noneleft {
 		peerComplete = true
 	}
 
-	t.peerdb.Save(ip, uint16(portInt), peerComplete, hash, peerid)
-	complete, incomplete := t.peerdb.HashStats(hash)
+	response, err := t.peerdb.Announce(&storage.Announce{
+		Hash:      hash,
+		ID:        peerid,
+		Addr:      netip.AddrPortFrom(ip, uint16(portInt)),
+		Complete:  peerComplete,
+		Completed: vals.event == "completed",
+		Transfer:  transfer,
+		Key:       key,
+		NumWant:   numwant,
+		Compact:   vals.compact,
+		NoPeerID:  vals.nopeerid,
+	})
+	if err != nil {
+		t.clientError(conn, err.Error())
+		return
+	}
 
 	interval := int64(config.Config.Announce.Base.Seconds())
 	if int32(config.Config.Announce.Fuzz.Seconds()) > 0 {
@@ -92,17 +131,17 @@ func (t *HTTPTracker) announce(conn net.Conn, vals *announceParams, ip netip.Add
 
 	dictionary := pools.Dictionaries.Get()
 	dictionary.Int64("interval", interval)
-	dictionary.Int64("complete", int64(complete))
-	dictionary.Int64("incomplete", int64(incomplete))
+	dictionary.Int64("complete", int64(response.Complete))
+	dictionary.Int64("incomplete", int64(response.Incomplete))
+	dictionary.Int64("downloaded", int64(response.Downloaded))
 	if vals.compact {
-		peers4, peers6 := t.peerdb.PeerListBytes(hash, numwant)
-		dictionary.StringBytes("peers", peers4)
-		dictionary.StringBytes("peers6", peers6)
+		dictionary.StringBytes("peers", response.Peers4)
+		dictionary.StringBytes("peers6", response.Peers6)
 
-		pools.Peerlists4.Put(peers4)
-		pools.Peerlists6.Put(peers6)
+		pools.Peerlists4.Put(response.Peers4)
+		pools.Peerlists6.Put(response.Peers6)
 	} else {
-		dictionary.BytesliceSlice("peers", t.peerdb.PeerList(hash, numwant, vals.nopeerid))
+		dictionary.BytesliceSlice("peers", response.Peers)
 	}
 
 	// double write no append is more efficient when > ~250 peers in response
@@ -112,3 +151,16 @@ func (t *HTTPTracker) announce(conn net.Conn, vals *announceParams, ip netip.Add
 	conn.Write(append(httpSuccessBytes, dictionary.GetBytes()...))
 	pools.Dictionaries.Put(dictionary)
 }
+
+// parseCounter parses a transfer counter, clients that don't send it are treated as reporting 0.
+// Negative values are invalid and treated as 0 like the counters of UDP announces.
+func parseCounter(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if value[0] == '-' {
+		_, err := strconv.ParseInt(value, 10, 64)
+		return 0, err
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/cbeuw/connutil"
 	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
 	"github.com/crimist/trakx/tracker/storage"
 )
 
@@ -30,6 +31,7 @@ func BenchmarkAnnounce(b *testing.B) {
 	config.Config.DB.Backup.Type = "none"
 	config.Config.Announce.Fuzz = 1 * time.Second
 	config.Config.Numwant.Limit = 200 // for peerlistpool
+	pools.Initialize(int(config.Config.Numwant.Limit))
 
 	// setup db
 	db, err := storage.Open()
@@ -79,6 +81,7 @@ func BenchmarkAnnounceCompact(b *testing.B) {
 	config.Config.DB.Backup.Type = "none"
 	config.Config.Announce.Fuzz = 1 * time.Second
 	config.Config.Numwant.Limit = 200
+	pools.Initialize(int(config.Config.Numwant.Limit))
 
 	// setup db
 	db, err := storage.Open()
@@ -128,6 +131,7 @@ func BenchmarkAnnounceCompactParallel(b *testing.B) {
 	config.Config.DB.Backup.Type = "none"
 	config.Config.Announce.Fuzz = 1 * time.Second
 	config.Config.Numwant.Limit = 200
+	pools.Initialize(int(config.Config.Numwant.Limit))
 
 	// setup db
 	db, err := storage.Open()
@@ -173,3 +177,52 @@ func BenchmarkAnnounceCompactParallel(b *testing.B) {
 		}
 	})
 }
+
+// benchmarkAnnounceSwarm announces new peers into a swarm of the given size.
+func benchmarkAnnounceSwarm(b *testing.B, peers int, compact bool) {
+	conn := connutil.Discard()
+
+	tracker := HTTPTracker{}
+	config.Config.DB.Type = "gomap"
+	config.Config.DB.Backup.Type = "none"
+	config.Config.Announce.Fuzz = 1 * time.Second
+	config.Config.Numwant.Limit = 200
+	pools.Initialize(int(config.Config.Numwant.Limit))
+
+	db, err := storage.Open()
+	if err != nil {
+		b.Fatal("failed to open storage", err)
+	}
+	tracker.peerdb = db
+
+	params := announceParams{
+		compact:  compact,
+		nopeerid: compact,
+		event:    "started",
+		port:     "6969",
+		hash:     "01234567890123456789",
+		numwant:  "200",
+	}
+	addr := netip.MustParseAddr("123.123.123.123")
+
+	// fill the swarm directly, announcing every peer would build as many peer lists
+	var hash storage.Hash
+	var peerid storage.PeerID
+	copy(hash[:], params.hash)
+	for i := 0; i < peers; i++ {
+		copy(peerid[:], randString(20))
+		db.Save(addr, uint16(i), false, hash, peerid, false, storage.Transfer{}, 0)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		params.peerid = randString(20)
+		b.StartTimer()
+		tracker.announce(conn, &params, addr)
+	}
+}
+
+func BenchmarkAnnounceSwarm10k(b *testing.B)         { benchmarkAnnounceSwarm(b, 10_000, false) }
+func BenchmarkAnnounceCompactSwarm10k(b *testing.B)  { benchmarkAnnounceSwarm(b, 10_000, true) }
+func BenchmarkAnnounceCompactSwarm100k(b *testing.B) { benchmarkAnnounceSwarm(b, 100_000, true) }
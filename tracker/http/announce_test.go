@@ -69,7 +69,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("1.1.1.1"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e5:peersl59:d7:peer id20:111111111111111111112:ip7:1.1.1.14:porti1234eeee"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e10:downloadedi0e5:peerslee"),
 			},
 		},
 		{
@@ -86,8 +86,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("2.2.2.2"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl59:d7:peer id20:111111111111111111112:ip7:1.1.1.14:porti1234ee59:d7:peer id20:222222222222222222222:ip7:2.2.2.24:porti4321eeee"),
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl59:d7:peer id20:222222222222222222222:ip7:2.2.2.24:porti4321ee59:d7:peer id20:111111111111111111112:ip7:1.1.1.14:porti1234eeee"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e10:downloadedi0e5:peersl59:d7:peer id20:111111111111111111112:ip7:1.1.1.14:porti1234eeee"),
 			},
 		},
 		{
@@ -104,7 +103,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("::1234"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e5:peersl58:d7:peer id20:111111111111111111112:ip6:::12344:porti1234eeee"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e10:downloadedi0e5:peerslee"),
 			},
 		},
 		{
@@ -118,11 +117,11 @@ func TestAnnounce(t *testing.T) {
 				hash:     "00000000000000000002",
 				peerid:   "22222222222222222222",
 				numwant:  "10",
+				key:      "0000abcd",
 			},
 			netip.MustParseAddr("::5678"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl58:d7:peer id20:111111111111111111112:ip6:::12344:porti1234ee58:d7:peer id20:222222222222222222222:ip6:::56784:porti4321eeee"),
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl58:d7:peer id20:222222222222222222222:ip6:::56784:porti4321ee58:d7:peer id20:111111111111111111112:ip6:::12344:porti1234eeee"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e10:downloadedi0e5:peersl58:d7:peer id20:111111111111111111112:ip6:::12344:porti1234eeee"),
 			},
 		},
 		{
@@ -136,11 +135,11 @@ func TestAnnounce(t *testing.T) {
 				hash:     "00000000000000000002",
 				peerid:   "22222222222222222222",
 				numwant:  "10",
+				key:      "0000abcd",
 			},
 			netip.MustParseAddr("1.1.1.1"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl58:d7:peer id20:111111111111111111112:ip6:::12344:porti1234ee59:d7:peer id20:222222222222222222222:ip7:1.1.1.14:porti4321eeee"),
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl59:d7:peer id20:222222222222222222222:ip7:1.1.1.14:porti4321ee58:d7:peer id20:111111111111111111112:ip6:::12344:porti1234eeee"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e10:downloadedi0e5:peersl58:d7:peer id20:111111111111111111112:ip6:::12344:porti1234eeee"),
 			},
 		},
 		{
@@ -157,7 +156,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("1.1.1.1"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e5:peersl27:d2:ip7:1.1.1.14:porti1234eeee"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e10:downloadedi0e5:peerslee"),
 			},
 		},
 		{
@@ -174,8 +173,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("2.2.2.2"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl27:d2:ip7:1.1.1.14:porti1234ee27:d2:ip7:2.2.2.24:porti4321eeee"),
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peersl27:d2:ip7:2.2.2.24:porti4321ee27:d2:ip7:1.1.1.14:porti1234eeee"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e10:downloadedi0e5:peersl27:d2:ip7:1.1.1.14:porti1234eeee"),
 			},
 		},
 		{
@@ -192,7 +190,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("1.1.1.1"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e5:peers6:\x01\x01\x01\x01\x04\xd26:peers60:e"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e10:downloadedi0e5:peers0:6:peers60:e"),
 			},
 		},
 		{
@@ -209,8 +207,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("2.2.2.2"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peers12:\x01\x01\x01\x01\x04\xd2\x02\x02\x02\x02\x10\xe16:peers60:e"),
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peers12:\x02\x02\x02\x02\x10\xe1\x01\x01\x01\x01\x04\xd26:peers60:e"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e10:downloadedi0e5:peers6:\x01\x01\x01\x01\x04\xd26:peers60:e"),
 			},
 		},
 		{
@@ -227,7 +224,7 @@ func TestAnnounce(t *testing.T) {
 			},
 			netip.MustParseAddr("::1234"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e5:peers0:6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x12\x34\x04\xd2e"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei1e10:downloadedi0e5:peers0:6:peers60:e"),
 			},
 		},
 		{
@@ -241,11 +238,11 @@ func TestAnnounce(t *testing.T) {
 				hash:     "33333333333333333333",
 				peerid:   "22222222222222222222",
 				numwant:  "10",
+				key:      "0000abcd",
 			},
 			netip.MustParseAddr("::5678"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peers0:6:peers636:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x12\x34\x04\xd2\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x56\x78\x04\xd2e"),
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peers0:6:peers636:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x56\x78\x04\xd2\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x12\x34\x04\xd2e"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e10:downloadedi0e5:peers0:6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x12\x34\x04\xd2e"),
 			},
 		},
 		{
@@ -259,10 +256,54 @@ func TestAnnounce(t *testing.T) {
 				hash:     "33333333333333333333",
 				peerid:   "22222222222222222222",
 				numwant:  "10",
+				key:      "0000abcd",
 			},
 			netip.MustParseAddr("1.1.1.1"),
 			[][]byte{
-				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e5:peers6:\x01\x01\x01\x01\x04\xd26:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x12\x34\x04\xd2e"),
+				[]byte("HTTP/1.1 200\r\n\r\nd8:intervali10e8:completei0e10:incompletei2e10:downloadedi0e5:peers0:6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x12\x34\x04\xd2e"),
+			},
+		},
+		{
+			"compactHijackKey",
+			announceParams{
+				compact:  true,
+				nopeerid: false,
+				noneleft: false,
+				event:    "started",
+				port:     "1234",
+				hash:     "33333333333333333333",
+				peerid:   "22222222222222222222",
+				numwant:  "10",
+				key:      "00001234",
+			},
+			netip.MustParseAddr("1.1.1.1"),
+			[][]byte{
+				[]byte("HTTP/1.1 200\r\n\r\nd14:failure reason32:peer id in use by another cliente"),
+			},
+		},
+		{
+			"stoppedHijackIP",
+			announceParams{
+				event:  "stopped",
+				hash:   "33333333333333333333",
+				peerid: "22222222222222222222",
+			},
+			netip.MustParseAddr("9.9.9.9"),
+			[][]byte{
+				[]byte("HTTP/1.1 200\r\n\r\nd14:failure reason32:peer id in use by another cliente"),
+			},
+		},
+		{
+			"stoppedKey",
+			announceParams{
+				event:  "stopped",
+				hash:   "33333333333333333333",
+				peerid: "22222222222222222222",
+				key:    "0000ABCD",
+			},
+			netip.MustParseAddr("9.9.9.9"),
+			[][]byte{
+				[]byte("HTTP/1.1 200\r\n\r\n"),
 			},
 		},
 	}
@@ -293,3 +334,28 @@ func TestAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCounter(t *testing.T) {
+	var cases = []struct {
+		value    string
+		expected uint64
+		valid    bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"1234", 1234, true},
+		{"18446744073709551615", 18446744073709551615, true},
+		{"-1", 0, true},
+		{"-9223372036854775808", 0, true},
+		{"-", 0, false},
+		{"12a", 0, false},
+		{"18446744073709551616", 0, false},
+	}
+
+	for _, c := range cases {
+		counter, err := parseCounter(c.value)
+		if (err == nil) != c.valid || (c.valid && counter != c.expected) {
+			t.Errorf("parseCounter(%q) = %v, %v; want %v, valid %v", c.value, counter, err, c.expected, c.valid)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package http
 
 import (
+	"context"
 	"fmt"
 	"net"
 
 	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
 	"github.com/crimist/trakx/tracker/storage"
+	"github.com/crimist/trakx/tracker/utils"
 	"github.com/pkg/errors"
 )
 
@@ -15,7 +18,7 @@ const (
 
 type HTTPTracker struct {
 	peerdb   storage.Database
-	workers  workers
+	workers  []workers
 	shutdown chan struct{}
 }
 
@@ -27,9 +30,18 @@ func (t *HTTPTracker) Init(peerdb storage.Database) {
 
 // Serve begins listening and serving clients.
 func (t *HTTPTracker) Serve() error {
-	ln, err := net.Listen("tcp", fmt.Sprintf("%v:%v", config.Config.HTTP.IP, config.Config.HTTP.Port))
+	sockets := config.Config.HTTP.Sockets
+	if sockets > 1 && !utils.ReusePortSupported {
+		config.Logger.Warn("SO_REUSEPORT isn't supported on this platform, serving a single TCP socket")
+		sockets = 1
+	}
+	if sockets < 1 {
+		sockets = 1
+	}
+
+	listeners, err := listen(sockets)
 	if err != nil {
-		return errors.Wrap(err, "Failed to open TCP listen socket")
+		return err
 	}
 
 	cache, err := config.GenerateEmbeddedCache()
@@ -37,23 +49,61 @@ func (t *HTTPTracker) Serve() error {
 		return errors.Wrap(err, "failed to generate embedded cache")
 	}
 
-	t.workers = workers{
-		tracker:   t,
-		listener:  ln,
-		fileCache: cache,
+	// every socket is served by its own share of the workers
+	threads := config.Config.HTTP.Threads / sockets
+	if threads < 1 {
+		threads = 1
+	}
+	hits := stats.HTTPSockets.Open(sockets)
+	t.workers = make([]workers, sockets)
+	for socket, ln := range listeners {
+		t.workers[socket] = workers{
+			tracker:   t,
+			listener:  ln,
+			fileCache: cache,
+			hits:      &hits[socket],
+		}
+		t.workers[socket].startWorkers(threads)
 	}
-
-	t.workers.startWorkers(config.Config.HTTP.Threads)
 
 	<-t.shutdown
-	if err := ln.Close(); err != nil {
-		return errors.Wrap(err, "Failed to close tcp listen socket")
+	for _, ln := range listeners {
+		if err := ln.Close(); err != nil {
+			return errors.Wrap(err, "Failed to close tcp listen socket")
+		}
 	}
 
 	return nil
 }
 
-// Shutdown stops the HTTP tracker server by closing the socket.
+// listen opens the sockets, more than one socket share the port with SO_REUSEPORT.
+func listen(sockets int) ([]net.Listener, error) {
+	address := fmt.Sprintf("%v:%v", config.Config.HTTP.IP, config.Config.HTTP.Port)
+	if sockets == 1 {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to open TCP listen socket")
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	listenConfig := utils.ReusePort()
+	listeners := make([]net.Listener, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		ln, err := listenConfig.Listen(context.Background(), "tcp", address)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, errors.Wrap(err, "Failed to open TCP listen socket")
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// Shutdown stops the HTTP tracker server by closing the sockets.
 func (t *HTTPTracker) Shutdown() {
 	if t == nil || t.shutdown == nil {
 		return
@@ -25,12 +25,13 @@ func (t *HTTPTracker) scrape(conn net.Conn, infohashes params) {
 
 		var hash storage.Hash
 		copy(hash[:], infohash)
-		complete, incomplete := t.peerdb.HashStats(hash)
+		complete, incomplete, downloaded := t.peerdb.HashStats(hash)
 
 		dictionary.StartDictionaryBytes(infohash)
 		{
 			dictionary.Int64("complete", int64(complete))
 			dictionary.Int64("incomplete", int64(incomplete))
+			dictionary.Int64("downloaded", int64(downloaded))
 		}
 		dictionary.EndDictionary()
 	}
@@ -5,6 +5,7 @@ import (
 	"expvar"
 	"net"
 	"net/netip"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -18,6 +19,7 @@ type workers struct {
 	tracker   *HTTPTracker
 	listener  net.Listener
 	fileCache config.EmbeddedCache
+	hits      *atomic.Int64 // connections accepted on the listener
 }
 
 func (w *workers) startWorkers(num int) {
@@ -45,6 +47,7 @@ func (w *workers) work() {
 			stats.ServerErrors.Add(1)
 			continue
 		}
+		w.hits.Add(1)
 
 		now := time.Now()
 		conn.SetReadDeadline(now.Add(config.Config.HTTP.Timeout.Read))
@@ -100,6 +103,11 @@ func (w *workers) work() {
 					if val == "0" {
 						v.noneleft = true
 					}
+					v.left = val
+				case "uploaded":
+					v.uploaded = val
+				case "downloaded":
+					v.downloaded = val
 				case "event":
 					v.event = val
 				case "port":
@@ -110,6 +118,8 @@ func (w *workers) work() {
 					v.peerid = val
 				case "numwant":
 					v.numwant = val
+				case "key":
+					v.key = val
 				}
 			}
 
@@ -35,6 +35,9 @@ func signalHandler(peerdb storage.Database, udptracker *udp.UDPTracker, httptrac
 			if err := peerdb.Backup().Save(); err != nil {
 				config.Logger.Error("Database save failed", zap.Error(err))
 			}
+			if err := peerdb.Close(); err != nil {
+				config.Logger.Error("Database close failed", zap.Error(err))
+			}
 
 			if err := udptracker.WriteConns(); err != nil {
 				config.Logger.Error("UDP connections save failed", zap.Error(err))
@@ -14,7 +14,7 @@ import (
 
 var initTime = time.Now()
 
-// Publish starts publishing and updating expvar values, requests metrics are over duration of Config.ExpvarInterval
+// Publish starts publishing and updating expvar values, requests and transfer metrics are over duration of Config.ExpvarInterval
 func Publish(peerdb storage.Database, udpconns func() int64) {
 	config.Logger.Info("publishing stats as expvars", zap.Duration("interval", config.Config.ExpvarInterval))
 
@@ -23,6 +23,11 @@ func Publish(peerdb storage.Database, udpconns func() int64) {
 	connects := expvar.NewInt("trakx.requests.connects")
 	announces := expvar.NewInt("trakx.requests.announces")
 	scrapes := expvar.NewInt("trakx.requests.scrapes")
+	truncated := expvar.NewInt("trakx.requests.truncated")
+
+	// sockets
+	udpSockets := expvar.NewMap("trakx.sockets.udp")
+	httpSockets := expvar.NewMap("trakx.sockets.http")
 
 	// database
 	seeds := expvar.NewInt("trakx.database.seeds")
@@ -31,6 +36,12 @@ func Publish(peerdb storage.Database, udpconns func() int64) {
 	ips := expvar.NewInt("trakx.database.ips")
 	hashes := expvar.NewInt("trakx.database.hashes")
 	udpConnections := expvar.NewInt("trakx.database.udpconnections")
+	evictions := expvar.NewInt("trakx.database.evictions")
+	compacted := expvar.NewInt("trakx.database.compacted")
+
+	// transfer
+	uploaded := expvar.NewInt("trakx.transfer.uploaded")
+	downloaded := expvar.NewInt("trakx.transfer.downloaded")
 
 	// errors
 	serverErrors := expvar.NewInt("trakx.errors.server")
@@ -38,7 +49,6 @@ func Publish(peerdb storage.Database, udpconns func() int64) {
 
 	// pools
 	dictionaryPool := expvar.NewInt("trakx.pools.dictionaries")
-	peerPool := expvar.NewInt("trakx.pools.peers")
 	peerlist4Pool := expvar.NewInt("trakx.pools.peerlists4")
 	peerlist6Pool := expvar.NewInt("trakx.pools.peerlists6")
 
@@ -52,6 +62,10 @@ func Publish(peerdb storage.Database, udpconns func() int64) {
 		connects.Set(Connects.Load())
 		announces.Set(Announces.Load())
 		scrapes.Set(Scrapes.Load())
+		truncated.Set(Truncated.Load())
+
+		UDPSockets.publish(udpSockets)
+		HTTPSockets.publish(httpSockets)
 
 		seeds.Set(Seeds.Load())
 		leeches.Set(Leeches.Load())
@@ -59,12 +73,16 @@ func Publish(peerdb storage.Database, udpconns func() int64) {
 		ips.Set(int64(IPStats.Total()))
 		hashes.Set(int64(peerdb.Hashes()))
 		udpConnections.Set(udpconns())
+		evictions.Set(Evictions.Load())
+		compacted.Set(Compacted.Load())
+
+		uploaded.Set(Uploaded.Load())
+		downloaded.Set(Downloaded.Load())
 
 		serverErrors.Set(ServerErrors.Load())
 		clientErrors.Set(ClientErrors.Load())
 
 		dictionaryPool.Set(int64(pools.Dictionaries.Created()))
-		peerPool.Set(int64(pools.Peers.Created()))
 		peerlist4Pool.Set(int64(pools.Peerlists4.Created()))
 		peerlist6Pool.Set(int64(pools.Peerlists6.Created()))
 
@@ -76,5 +94,8 @@ func Publish(peerdb storage.Database, udpconns func() int64) {
 		Connects.Store(0)
 		Announces.Store(0)
 		Scrapes.Store(0)
+		Truncated.Store(0)
+		Uploaded.Store(0)
+		Downloaded.Store(0)
 	})
 }
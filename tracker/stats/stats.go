@@ -1,7 +1,10 @@
 package stats
 
 import (
+	"expvar"
+	"math"
 	"net/netip"
+	"strconv"
 	"sync"
 	"sync/atomic"
 )
@@ -17,13 +20,68 @@ var (
 	Connects  atomic.Int64 // udp connects
 	Announces atomic.Int64 // announces
 	Scrapes   atomic.Int64 // scrapes
+	Truncated atomic.Int64 // udp announce responses trimmed to fit udp.maxpayload
 
 	// db
 	Seeds   atomic.Int64 // total seeds
 	Leeches atomic.Int64 // total leeches
 	IPStats ipStats      // total (unique) ips
 
+	Evictions atomic.Int64 // peers evicted from full swarms
+	Compacted atomic.Int64 // estimated bytes returned by rebuilding shrunken maps
+
+	// transfer
+	Uploaded   atomic.Int64 // bytes uploaded reported by peers
+	Downloaded atomic.Int64 // bytes downloaded reported by peers
+
 	// errors
 	ServerErrors atomic.Int64
 	ClientErrors atomic.Int64
 )
+
+// AddTransfer adds bytes transferred by peers, deltas beyond the range of the counters are clamped.
+func AddTransfer(uploaded, downloaded uint64) {
+	if uploaded > math.MaxInt64 {
+		uploaded = math.MaxInt64
+	}
+	if downloaded > math.MaxInt64 {
+		downloaded = math.MaxInt64
+	}
+	Uploaded.Add(int64(uploaded))
+	Downloaded.Add(int64(downloaded))
+}
+
+// Sockets counts the requests received on each socket of a tracker.
+type Sockets struct {
+	hits atomic.Pointer[[]atomic.Int64]
+}
+
+var (
+	UDPSockets  Sockets // packets received per udp socket
+	HTTPSockets Sockets // connections accepted per http socket
+)
+
+// Open sets the number of sockets and returns their counters, socket i counts its requests in the i-th counter.
+func (sockets *Sockets) Open(count int) []atomic.Int64 {
+	hits := make([]atomic.Int64, count)
+	sockets.hits.Store(&hits)
+	return hits
+}
+
+// publish sets the requests of each socket since the last call in the map keyed by socket index.
+func (sockets *Sockets) publish(vars *expvar.Map) {
+	hits := sockets.hits.Load()
+	if hits == nil {
+		return
+	}
+
+	for socket := range *hits {
+		key := strconv.Itoa(socket)
+		hit, ok := vars.Get(key).(*expvar.Int)
+		if !ok {
+			hit = new(expvar.Int)
+			vars.Set(key, hit)
+		}
+		hit.Set((*hits)[socket].Swap(0))
+	}
+}
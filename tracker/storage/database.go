@@ -35,6 +35,29 @@ func Open() (Database, error) {
 	return driver.db, nil
 }
 
+var (
+	// ErrPeerOwned is returned by Save and Drop if the peer id is owned by another client (see Peer.Owns).
+	ErrPeerOwned = errors.New("peer id in use by another client")
+	// ErrAddressLimit is returned by Save if the address of a new peer already has the maximum number of peers (see `db.limits.address`).
+	ErrAddressLimit = errors.New("too many peers from your address")
+)
+
+// AnnounceSeparately answers an announce with Save, HashStats and PeerList or PeerListBytes for drivers without a combined operation.
+// Other announces to the swarm can change it between the calls.
+func AnnounceSeparately(db Database, announce *Announce) (response AnnounceResponse, err error) {
+	if err = db.Save(announce.Addr.Addr(), announce.Addr.Port(), announce.Complete, announce.Hash, announce.ID, announce.Completed, announce.Transfer, announce.Key); err != nil {
+		return
+	}
+
+	response.Complete, response.Incomplete, response.Downloaded = db.HashStats(announce.Hash)
+	if announce.Compact {
+		response.Peers4, response.Peers6 = db.PeerListBytes(announce.Hash, announce.NumWant, announce.Requester())
+	} else {
+		response.Peers = db.PeerList(announce.Hash, announce.NumWant, announce.Requester(), announce.NoPeerID)
+	}
+	return
+}
+
 type Database interface {
 	// Used to init the database after open()
 	Init(backup Backup) error
@@ -44,13 +67,26 @@ type Database interface {
 	Backup() Backup
 	Trim()
 	SyncExpvars() error
+	// Close flushes and releases the database on shutdown, it's called once after the backup is saved.
+	Close() error
+
+	// Save stores the peer, the last bool is true when the peer announced it completed the download.
+	// Drivers that keep per peer state account the transfer counters into the peer and the swarm totals.
+	// The uint32 is the announce key. Save and Drop return ErrPeerOwned, and Save returns ErrAddressLimit, without changing anything.
+	// The errors are meant for the client, failures of the database itself are logged by the driver instead.
+	Save(netip.Addr, uint16, bool, Hash, PeerID, bool, Transfer, uint32) error
+	Drop(Hash, PeerID, netip.Addr, uint32) error
 
-	Save(netip.Addr, uint16, bool, Hash, PeerID)
-	Drop(Hash, PeerID)
+	// HashStats returns the number of seeds, leeches and completed downloads (snatches) of the hash
+	HashStats(Hash) (uint32, uint32, uint32)
+	// PeerList and PeerListBytes return peers other than the requester mixed by its role (see PeerMix).
+	// PeerList returns up to numwant peers and its bool removes the peer ids, PeerListBytes returns up to numwant of each address family.
+	PeerList(Hash, uint, Requester, bool) [][]byte
+	PeerListBytes(Hash, uint, Requester) ([]byte, []byte)
 
-	HashStats(Hash) (uint16, uint16)
-	PeerList(Hash, uint, bool) [][]byte
-	PeerListBytes(Hash, uint) ([]byte, []byte)
+	// Announce saves the peer like Save and answers it with the counts of HashStats and a peer list of PeerList or PeerListBytes.
+	// Drivers that can do it in one operation return counts and peers that agree with each other.
+	Announce(*Announce) (AnnounceResponse, error)
 
 	// Number of hashes for stats
 	Hashes() int
@@ -0,0 +1,25 @@
+package disk
+
+import (
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/pkg/errors"
+)
+
+// NoneBackup doesn't back anything up as every write goes to disk, Save only flushes pending writes.
+type NoneBackup struct {
+	db *Disk
+}
+
+func (bck *NoneBackup) Init(db storage.Database) error {
+	bck.db = db.(*Disk)
+	if bck.db == nil {
+		return errors.New("database is not type `Disk` for `NoneBackup`")
+	}
+	return nil
+}
+
+func (bck *NoneBackup) Save() error {
+	return errors.Wrap(bck.db.store.Sync(), "failed to sync store")
+}
+
+func (bck *NoneBackup) Load() error { return nil }
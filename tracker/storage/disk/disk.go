@@ -0,0 +1,457 @@
+/*
+	Disk implements a persistent trakx database on an embedded log-structured key/value store (badger) on local disk. Every write goes to the store so a restart resumes with the exact swarm state, and memory use is bounded by the configured cache.
+
+	Keys:
+		p<hash><peer id> peer: complete, last seen, port, first seen, announces, uploaded, downloaded, left, key, ip
+		s<hash>          swarm: complete, incomplete and downloaded counts, uploaded and downloaded bytes
+		l<hash><last seen><peer id> empty, orders the peers of a swarm by the time they were last seen so the oldest are evicted without a scan
+	Peers older than `db.expiry` are deleted by trim which rewrites the swarm counts so they never count peers that are gone.
+	Keys are written with a backstop ttl of 2 * `db.expiry` + `db.trim` so they're trimmed first, it only removes keys trim never reaches such as every key when trimming is disabled.
+	Trim repairs the counts and the index left behind by keys that expired on their own.
+	`db.limits.address` isn't supported and is rejected when loading the config, only the gomap driver indexes peers by address.
+*/
+
+package disk
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/crimist/trakx/tracker/utils"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	peerPrefix  = 'p'
+	swarmPrefix = 's'
+	seenPrefix  = 'l'
+
+	peerKeySize  = 1 + 20 + 20
+	swarmKeySize = 1 + 20
+	seenKeySize  = 1 + 20 + 8 + 20
+
+	// default cache size if `db.disk.cache` isn't set
+	defaultCache = 256 << 20
+
+	// peers and swarm counts are small enough to always be stored in the lsm tree
+	valueThreshold = 64
+
+	// number of times a conflicting transaction is retried
+	conflictRetries = 10
+
+	// number of keys written per transaction during trim
+	trimBatchSize = 1000
+
+	// value log files with more than this ratio of stale data are rewritten during trim
+	vlogDiscardRatio = 0.5
+)
+
+type Disk struct {
+	store  *badger.DB
+	hashes atomic.Int64
+
+	// serializes read-modify-write of the swarm counts for hashes that share a lock
+	locks [256]sync.Mutex
+
+	backup storage.Backup
+}
+
+func (db *Disk) Init(backup storage.Backup) error {
+	*db = Disk{
+		backup: backup,
+	}
+
+	cache := config.Config.DB.Disk.Cache
+	if cache <= 0 {
+		cache = defaultCache
+	}
+
+	options := badger.DefaultOptions(config.Config.DB.Disk.Path).
+		WithLogger(logger{config.Logger.Sugar()}).
+		WithSyncWrites(config.Config.DB.Disk.Sync).
+		WithNumVersionsToKeep(1).
+		WithValueThreshold(valueThreshold).
+		WithBlockCacheSize(cache / 2).
+		WithIndexCacheSize(cache / 4).
+		WithMemTableSize(cache / 8).
+		WithNumMemtables(2)
+
+	var err error
+	if db.store, err = badger.Open(options); err != nil {
+		return errors.Wrap(err, "failed to open store")
+	}
+
+	if err := db.countHashes(); err != nil {
+		return errors.Wrap(err, "failed to count hashes")
+	}
+
+	if err := db.backup.Init(db); err != nil {
+		return errors.Wrap(err, "failed to initialize backup")
+	}
+	if err := db.backup.Load(); err != nil {
+		return errors.Wrap(err, "failed to load backup")
+	}
+
+	if config.Config.DB.Trim > 0 {
+		go utils.RunOn(config.Config.DB.Trim, db.Trim)
+	}
+
+	return nil
+}
+
+func (db *Disk) Backup() storage.Backup {
+	return db.backup
+}
+
+func (db *Disk) Check() bool {
+	return db.store != nil
+}
+
+// Close flushes pending writes and closes the store.
+func (db *Disk) Close() error {
+	return errors.Wrap(db.store.Close(), "failed to close store")
+}
+
+// Hashes gets the number of hashes
+func (db *Disk) Hashes() int {
+	return int(db.hashes.Load())
+}
+
+// backstop returns an entry that expires well after trim would have deleted it, keys are trimmed first unless trim never reaches them.
+func backstop(key, value []byte) *badger.Entry {
+	entry := badger.NewEntry(key, value)
+	if ttl := 2*config.Config.DB.Expiry + config.Config.DB.Trim; ttl > 0 {
+		entry = entry.WithTTL(ttl)
+	}
+	return entry
+}
+
+func peerKey(hash storage.Hash, id storage.PeerID) []byte {
+	key := make([]byte, peerKeySize)
+	key[0] = peerPrefix
+	copy(key[1:21], hash[:])
+	copy(key[21:], id[:])
+	return key
+}
+
+func swarmKey(hash storage.Hash) []byte {
+	key := make([]byte, swarmKeySize)
+	key[0] = swarmPrefix
+	copy(key[1:], hash[:])
+	return key
+}
+
+func swarmPeersPrefix(hash storage.Hash) []byte {
+	prefix := make([]byte, 1+20)
+	prefix[0] = peerPrefix
+	copy(prefix[1:], hash[:])
+	return prefix
+}
+
+// seenKey is the key of the peer in the index ordered by last seen time, big endian so keys sort by time.
+func seenKey(hash storage.Hash, lastSeen int64, id storage.PeerID) []byte {
+	key := make([]byte, seenKeySize)
+	key[0] = seenPrefix
+	copy(key[1:21], hash[:])
+	binary.BigEndian.PutUint64(key[21:29], uint64(lastSeen))
+	copy(key[29:], id[:])
+	return key
+}
+
+func swarmSeenPrefix(hash storage.Hash) []byte {
+	prefix := make([]byte, 1+20)
+	prefix[0] = seenPrefix
+	copy(prefix[1:], hash[:])
+	return prefix
+}
+
+// lock locks the swarm counts of the hash.
+func (db *Disk) lock(hash storage.Hash) *sync.Mutex {
+	mutex := &db.locks[hash[0]]
+	mutex.Lock()
+	return mutex
+}
+
+// update runs fn in a read-write transaction, retrying on conflicts.
+func (db *Disk) update(fn func(txn *badger.Txn) error) (err error) {
+	for i := 0; i < conflictRetries; i++ {
+		if err = db.store.Update(fn); err != badger.ErrConflict {
+			return
+		}
+	}
+	return
+}
+
+func (db *Disk) countHashes() error {
+	var hashes int64
+
+	err := db.store.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		options.Prefix = []byte{swarmPrefix}
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			hashes++
+		}
+		return nil
+	})
+
+	db.hashes.Store(hashes)
+	return err
+}
+
+func (db *Disk) Trim() {
+	start := time.Now()
+	config.Logger.Info("Trimming database")
+	peers, hashes, err := db.trim()
+	if err != nil {
+		config.Logger.Error("Failed to trim database", zap.Error(err))
+	}
+	config.Logger.Info("Trimmed database", zap.Int("peers", peers), zap.Int("hashes", hashes), zap.Duration("duration", time.Since(start)))
+
+	// rewrite value logs until there's nothing left to reclaim
+	for db.store.RunValueLogGC(vlogDiscardRatio) == nil {
+	}
+}
+
+// trim removes expired peers, recounts every swarm from the peers that remain, and deletes empty swarms.
+func (db *Disk) trim() (peers, hashes int, err error) {
+	now := time.Now().Unix()
+	peerTimeout := int64(config.Config.DB.Expiry.Seconds())
+
+	var swarms []storage.Hash
+	err = db.store.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		options.Prefix = []byte{swarmPrefix}
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			var hash storage.Hash
+			copy(hash[:], iterator.Item().Key()[1:])
+			swarms = append(swarms, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	var seeds, leeches int64
+	for _, hash := range swarms {
+		mutex := db.lock(hash)
+		expired, counts, trimErr := db.trimSwarm(hash, now-peerTimeout)
+		mutex.Unlock()
+
+		if trimErr != nil {
+			err = trimErr
+			return
+		}
+
+		peers += expired
+		if counts.complete == 0 && counts.incomplete == 0 {
+			hashes++
+		}
+		seeds += int64(counts.complete)
+		leeches += int64(counts.incomplete)
+	}
+
+	stats.Seeds.Store(seeds)
+	stats.Leeches.Store(leeches)
+
+	// swarms written with a ttl may have expired without being visited so recount
+	err = db.countHashes()
+
+	return
+}
+
+// trimSwarm removes peers last seen before cutoff and rewrites the swarm counts, the swarm must be locked.
+// The last seen index is repaired on the way: entries without a peer are deleted and peers stored before the index existed are added to it.
+func (db *Disk) trimSwarm(hash storage.Hash, cutoff int64) (expired int, counts swarm, err error) {
+	var stale, orphaned, unindexed [][]byte
+
+	err = db.store.View(func(txn *badger.Txn) error {
+		// entries of the index that no peer has claimed yet
+		indexed := make(map[string]struct{})
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		options.Prefix = swarmSeenPrefix(hash)
+		iterator := txn.NewIterator(options)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			indexed[string(iterator.Item().Key())] = struct{}{}
+		}
+		iterator.Close()
+
+		options = badger.DefaultIteratorOptions
+		options.Prefix = swarmPeersPrefix(hash)
+		iterator = txn.NewIterator(options)
+		defer iterator.Close()
+
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			err := item.Value(func(value []byte) error {
+				var id storage.PeerID
+				copy(id[:], item.Key()[21:])
+				peer, ok := decodePeer(value)
+				if !ok {
+					stale = append(stale, item.KeyCopy(nil))
+					return nil
+				}
+
+				key := seenKey(hash, peer.LastSeen, id)
+				_, isIndexed := indexed[string(key)]
+				delete(indexed, string(key))
+				if peer.LastSeen < cutoff {
+					stale = append(stale, item.KeyCopy(nil))
+					if isIndexed {
+						orphaned = append(orphaned, key)
+					}
+					return nil
+				}
+
+				if !isIndexed {
+					unindexed = append(unindexed, key)
+				}
+				if peer.Complete {
+					counts.complete++
+				} else {
+					counts.incomplete++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for key := range indexed {
+			orphaned = append(orphaned, []byte(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if expired, err = db.batch(stale, func(txn *badger.Txn, key []byte) error {
+		return txn.Delete(key)
+	}); err != nil {
+		return
+	}
+	if _, err = db.batch(orphaned, func(txn *badger.Txn, key []byte) error {
+		return txn.Delete(key)
+	}); err != nil {
+		return
+	}
+	if _, err = db.batch(unindexed, func(txn *badger.Txn, key []byte) error {
+		return txn.SetEntry(backstop(key, nil))
+	}); err != nil {
+		return
+	}
+
+	err = db.update(func(txn *badger.Txn) error {
+		if counts.complete == 0 && counts.incomplete == 0 {
+			return txn.Delete(swarmKey(hash))
+		}
+
+		// keep the completed downloads and transferred bytes
+		old, _, err := getSwarm(txn, hash)
+		if err != nil {
+			return err
+		}
+		counts.downloaded = old.downloaded
+		counts.uploadedBytes = old.uploadedBytes
+		counts.downloadedBytes = old.downloadedBytes
+
+		return txn.SetEntry(counts.entry(hash))
+	})
+
+	return
+}
+
+// batch calls fn on every key in transactions of trimBatchSize keys to stay below the transaction size limit, done is the number of keys committed.
+func (db *Disk) batch(keys [][]byte, fn func(txn *badger.Txn, key []byte) error) (done int, err error) {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > trimBatchSize {
+			batch = batch[:trimBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		err = db.update(func(txn *badger.Txn) error {
+			for _, key := range batch {
+				if err := fn(txn, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		done += len(batch)
+	}
+	return
+}
+
+func (db *Disk) SyncExpvars() error {
+	if ok := db.Check(); !ok {
+		return errors.New("driver not initiated before SyncExpvars")
+	}
+
+	var seeds, leeches int64
+	err := db.store.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.Prefix = []byte{swarmPrefix}
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			err := iterator.Item().Value(func(value []byte) error {
+				counts := decodeSwarm(value)
+				seeds += int64(counts.complete)
+				leeches += int64(counts.incomplete)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stats.Seeds.Store(seeds)
+	stats.Leeches.Store(leeches)
+
+	return nil
+}
+
+// logger adapts zap to the badger logger interface.
+type logger struct {
+	*zap.SugaredLogger
+}
+
+func (l logger) Warningf(format string, args ...interface{}) {
+	l.Warnf(format, args...)
+}
+
+// Infof is logged at debug level as badger is very verbose.
+func (l logger) Infof(format string, args ...interface{}) {
+	l.SugaredLogger.Debugf(format, args...)
+}
+
+// Debugf is dropped as badger is very verbose.
+func (l logger) Debugf(format string, args ...interface{}) {}
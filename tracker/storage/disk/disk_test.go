@@ -0,0 +1,351 @@
+package disk
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/dgraph-io/badger/v3"
+)
+
+var (
+	testHash = storage.Hash{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	testId   = storage.PeerID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	testId2  = storage.PeerID{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+)
+
+func openTestDatabase(t *testing.T, path string) *Disk {
+	config.Config.DB.Disk.Path = path
+	config.Config.DB.Disk.Cache = 1 << 24
+	config.Config.DB.Trim = 0
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	var db Disk
+	if err := db.Init(&NoneBackup{}); err != nil {
+		t.Fatal("failed to init disk database:", err)
+	}
+	t.Cleanup(func() { db.store.Close() })
+	return &db
+}
+
+func TestSaveDrop(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 4321, false, testHash, testId, false, storage.Transfer{}, 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 1 {
+		t.Errorf("HashStats() = %v, %v; want 0, 1", complete, incomplete)
+	}
+
+	// completing moves the peer to the seeds
+	db.Save(netip.MustParseAddr("1.2.3.4"), 4321, true, testHash, testId, false, storage.Transfer{}, 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() after complete = %v, %v; want 1, 0", complete, incomplete)
+	}
+	if hashes := db.Hashes(); hashes != 1 {
+		t.Errorf("Hashes() = %v; want 1", hashes)
+	}
+
+	db.Drop(testHash, testId, netip.MustParseAddr("1.2.3.4"), 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after drop = %v, %v; want 0, 0", complete, incomplete)
+	}
+}
+
+func TestPeerListBytes(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 0x1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("::1"), 0x4321, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	peers4, peers6 := db.PeerListBytes(testHash, 10, storage.Requester{Complete: false})
+	if !bytes.Equal(peers4, []byte{1, 2, 3, 4, 0x12, 0x34}) {
+		t.Errorf("peers4 = %v; want [1 2 3 4 18 52]", peers4)
+	}
+	if !bytes.Equal(peers6, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x43, 0x21}) {
+		t.Errorf("peers6 = %v; want ::1 port 0x4321", peers6)
+	}
+
+	peers4, peers6 = db.PeerListBytes(testHash, 1, storage.Requester{Complete: false})
+	// each family is capped at numWant
+	if len(peers4)/6 != 1 || len(peers6)/18 != 1 {
+		t.Errorf("PeerListBytes(1) returned %v ipv4 and %v ipv6 peers; want 1 and 1", len(peers4)/6, len(peers6)/18)
+	}
+}
+
+func TestPeerList(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+
+	peers := db.PeerList(testHash, 10, storage.Requester{Complete: false}, false)
+	expected := "d7:peer id20:" + string(testId[:]) + "2:ip7:1.2.3.44:porti1234ee"
+	if len(peers) != 1 || string(peers[0]) != expected {
+		t.Errorf("PeerList() = %q; want [%q]", peers, expected)
+	}
+
+	peers = db.PeerList(testHash, 10, storage.Requester{Complete: false}, true)
+	expected = "d2:ip7:1.2.3.44:porti1234ee"
+	if len(peers) != 1 || string(peers[0]) != expected {
+		t.Errorf("PeerList() without peer id = %q; want [%q]", peers, expected)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := t.TempDir()
+	db := openTestDatabase(t, path)
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("4.3.2.1"), 4321, true, testHash, testId2, false, storage.Transfer{}, 0)
+	if err := db.store.Close(); err != nil {
+		t.Fatal("failed to close store:", err)
+	}
+
+	db = openTestDatabase(t, path)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 1 {
+		t.Errorf("HashStats() after reopen = %v, %v; want 1, 1", complete, incomplete)
+	}
+	if hashes := db.Hashes(); hashes != 1 {
+		t.Errorf("Hashes() after reopen = %v; want 1", hashes)
+	}
+	if peers4, _ := db.PeerListBytes(testHash, 10, storage.Requester{Complete: false}); len(peers4) != 12 {
+		t.Errorf("PeerListBytes() after reopen returned %v bytes; want 12", len(peers4))
+	}
+}
+
+func TestTrim(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	config.Config.DB.Expiry = time.Hour
+	if peers, hashes, err := db.trim(); err != nil || peers != 0 || hashes != 0 {
+		t.Errorf("trim() = %v, %v, %v; want 0, 0, nil", peers, hashes, err)
+	}
+
+	config.Config.DB.Expiry = -1 * time.Second
+	if peers, hashes, err := db.trim(); err != nil || peers != 2 || hashes != 1 {
+		t.Errorf("trim() = %v, %v, %v; want 2, 1, nil", peers, hashes, err)
+	}
+	if hashes := db.Hashes(); hashes != 0 {
+		t.Errorf("Hashes() after trim = %v; want 0", hashes)
+	}
+}
+
+func TestTrimFirst(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	// keys only expire on their own long after trim deleted them so the counts always match the peers
+	trimmed := uint64(time.Now().Add(config.Config.DB.Expiry).Unix())
+	err := db.store.View(func(txn *badger.Txn) error {
+		iterator := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			if expires := iterator.Item().ExpiresAt(); expires == 0 || expires <= trimmed {
+				t.Errorf("key %q expires at %v; want a backstop ttl after %v", iterator.Item().Key(), expires, trimmed)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("failed to read store:", err)
+	}
+
+	config.Config.DB.Expiry = -1 * time.Second
+	defer func() { config.Config.DB.Expiry = time.Hour }()
+	db.trim()
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after trim = %v, %v; want 0, 0", complete, incomplete)
+	}
+	if seeds, leeches := stats.Seeds.Load(), stats.Leeches.Load(); seeds != 0 || leeches != 0 {
+		t.Errorf("seeds, leeches after trim = %v, %v; want 0, 0", seeds, leeches)
+	}
+}
+
+func TestDownloaded(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId, true, storage.Transfer{}, 0)
+	// repeated completed announces count once
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId, true, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("4.3.2.1"), 4321, true, testHash, testId2, true, storage.Transfer{}, 0)
+
+	if complete, incomplete, downloaded := db.HashStats(testHash); complete != 2 || incomplete != 0 || downloaded != 2 {
+		t.Errorf("HashStats() = %v, %v, %v; want 2, 0, 2", complete, incomplete, downloaded)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{Uploaded: 100, Downloaded: 1000, Left: 5000}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{Uploaded: 300, Downloaded: 4000, Left: 2000}, 0)
+
+	var counts swarm
+	var peer storage.Peer
+	err := db.store.View(func(txn *badger.Txn) (err error) {
+		if counts, _, err = getSwarm(txn, testHash); err != nil {
+			return
+		}
+		peer, _, err = getPeer(txn, peerKey(testHash, testId))
+		return
+	})
+	if err != nil {
+		t.Fatal("failed to read swarm:", err)
+	}
+
+	if counts.uploadedBytes != 200 || counts.downloadedBytes != 3000 {
+		t.Errorf("swarm transferred = %v, %v; want 200, 3000", counts.uploadedBytes, counts.downloadedBytes)
+	}
+	if peer.Uploaded != 300 || peer.Downloaded != 4000 || peer.Left != 2000 || peer.Announces != 2 {
+		t.Errorf("peer = %+v; want 300 uploaded, 4000 downloaded, 2000 left over 2 announces", peer)
+	}
+}
+
+func TestPeerListRoles(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+	config.Config.Numwant.SeedRatio = 0.5
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("4.3.2.1"), 4321, false, testHash, testId2, false, storage.Transfer{}, 0)
+
+	// seeds only get leeches
+	if peers4, _ := db.PeerListBytes(testHash, 10, storage.Requester{Complete: true}); !bytes.Equal(peers4, []byte{4, 3, 2, 1, 0x10, 0xe1}) {
+		t.Errorf("PeerListBytes() for seed = %v; want only the leech", peers4)
+	}
+	if peers4, _ := db.PeerListBytes(testHash, 10, storage.Requester{Complete: false}); len(peers4) != 12 {
+		t.Errorf("PeerListBytes() for leech returned %v bytes; want 12", len(peers4))
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+
+	ip, other := netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("4.3.2.1")
+
+	// without a key the peer id is owned by its ip
+	if err := db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0); err != nil {
+		t.Fatal("Save() of a new peer was rejected:", err)
+	}
+	if err := db.Save(other, 1234, false, testHash, testId, false, storage.Transfer{}, 0); err != storage.ErrPeerOwned {
+		t.Errorf("Save() from another ip without a key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Drop(testHash, testId, other, 0); err != storage.ErrPeerOwned {
+		t.Errorf("Drop() from another ip without a key = %v; want storage.ErrPeerOwned", err)
+	}
+
+	// a key sent from the owning ip is stored, after that the key owns the peer id from any ip
+	if err := db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Error("Save() with a key from the owning ip was rejected:", err)
+	}
+	if err := db.Save(other, 1234, false, testHash, testId, false, storage.Transfer{}, 0x1234); err != storage.ErrPeerOwned {
+		t.Errorf("Save() with the wrong key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Save(other, 1234, true, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Error("Save() with the key from another ip was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() = %v, %v; want 1, 0", complete, incomplete)
+	}
+
+	if err := db.Drop(testHash, testId, other, 0x1234); err != storage.ErrPeerOwned {
+		t.Errorf("Drop() with the wrong key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Drop(testHash, testId, ip, 0xabcd); err != nil {
+		t.Error("Drop() with the key was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after drop = %v, %v; want 0, 0", complete, incomplete)
+	}
+}
+
+func TestPeerLimit(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+	config.Config.DB.Limits.Peers = 3
+	defer func() { config.Config.DB.Limits.Peers = 0 }()
+
+	// peer i was last seen i seconds ago
+	now := time.Now().Unix()
+	for i := byte(0); i < 3; i++ {
+		db.Save(netip.MustParseAddr("1.2.3.4"), 1000+uint16(i), i == 0, testHash, storage.PeerID{i}, false, storage.Transfer{}, 0)
+		err := db.update(func(txn *badger.Txn) error {
+			old, _, err := getPeer(txn, peerKey(testHash, storage.PeerID{i}))
+			if err != nil {
+				return err
+			}
+			peer := old
+			peer.LastSeen = now - int64(i)
+			return setPeer(txn, testHash, storage.PeerID{i}, &peer, &old)
+		})
+		if err != nil {
+			t.Fatal("failed to age peer:", err)
+		}
+	}
+
+	evictions := stats.Evictions.Load()
+	db.Save(netip.MustParseAddr("1.2.3.4"), 2000, false, testHash, storage.PeerID{3}, false, storage.Transfer{}, 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 2 {
+		t.Errorf("HashStats() = %v, %v; want 1, 2", complete, incomplete)
+	}
+	err := db.store.View(func(txn *badger.Txn) error {
+		if _, exists, err := getPeer(txn, peerKey(testHash, storage.PeerID{2})); err != nil || exists {
+			t.Errorf("oldest peer exists = %v, %v; want false", exists, err)
+		}
+		if _, err := txn.Get(seenKey(testHash, now-2, storage.PeerID{2})); err != badger.ErrKeyNotFound {
+			t.Errorf("index entry of the oldest peer = %v; want badger.ErrKeyNotFound", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted := stats.Evictions.Load() - evictions; evicted != 1 {
+		t.Errorf("evictions = %v; want 1", evicted)
+	}
+}
+
+func TestTrimIndexes(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+	now := time.Now().Unix()
+
+	// a peer stored before the last seen index existed and an index entry without a peer
+	peer := storage.Peer{IP: netip.MustParseAddr("1.2.3.4"), Port: 1000, LastSeen: now}
+	err := db.update(func(txn *badger.Txn) error {
+		if err := txn.Set(peerKey(testHash, testId), encodePeer(&peer)); err != nil {
+			return err
+		}
+		if err := txn.Set(seenKey(testHash, now, storage.PeerID{1}), nil); err != nil {
+			return err
+		}
+		return txn.SetEntry(swarm{incomplete: 1}.entry(testHash))
+	})
+	if err != nil {
+		t.Fatal("failed to store peer:", err)
+	}
+
+	if peers, _, err := db.trim(); err != nil || peers != 0 {
+		t.Errorf("trim() = %v, %v; want 0, nil", peers, err)
+	}
+	err = db.store.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(seenKey(testHash, now, testId)); err != nil {
+			t.Errorf("index entry of the peer = %v; want nil", err)
+		}
+		if _, err := txn.Get(seenKey(testHash, now, storage.PeerID{1})); err != badger.ErrKeyNotFound {
+			t.Errorf("orphaned index entry = %v; want badger.ErrKeyNotFound", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,192 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+)
+
+// HashStats returns number of complete and incomplete peers associated with the hash and its completed downloads
+func (db *Disk) HashStats(hash storage.Hash) (complete, incomplete, downloaded uint32) {
+	err := db.store.View(func(txn *badger.Txn) error {
+		counts, _, err := getSwarm(txn, hash)
+		complete, incomplete, downloaded = counts.complete, counts.incomplete, counts.downloaded
+		return err
+	})
+	if err != nil {
+		config.Logger.Error("Failed to get hash stats from disk", zap.Error(err))
+	}
+
+	return
+}
+
+type listedPeer struct {
+	id   []byte
+	peer storage.Peer
+}
+
+// eachPeer calls fn on up to numWant peers of the swarm other than the requester mixed by its role (see storage.PeerMix).
+// Peers are collected starting at a random peer id and wrapping around so the same peers aren't always returned.
+// If byFamily is set the collected ipv4 and ipv6 peers are mixed separately so fn is called on up to numWant of each,
+// collection still stops at numWant peers of each role so the swarm isn't scanned for a family it doesn't have.
+func (db *Disk) eachPeer(hash storage.Hash, numWant uint, requester storage.Requester, byFamily bool, fn func(id []byte, peer *storage.Peer)) {
+	if numWant == 0 {
+		return
+	}
+
+	prefix := swarmPeersPrefix(hash)
+	start := make([]byte, peerKeySize)
+	copy(start, prefix)
+	binary.LittleEndian.PutUint64(start[len(prefix):], rand.Uint64())
+
+	// seeds only get leeches so they don't need to collect seeds
+	wantSeeds := numWant
+	if requester.Complete {
+		wantSeeds = 0
+	}
+	var seeds, leeches []listedPeer
+
+	err := db.store.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.Prefix = prefix
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+
+		full := func() bool {
+			return uint(len(seeds)) >= wantSeeds && uint(len(leeches)) >= numWant
+		}
+		visit := func() error {
+			item := iterator.Item()
+			return item.Value(func(value []byte) error {
+				peer, ok := decodePeer(value)
+				if !ok {
+					return nil
+				}
+				var id storage.PeerID
+				copy(id[:], item.Key()[len(prefix):])
+				if requester.Is(id, peer.IP, peer.Port) {
+					return nil
+				}
+
+				if peer.Complete && uint(len(seeds)) < wantSeeds {
+					seeds = append(seeds, listedPeer{item.KeyCopy(nil)[len(prefix):], peer})
+				} else if !peer.Complete && uint(len(leeches)) < numWant {
+					leeches = append(leeches, listedPeer{item.KeyCopy(nil)[len(prefix):], peer})
+				}
+				return nil
+			})
+		}
+
+		// start to end of the swarm
+		for iterator.Seek(start); iterator.Valid() && !full(); iterator.Next() {
+			if err := visit(); err != nil {
+				return err
+			}
+		}
+		// wrap around from the beginning up to start
+		for iterator.Rewind(); iterator.Valid() && !full(); iterator.Next() {
+			if bytes.Compare(iterator.Item().Key(), start) >= 0 {
+				break
+			}
+			if err := visit(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		config.Logger.Error("Failed to get peer list from disk", zap.Error(err))
+		return
+	}
+
+	if !byFamily {
+		mixSeeds, mixLeeches := storage.PeerMix(numWant, uint(len(seeds)), uint(len(leeches)), requester.Complete)
+		for _, listed := range append(seeds[:mixSeeds], leeches[:mixLeeches]...) {
+			fn(listed.id, &listed.peer)
+		}
+		return
+	}
+
+	for _, v6 := range []bool{false, true} {
+		familySeeds, familyLeeches := inFamily(seeds, v6), inFamily(leeches, v6)
+		mixSeeds, mixLeeches := storage.PeerMix(numWant, uint(len(familySeeds)), uint(len(familyLeeches)), requester.Complete)
+		for _, listed := range append(familySeeds[:mixSeeds], familyLeeches[:mixLeeches]...) {
+			fn(listed.id, &listed.peer)
+		}
+	}
+}
+
+// inFamily returns the ipv6 peers if v6 is set and the ipv4 peers otherwise.
+func inFamily(peers []listedPeer, v6 bool) (family []listedPeer) {
+	for _, listed := range peers {
+		if listed.peer.IP.Is6() == v6 {
+			family = append(family, listed)
+		}
+	}
+	return
+}
+
+// PeerList returns a peer list for the given hash capped at max
+func (db *Disk) PeerList(hash storage.Hash, numWant uint, requester storage.Requester, removePeerId bool) (peers [][]byte) {
+	dictionary := pools.Dictionaries.Get()
+
+	db.eachPeer(hash, numWant, requester, false, func(id []byte, peer *storage.Peer) {
+		if !removePeerId {
+			dictionary.String("peer id", string(id))
+		}
+		dictionary.String("ip", peer.IP.String())
+		dictionary.Int64("port", int64(peer.Port))
+
+		dictBytes := dictionary.GetBytes()
+		peerBytes := make([]byte, len(dictBytes))
+		copy(peerBytes, dictBytes)
+		peers = append(peers, peerBytes)
+
+		dictionary.Reset()
+	})
+
+	pools.Dictionaries.Put(dictionary)
+
+	return
+}
+
+// PeerListBytes returns byte encoded peer lists of up to numWant ipv4 and up to numWant ipv6 peers for the given hash other than the requester, mixed by its role (see storage.PeerMix)
+func (db *Disk) PeerListBytes(hash storage.Hash, numWant uint, requester storage.Requester) (peers4 []byte, peers6 []byte) {
+	peers4 = pools.Peerlists4.Get()
+	peers6 = pools.Peerlists6.Get()
+
+	var pos4, pos6 int
+	db.eachPeer(hash, numWant, requester, true, func(id []byte, peer *storage.Peer) {
+		if peer.IP.Is6() {
+			if pos6+18 > cap(peers6) {
+				return
+			}
+			copy(peers6[pos6:pos6+16], peer.IP.AsSlice())
+			binary.BigEndian.PutUint16(peers6[pos6+16:pos6+18], peer.Port)
+			pos6 += 18
+		} else {
+			if pos4+6 > cap(peers4) {
+				return
+			}
+			copy(peers4[pos4:pos4+4], peer.IP.AsSlice())
+			binary.BigEndian.PutUint16(peers4[pos4+4:pos4+6], peer.Port)
+			pos4 += 6
+		}
+	})
+
+	peers4 = peers4[:pos4]
+	peers6 = peers6[:pos6]
+
+	return
+}
+
+// Announce saves the peer and answers it through separate calls (see storage.AnnounceSeparately)
+func (db *Disk) Announce(announce *storage.Announce) (storage.AnnounceResponse, error) {
+	return storage.AnnounceSeparately(db, announce)
+}
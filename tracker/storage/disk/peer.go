@@ -0,0 +1,345 @@
+package disk
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// complete + last seen + port + first seen + announces + uploaded + downloaded + left + key
+	peerSize = 1 + 8 + 2 + 8 + 4 + 8 + 8 + 8 + 4
+	// complete + incomplete + downloaded + uploaded bytes + downloaded bytes
+	swarmSize = 4 + 4 + 4 + 8 + 8
+)
+
+// encodePeer encodes a peer as complete (1), last seen (8), port (2), first seen (8), announces (4), uploaded (8), downloaded (8), left (8), key (4), ip (4 or 16).
+func encodePeer(peer *storage.Peer) []byte {
+	addr := peer.IP.AsSlice()
+	value := make([]byte, peerSize+len(addr))
+	if peer.Complete {
+		value[0] = 1
+	}
+	binary.BigEndian.PutUint64(value[1:9], uint64(peer.LastSeen))
+	binary.BigEndian.PutUint16(value[9:11], peer.Port)
+	binary.BigEndian.PutUint64(value[11:19], uint64(peer.FirstSeen))
+	binary.BigEndian.PutUint32(value[19:23], peer.Announces)
+	binary.BigEndian.PutUint64(value[23:31], peer.Uploaded)
+	binary.BigEndian.PutUint64(value[31:39], peer.Downloaded)
+	binary.BigEndian.PutUint64(value[39:47], peer.Left)
+	binary.BigEndian.PutUint32(value[47:51], peer.Key)
+	copy(value[peerSize:], addr)
+	return value
+}
+
+func decodePeer(value []byte) (peer storage.Peer, ok bool) {
+	if len(value) != peerSize+4 && len(value) != peerSize+16 {
+		return
+	}
+
+	peer.Complete = value[0] == 1
+	peer.LastSeen = int64(binary.BigEndian.Uint64(value[1:9]))
+	peer.Port = binary.BigEndian.Uint16(value[9:11])
+	peer.FirstSeen = int64(binary.BigEndian.Uint64(value[11:19]))
+	peer.Announces = binary.BigEndian.Uint32(value[19:23])
+	peer.Uploaded = binary.BigEndian.Uint64(value[23:31])
+	peer.Downloaded = binary.BigEndian.Uint64(value[31:39])
+	peer.Left = binary.BigEndian.Uint64(value[39:47])
+	peer.Key = binary.BigEndian.Uint32(value[47:51])
+	peer.IP, ok = netip.AddrFromSlice(value[peerSize:])
+	return
+}
+
+// swarm holds the peer counts, completed downloads and transferred bytes of a hash.
+type swarm struct {
+	complete   uint32
+	incomplete uint32
+	downloaded uint32
+
+	uploadedBytes   uint64
+	downloadedBytes uint64
+}
+
+func decodeSwarm(value []byte) (counts swarm) {
+	if len(value) != swarmSize {
+		return
+	}
+	counts.complete = binary.BigEndian.Uint32(value[0:4])
+	counts.incomplete = binary.BigEndian.Uint32(value[4:8])
+	counts.downloaded = binary.BigEndian.Uint32(value[8:12])
+	counts.uploadedBytes = binary.BigEndian.Uint64(value[12:20])
+	counts.downloadedBytes = binary.BigEndian.Uint64(value[20:28])
+	return
+}
+
+// entry returns the swarm counts as an entry with the backstop ttl.
+func (counts swarm) entry(hash storage.Hash) *badger.Entry {
+	value := make([]byte, swarmSize)
+	binary.BigEndian.PutUint32(value[0:4], counts.complete)
+	binary.BigEndian.PutUint32(value[4:8], counts.incomplete)
+	binary.BigEndian.PutUint32(value[8:12], counts.downloaded)
+	binary.BigEndian.PutUint64(value[12:20], counts.uploadedBytes)
+	binary.BigEndian.PutUint64(value[20:28], counts.downloadedBytes)
+	return backstop(swarmKey(hash), value)
+}
+
+// getSwarm reads the swarm counts, exists is false if the swarm isn't stored.
+func getSwarm(txn *badger.Txn, hash storage.Hash) (counts swarm, exists bool, err error) {
+	item, err := txn.Get(swarmKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return counts, false, nil
+	} else if err != nil {
+		return
+	}
+
+	err = item.Value(func(value []byte) error {
+		counts = decodeSwarm(value)
+		return nil
+	})
+	return counts, true, err
+}
+
+// getPeer reads a peer, exists is false if the peer isn't stored.
+func getPeer(txn *badger.Txn, key []byte) (peer storage.Peer, exists bool, err error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return peer, false, nil
+	} else if err != nil {
+		return
+	}
+
+	err = item.Value(func(value []byte) error {
+		peer, exists = decodePeer(value)
+		return nil
+	})
+	return
+}
+
+func (db *Disk) Save(ip netip.Addr, port uint16, complete bool, hash storage.Hash, id storage.PeerID, completed bool, transfer storage.Transfer, key uint32) error {
+	dbKey := peerKey(hash, id)
+	now := time.Now().Unix()
+
+	var old storage.Peer
+	var peerExists, swarmExists, owned bool
+	var uploaded, downloaded uint64
+	var evicted []storage.Peer
+
+	mutex := db.lock(hash)
+	err := db.update(func(txn *badger.Txn) error {
+		var err error
+		if old, peerExists, err = getPeer(txn, dbKey); err != nil {
+			return err
+		}
+		if owned = !peerExists || old.Owns(key, ip); !owned {
+			return nil
+		}
+		counts, exists, err := getSwarm(txn, hash)
+		if err != nil {
+			return err
+		}
+		swarmExists = exists
+
+		// make room for a new peer in a full swarm
+		if limit := config.Config.DB.Limits.Peers; !peerExists && limit > 0 && counts.complete+counts.incomplete >= limit {
+			if evicted, err = evict(txn, hash, &counts, counts.complete+counts.incomplete-limit+1); err != nil {
+				return err
+			}
+		}
+
+		if peerExists && old.Complete {
+			counts.complete--
+		} else if peerExists {
+			counts.incomplete--
+		}
+		if complete {
+			counts.complete++
+		} else {
+			counts.incomplete++
+		}
+		// count completed downloads once per peer
+		if completed && !(peerExists && old.Complete) {
+			counts.downloaded++
+		}
+
+		peer := old
+		peer.Complete = complete
+		peer.IP = ip
+		peer.Port = port
+		peer.LastSeen = now
+		if key != 0 {
+			peer.Key = key
+		}
+		uploaded, downloaded = peer.Account(transfer, now, peerExists)
+		counts.uploadedBytes += uploaded
+		counts.downloadedBytes += downloaded
+
+		stored := &old
+		if !peerExists {
+			stored = nil
+		}
+		if err := setPeer(txn, hash, id, &peer, stored); err != nil {
+			return err
+		}
+		return txn.SetEntry(counts.entry(hash))
+	})
+	mutex.Unlock()
+
+	if err != nil {
+		config.Logger.Error("Failed to save peer to disk", zap.Error(err))
+		return nil
+	}
+	if !owned {
+		return storage.ErrPeerOwned
+	}
+
+	if !swarmExists {
+		db.hashes.Add(1)
+	}
+
+	// update metrics
+	stats.AddTransfer(uploaded, downloaded)
+	for _, peer := range evicted {
+		if peer.Complete {
+			stats.Seeds.Add(-1)
+		} else {
+			stats.Leeches.Add(-1)
+		}
+	}
+	stats.Evictions.Add(int64(len(evicted)))
+	if peerExists {
+		if !old.Complete && complete {
+			stats.Leeches.Add(-1)
+			stats.Seeds.Add(1)
+		} else if old.Complete && !complete {
+			stats.Seeds.Add(-1)
+			stats.Leeches.Add(1)
+		}
+	} else if complete {
+		stats.Seeds.Add(1)
+	} else {
+		stats.Leeches.Add(1)
+	}
+
+	return nil
+}
+
+// evict deletes the count least recently seen peers of the swarm and removes them from counts, the swarm must be locked.
+// The oldest peers are read off the front of the last seen index, entries left behind by peers that are gone are deleted on the way.
+func evict(txn *badger.Txn, hash storage.Hash, counts *swarm, count uint32) (evicted []storage.Peer, err error) {
+	options := badger.DefaultIteratorOptions
+	options.PrefetchValues = false
+	options.Prefix = swarmSeenPrefix(hash)
+	iterator := txn.NewIterator(options)
+	defer iterator.Close()
+
+	// writes made while iterating aren't seen by the iterator
+	for iterator.Rewind(); iterator.Valid() && uint32(len(evicted)) < count; iterator.Next() {
+		key := iterator.Item().KeyCopy(nil)
+		var id storage.PeerID
+		copy(id[:], key[29:])
+		lastSeen := int64(binary.BigEndian.Uint64(key[21:29]))
+
+		var peer storage.Peer
+		var exists bool
+		if peer, exists, err = getPeer(txn, peerKey(hash, id)); err != nil {
+			return
+		}
+		if !exists || peer.LastSeen != lastSeen {
+			if err = txn.Delete(key); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = deletePeer(txn, hash, id, &peer); err != nil {
+			return
+		}
+		if peer.Complete {
+			counts.complete--
+		} else {
+			counts.incomplete--
+		}
+		evicted = append(evicted, peer)
+	}
+	return
+}
+
+// setPeer stores the peer and its entry in the last seen index, old is the stored peer or nil if there isn't one.
+func setPeer(txn *badger.Txn, hash storage.Hash, id storage.PeerID, peer *storage.Peer, old *storage.Peer) error {
+	if old != nil && old.LastSeen != peer.LastSeen {
+		if err := txn.Delete(seenKey(hash, old.LastSeen, id)); err != nil {
+			return err
+		}
+	}
+	if err := txn.SetEntry(backstop(seenKey(hash, peer.LastSeen, id), nil)); err != nil {
+		return err
+	}
+	return txn.SetEntry(backstop(peerKey(hash, id), encodePeer(peer)))
+}
+
+// deletePeer deletes the stored peer and its entry in the last seen index.
+func deletePeer(txn *badger.Txn, hash storage.Hash, id storage.PeerID, peer *storage.Peer) error {
+	if err := txn.Delete(seenKey(hash, peer.LastSeen, id)); err != nil {
+		return err
+	}
+	return txn.Delete(peerKey(hash, id))
+}
+
+// Drop deletes the peer unless it's owned by another client
+func (db *Disk) Drop(hash storage.Hash, id storage.PeerID, ip netip.Addr, key uint32) error {
+	dbKey := peerKey(hash, id)
+
+	var old storage.Peer
+	var peerExists, owned bool
+
+	mutex := db.lock(hash)
+	err := db.update(func(txn *badger.Txn) error {
+		var err error
+		if old, peerExists, err = getPeer(txn, dbKey); err != nil || !peerExists {
+			return err
+		}
+		if owned = old.Owns(key, ip); !owned {
+			return nil
+		}
+		counts, _, err := getSwarm(txn, hash)
+		if err != nil {
+			return err
+		}
+
+		if old.Complete {
+			counts.complete--
+		} else {
+			counts.incomplete--
+		}
+
+		if err := deletePeer(txn, hash, id, &old); err != nil {
+			return err
+		}
+		return txn.SetEntry(counts.entry(hash))
+	})
+	mutex.Unlock()
+
+	if err != nil {
+		config.Logger.Error("Failed to drop peer from disk", zap.Error(err))
+		return nil
+	}
+
+	if !peerExists {
+		return nil
+	} else if !owned {
+		return storage.ErrPeerOwned
+	}
+	if old.Complete {
+		stats.Seeds.Add(-1)
+	} else {
+		stats.Leeches.Add(-1)
+	}
+
+	return nil
+}
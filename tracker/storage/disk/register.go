@@ -0,0 +1,18 @@
+package disk
+
+import (
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+func init() {
+	storage.Register(storage.DatabaseInfo{
+		Name: "disk",
+		DB:   &Disk{},
+		Backups: []storage.BackupInfo{
+			{
+				Name: "none",
+				Back: &NoneBackup{},
+			},
+		},
+	})
+}
@@ -0,0 +1,146 @@
+package gomap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+// addressIndex counts the peers of every address across all swarms to enforce `db.limits.address`.
+// An address is an ipv4 address or an ipv6 prefix of `db.limits.prefix` bits, the counts per swarm are kept in PeerMap.addresses.
+// The addresses are split into as many independently locked shards as the database has.
+// Only counts are kept as the limits never need the peers of an address: a new peer over a limit is rejected rather than evicting the older peers of its address,
+// and expired peers are found by the trim through their swarm so an address drops its count when each of its peers is removed.
+type addressIndex struct {
+	prefix int
+	swarm  uint32 // max peers of an address per swarm, 0 for unlimited
+	global uint32 // max peers of an address across all swarms, 0 for unlimited
+
+	shards []addressShard
+}
+
+// addressShard holds the counts of a portion of the addresses under its own lock.
+type addressShard struct {
+	mutex sync.Mutex // locked after the peermap mutex
+	peers map[[16]byte]uint32
+	peak  int // most addresses held since the map was built
+}
+
+// newAddressIndex returns the index for the configured limits split into shards or nil if there are no limits.
+func newAddressIndex(shards int) *addressIndex {
+	limits := config.Config.DB.Limits
+	if limits.Address.Swarm == 0 && limits.Address.Global == 0 {
+		return nil
+	}
+
+	index := &addressIndex{
+		prefix: limits.Prefix,
+		swarm:  limits.Address.Swarm,
+		global: limits.Address.Global,
+		shards: make([]addressShard, shards),
+	}
+	for i := range index.shards {
+		index.shards[i].peers = make(map[[16]byte]uint32)
+	}
+	return index
+}
+
+// shard returns the shard responsible for the address.
+func (index *addressIndex) shard(address [16]byte) *addressShard {
+	if len(index.shards) == 1 {
+		return &index.shards[0]
+	}
+	// ipv6 prefixes end in zeros and ipv4 addresses start with them so every bit is mixed in
+	mixed := binary.LittleEndian.Uint64(address[:8]) ^ binary.LittleEndian.Uint64(address[8:])
+	mixed ^= mixed >> 29
+	mixed *= 0x9e3779b97f4a7c15
+	mixed ^= mixed >> 32
+	return &index.shards[mixed%uint64(len(index.shards))]
+}
+
+// peers returns the number of peers of the address across all swarms.
+func (index *addressIndex) peers(address [16]byte) uint32 {
+	shard := index.shard(address)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.peers[address]
+}
+
+// address returns the address ip is counted under, ipv4 addresses are mapped into ipv6 so the keys hold no pointers.
+func (index *addressIndex) address(ip netip.Addr) [16]byte {
+	if ip.Is4() || ip.Is4In6() {
+		return ip.As16()
+	}
+	prefix, err := ip.WithZone("").Prefix(index.prefix)
+	if err != nil {
+		return ip.As16()
+	}
+	return prefix.Addr().As16()
+}
+
+// acquire counts a peer of address in the peermap, the peermap must be locked.
+// It returns storage.ErrAddressLimit without counting anything if the address already has the maximum number of peers.
+func (index *addressIndex) acquire(peermap *PeerMap, address [16]byte) error {
+	if index.swarm > 0 && peermap.addresses[address] >= index.swarm {
+		return storage.ErrAddressLimit
+	}
+
+	shard := index.shard(address)
+	shard.mutex.Lock()
+	if index.global > 0 && shard.peers[address] >= index.global {
+		shard.mutex.Unlock()
+		return storage.ErrAddressLimit
+	}
+	shard.peers[address]++
+	shard.grew()
+	shard.mutex.Unlock()
+
+	index.count(peermap, address)
+	return nil
+}
+
+// add counts a peer of address in the peermap regardless of the limits, the peermap must be locked.
+func (index *addressIndex) add(peermap *PeerMap, address [16]byte) {
+	shard := index.shard(address)
+	shard.mutex.Lock()
+	shard.peers[address]++
+	shard.grew()
+	shard.mutex.Unlock()
+
+	index.count(peermap, address)
+}
+
+// grew updates the peak of the shard, the mutex must be held.
+func (shard *addressShard) grew() {
+	if len(shard.peers) > shard.peak {
+		shard.peak = len(shard.peers)
+	}
+}
+
+func (index *addressIndex) count(peermap *PeerMap, address [16]byte) {
+	if peermap.addresses == nil {
+		peermap.addresses = make(map[[16]byte]uint32, 1)
+	}
+	peermap.addresses[address]++
+}
+
+// release uncounts a peer of address in the peermap, the peermap must be locked.
+func (index *addressIndex) release(peermap *PeerMap, address [16]byte) {
+	if peermap.addresses[address] <= 1 {
+		delete(peermap.addresses, address)
+	} else {
+		peermap.addresses[address]--
+	}
+
+	shard := index.shard(address)
+	shard.mutex.Lock()
+	if shard.peers[address] <= 1 {
+		delete(shard.peers, address)
+	} else {
+		shard.peers[address]--
+	}
+	shard.mutex.Unlock()
+}
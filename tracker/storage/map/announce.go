@@ -0,0 +1,46 @@
+package gomap
+
+import (
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+// Announce saves the peer and answers it with the counts and a peer list of the swarm, all under one lock of the peermap
+func (memoryDb *Memory) Announce(announce *storage.Announce) (response storage.AnnounceResponse, err error) {
+	ip, port := announce.Addr.Addr(), announce.Addr.Port()
+	requester := announce.Requester()
+
+	var peers4, peers6 []byte
+	if announce.Compact {
+		peers4 = pools.Peerlists4.Get()
+		peers6 = pools.Peerlists6.Get()
+	}
+
+	peermap := memoryDb.lockPeermap(announce.Hash)
+	change, err := memoryDb.upsert(peermap, ip, port, announce.Complete, announce.Hash, announce.ID, announce.Completed, announce.Transfer, announce.Key, true)
+	if err != nil {
+		empty := peermap.len() == 0
+		peermap.mutex.Unlock()
+		if empty {
+			memoryDb.removeEmpty(announce.Hash, peermap)
+		}
+		if announce.Compact {
+			pools.Peerlists4.Put(peers4)
+			pools.Peerlists6.Put(peers6)
+		}
+		return
+	}
+
+	response.Complete = peermap.Complete
+	response.Incomplete = peermap.Incomplete
+	response.Downloaded = peermap.Downloaded
+	if announce.Compact {
+		response.Peers4, response.Peers6 = peermap.peerListBytes(peers4, peers6, announce.NumWant, &requester)
+	} else {
+		response.Peers = peermap.peerList(announce.NumWant, &requester, announce.NoPeerID)
+	}
+	peermap.mutex.Unlock()
+
+	change.updateMetrics(ip, announce.Complete)
+	return
+}
@@ -0,0 +1,88 @@
+package gomap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+func TestAnnounce(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	db, hash := dbWithMixedPeers(5, 2)
+	announce := storage.Announce{
+		Hash:      hash,
+		ID:        mixedPeerID(100),
+		Addr:      netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), 100),
+		Completed: true,
+		Complete:  true,
+		NumWant:   10,
+		Compact:   true,
+	}
+
+	response, err := db.Announce(&announce)
+	if err != nil {
+		t.Fatal("Announce() failed:", err)
+	}
+	if response.Complete != 1 || response.Incomplete != 7 || response.Downloaded != 1 {
+		t.Errorf("Announce() counts = %v, %v, %v; want 1, 7, 1", response.Complete, response.Incomplete, response.Downloaded)
+	}
+	if len(response.Peers4) != 5*6 || len(response.Peers6) != 2*18 {
+		t.Fatalf("Announce() returned %v ipv4 and %v ipv6 peers; want 5 and 2", len(response.Peers4)/6, len(response.Peers6)/18)
+	}
+	for pos := 0; pos < len(response.Peers4); pos += 6 {
+		if port := binary.BigEndian.Uint16(response.Peers4[pos+4:]); port == 100 {
+			t.Error("Announce() returned the requester")
+		}
+	}
+	pools.Peerlists4.Put(response.Peers4)
+	pools.Peerlists6.Put(response.Peers6)
+
+	peer, ok := db.shard(hash).hashmap[hash].get(announce.ID)
+	if !ok || !peer.Complete || peer.Port != 100 {
+		t.Errorf("Announce() saved %+v, %v; want the complete peer on port 100", peer, ok)
+	}
+
+	announce.Compact = false
+	announce.NoPeerID = true
+	if response, err = db.Announce(&announce); err != nil || len(response.Peers) != 7 {
+		t.Errorf("Announce() returned %v peers, %v; want 7", len(response.Peers), err)
+	}
+	if response.Downloaded != 1 {
+		t.Errorf("Announce() downloaded = %v; want 1", response.Downloaded)
+	}
+
+	// another client can't announce as the peer
+	announce.Addr = netip.AddrPortFrom(netip.MustParseAddr("4.3.2.1"), 100)
+	if _, err = db.Announce(&announce); err != storage.ErrPeerOwned {
+		t.Errorf("Announce() from another client = %v; want %v", err, storage.ErrPeerOwned)
+	}
+	checkSwarm(t, db.shard(hash).hashmap[hash])
+}
+
+func BenchmarkAnnounce(b *testing.B) {
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(200)
+
+	db, hash := dbWithMixedPeers(numPeers, 0)
+	announce := storage.Announce{
+		Hash:    hash,
+		Addr:    netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), 6969),
+		NumWant: 200,
+		Compact: true,
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		announce.ID = mixedPeerID(n % numPeers)
+		response, _ := db.Announce(&announce)
+		pools.Peerlists4.Put(response.Peers4)
+		pools.Peerlists6.Put(response.Peers6)
+	}
+}
@@ -1,7 +1,10 @@
 package gomap
 
 import (
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/crimist/trakx/config"
@@ -11,6 +14,7 @@ import (
 )
 
 // FileBackup backs up the peer database to a local file.
+// The last `db.backup.generations` backups are kept as "<path>", "<path>.1", "<path>.2"... from newest to oldest.
 type FileBackup struct {
 	db *Memory
 }
@@ -23,60 +27,145 @@ func (bck *FileBackup) Init(db storage.Database) error {
 	return nil
 }
 
+// generations returns the number of backups kept.
+func generations() int {
+	if config.Config.DB.Backup.Generations < 1 {
+		return 1
+	}
+	return config.Config.DB.Backup.Generations
+}
+
+// generationPath returns the path of the nth newest backup.
+func generationPath(generation int) string {
+	if generation == 0 {
+		return config.Config.DB.Backup.Path
+	}
+	return config.Config.DB.Backup.Path + "." + strconv.Itoa(generation)
+}
+
+// Load loads the newest backup that decodes in full, falling back to older generations.
+// If every backup that decodes skipped corrupt or truncated blocks the newest of them is loaded.
 func (bck *FileBackup) Load() error {
 	config.Logger.Info("Loading database from file")
 	start := time.Now()
 
-	_, err := os.Stat(config.Config.DB.Backup.Path)
-	if err != nil {
-		// If the file doesn't exist than create an empty database and return success
-		if os.IsNotExist(err) {
-			bck.db.make()
-			config.Logger.Info("Database file not found, created empty database", zap.String("filepath", config.Config.DB.Backup.Path))
-			return nil
+	var found bool
+	partial := -1 // newest generation that skipped blocks
+	for generation := 0; generation < generations(); generation++ {
+		filename := generationPath(generation)
+		if _, err := os.Stat(filename); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrap(err, "failed to stat file")
+		}
+		found = true
+
+		peers, hashes, err := bck.db.loadFile(filename)
+		var skipped *skippedBlocksError
+		if errors.As(err, &skipped) {
+			config.Logger.Warn("Database file skipped blocks, trying older generation", zap.String("filepath", filename), zap.Error(err))
+			if partial < 0 {
+				partial = generation
+			}
+			continue
+		} else if err != nil {
+			config.Logger.Warn("Failed to load database file, trying older generation", zap.String("filepath", filename), zap.Error(err))
+			continue
 		}
 
-		return errors.Wrap(err, "failed to stat file")
+		config.Logger.Info("Loaded database", zap.String("filepath", filename), zap.Int("generation", generation), zap.Duration("time", time.Since(start)), zap.Int("peers", peers), zap.Int("hashes", hashes))
+		return nil
 	}
 
-	peers, hashes, err := bck.db.loadFile(config.Config.DB.Backup.Path)
-	if err != nil {
-		return errors.Wrap(err, "failed to load file")
+	// what's left of a damaged backup beats an empty database
+	if partial >= 0 {
+		filename := generationPath(partial)
+		peers, hashes, err := bck.db.loadFile(filename)
+		config.Logger.Warn("Loaded database with skipped blocks", zap.String("filepath", filename), zap.Int("generation", partial), zap.Duration("time", time.Since(start)), zap.Int("peers", peers), zap.Int("hashes", hashes), zap.Error(err))
+		return nil
+	}
+
+	if found {
+		return errors.New("failed to load any backup generation")
 	}
 
-	config.Logger.Info("Loaded database", zap.Duration("time", time.Since(start)), zap.Int("peers", peers), zap.Int("hashes", hashes))
+	// If no file exists than create an empty database and return success
+	bck.db.make()
+	config.Logger.Info("Database file not found, created empty database", zap.String("filepath", config.Config.DB.Backup.Path))
 
 	return nil
 }
 
 func (db *Memory) loadFile(filename string) (peers int, hashes int, err error) {
-	data, err := os.ReadFile(filename)
+	file, err := os.Open(filename)
 	if err != nil {
-		err = errors.Wrap(err, "failed to read file from disk")
+		err = errors.Wrap(err, "failed to open file")
 		return
 	}
+	defer file.Close()
 
-	peers, hashes, err = db.decodeBinary(data)
-	err = errors.Wrap(err, "failed to decode saved data")
-
-	return
+	return db.readBackup(file)
 }
 
-func (bck *FileBackup) writeFile() (int, error) {
-	var encoded []byte
-	var err error
+// writeFileAtomic writes to a temporary file which is synced and renamed over filename once complete, so filename is never partially written.
+// rotate, if set, is called just before the rename.
+func writeFileAtomic(filename string, write func(io.Writer) error, rotate func() error) (int64, error) {
+	temp := filename + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create file")
+	}
+	defer os.Remove(temp)
+
+	if err := write(file); err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, errors.Wrap(err, "failed to sync file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, errors.Wrap(err, "failed to stat file")
+	}
+	if err := file.Close(); err != nil {
+		return 0, errors.Wrap(err, "failed to close file")
+	}
 
-	encoded, err = bck.db.encodeBinary()
+	if rotate != nil {
+		if err := rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Rename(temp, filename); err != nil {
+		return 0, errors.Wrap(err, "failed to rename file")
+	}
 
+	// sync the directory so the rename survives a crash
+	dir, err := os.Open(filepath.Dir(filename))
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to encode db")
+		return 0, errors.Wrap(err, "failed to open directory")
 	}
+	defer dir.Close()
+
+	return info.Size(), errors.Wrap(dir.Sync(), "failed to sync directory")
+}
 
-	if err := os.WriteFile(config.Config.DB.Backup.Path, encoded, 0644); err != nil {
-		return 0, errors.Wrap(err, "failed to write file to disk")
+// rotate shifts every generation back by one, dropping the oldest.
+func (bck *FileBackup) rotate() error {
+	for generation := generations() - 1; generation > 0; generation-- {
+		if err := os.Rename(generationPath(generation-1), generationPath(generation)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rotate backup generation")
+		}
 	}
+	return nil
+}
 
-	return len(encoded), nil
+func (bck *FileBackup) writeFile() (int64, error) {
+	return writeFileAtomic(config.Config.DB.Backup.Path, bck.db.writeBackup, bck.rotate)
 }
 
 // Save encodes and writes the database to a file
@@ -89,7 +178,7 @@ func (bck *FileBackup) Save() error {
 		return errors.Wrap(err, "failed to save database")
 	}
 
-	config.Logger.Info("Wrote database", zap.Int("size (bytes)", size), zap.Int("hashes", bck.db.Hashes()), zap.Duration("duration", time.Since(start)))
+	config.Logger.Info("Wrote database", zap.Int64("size (bytes)", size), zap.Int("hashes", bck.db.Hashes()), zap.Duration("duration", time.Since(start)))
 
 	return nil
 }
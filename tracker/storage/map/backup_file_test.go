@@ -0,0 +1,106 @@
+package gomap
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+)
+
+func TestFileBackupGenerations(t *testing.T) {
+	config.Config.DB.Backup.Path = filepath.Join(t.TempDir(), "trakx.db")
+	config.Config.DB.Backup.Generations = 3
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	db := dbWithHashesAndPeers(10, 1)
+	bck := FileBackup{db: db}
+	for i := 0; i < 4; i++ {
+		if err := bck.Save(); err != nil {
+			t.Fatal("Save() threw error: ", err)
+		}
+	}
+
+	for generation := 0; generation < 3; generation++ {
+		if _, err := os.Stat(generationPath(generation)); err != nil {
+			t.Errorf("generation %v missing: %v", generation, err)
+		}
+	}
+	if _, err := os.Stat(generationPath(3)); !os.IsNotExist(err) {
+		t.Errorf("generation 3 exists with 3 generations kept")
+	}
+	if _, err := os.Stat(config.Config.DB.Backup.Path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind")
+	}
+
+	// newest generation is unreadable so the next one is loaded
+	header := binaryHeader{version: binaryVersion + 1}
+	if err := os.WriteFile(generationPath(0), header.marshal(), 0644); err != nil {
+		t.Fatal("failed to corrupt newest generation: ", err)
+	}
+
+	var loaded Memory
+	bck = FileBackup{db: &loaded}
+	if err := bck.Load(); err != nil {
+		t.Fatal("Load() threw error: ", err)
+	}
+	if hashes := loaded.Hashes(); hashes != 10 {
+		t.Errorf("Hashes() after fallback = %v; want 10", hashes)
+	}
+
+	// every generation is unreadable
+	for generation := 1; generation < 3; generation++ {
+		if err := os.WriteFile(generationPath(generation), header.marshal(), 0644); err != nil {
+			t.Fatal("failed to corrupt generation: ", err)
+		}
+	}
+	if err := bck.Load(); err == nil {
+		t.Error("Load() with no readable generation didn't error")
+	}
+}
+
+func TestFileBackupSkippedBlocks(t *testing.T) {
+	config.Config.DB.Backup.Path = filepath.Join(t.TempDir(), "trakx.db")
+	config.Config.DB.Backup.Generations = 2
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	// writes a backup of the given number of hashes, truncated ones end in the start of a block
+	write := func(generation, hashes int, truncated bool) {
+		var data bytes.Buffer
+		if err := dbWithHashesAndPeers(hashes, 1).encodeBinary(&data); err != nil {
+			t.Fatal("encodeBinary threw error: ", err)
+		}
+		if truncated {
+			data.Write(blockMarker[:])
+		}
+		if err := os.WriteFile(generationPath(generation), data.Bytes(), 0644); err != nil {
+			t.Fatal("failed to write generation: ", err)
+		}
+	}
+
+	// the older generation loads in full
+	write(0, 20, true)
+	write(1, 10, false)
+	var loaded Memory
+	bck := FileBackup{db: &loaded}
+	if err := bck.Load(); err != nil {
+		t.Fatal("Load() threw error: ", err)
+	}
+	if hashes := loaded.Hashes(); hashes != 10 {
+		t.Errorf("Hashes() after fallback = %v; want 10", hashes)
+	}
+
+	// every generation skipped blocks so the newest is kept
+	write(1, 10, true)
+	if err := bck.Load(); err != nil {
+		t.Fatal("Load() threw error: ", err)
+	}
+	if hashes := loaded.Hashes(); hashes != 20 {
+		t.Errorf("Hashes() with every generation damaged = %v; want 20", hashes)
+	}
+}
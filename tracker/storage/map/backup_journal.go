@@ -0,0 +1,422 @@
+package gomap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/crimist/trakx/tracker/utils"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// interval journaled changes are flushed and synced to disk
+	journalFlushInterval = 1 * time.Second
+	// number of buffers records are spread over by hash
+	journalBuffers = 64
+
+	journalSave  byte = 's'
+	journalDrop  byte = 'd'
+	journalSwarm byte = 'w'
+
+	// op + hash + peer id
+	journalHeaderSize = 1 + 20 + 20
+	// complete + lastseen + port + firstseen + announces + uploaded + downloaded + left + key + ip length
+	journalSaveSize = 1 + 8 + 2 + 8 + 4 + 8 + 8 + 8 + 4 + 1
+	// downloaded count + uploaded bytes + downloaded bytes
+	journalSwarmSize = 4 + 8 + 8
+)
+
+// size at which the journal is compacted into the snapshot on flush, so it's bounded without periodic saves
+var journalCompactSize int64 = 256 << 20
+
+// journal appends every change to the database to a write ahead log.
+// Records go to a buffer picked by their hash like the shards are, which keeps the records of a swarm in order without a lock shared by every announce, and the buffers are written to the file on flush.
+type journal struct {
+	buffers [journalBuffers]journalBuffer
+
+	mutex sync.Mutex // serializes flushing, rotating and closing
+	file  *os.File   // nil once closed
+	size  int64      // bytes written to the file
+	spare []byte     // written out records reused as the next drained buffer
+}
+
+type journalBuffer struct {
+	mutex   sync.Mutex
+	records []byte
+}
+
+func openJournal(filename string) (*journal, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{
+		file: file,
+	}, nil
+}
+
+// write appends the record to the buffer of the hash.
+func (j *journal) write(hash storage.Hash, record []byte) {
+	buffer := &j.buffers[binary.LittleEndian.Uint32(hash[:4])%journalBuffers]
+	buffer.mutex.Lock()
+	buffer.records = append(buffer.records, record...)
+	buffer.mutex.Unlock()
+}
+
+// save records the state of a peer, must be called under the peermap lock so records of a peer are ordered.
+func (j *journal) save(hash storage.Hash, id storage.PeerID, peer *storage.Peer) {
+	var record [journalHeaderSize + journalSaveSize + 16]byte
+	record[0] = journalSave
+	copy(record[1:21], hash[:])
+	copy(record[21:41], id[:])
+	if peer.Complete {
+		record[41] = 1
+	}
+	binary.LittleEndian.PutUint64(record[42:50], uint64(peer.LastSeen))
+	binary.LittleEndian.PutUint16(record[50:52], peer.Port)
+	binary.LittleEndian.PutUint64(record[52:60], uint64(peer.FirstSeen))
+	binary.LittleEndian.PutUint32(record[60:64], peer.Announces)
+	binary.LittleEndian.PutUint64(record[64:72], peer.Uploaded)
+	binary.LittleEndian.PutUint64(record[72:80], peer.Downloaded)
+	binary.LittleEndian.PutUint64(record[80:88], peer.Left)
+	binary.LittleEndian.PutUint32(record[88:92], peer.Key)
+	addr := peer.IP.AsSlice()
+	record[92] = byte(len(addr))
+	size := journalHeaderSize + journalSaveSize + copy(record[93:], addr)
+
+	j.write(hash, record[:size])
+}
+
+// drop records the removal of a peer.
+func (j *journal) drop(hash storage.Hash, id storage.PeerID) {
+	var record [journalHeaderSize]byte
+	record[0] = journalDrop
+	copy(record[1:21], hash[:])
+	copy(record[21:41], id[:])
+	j.write(hash, record[:])
+}
+
+// swarm records the completed downloads and transferred bytes of a hash, must be called under the peermap lock.
+// The totals are absolute rather than increments so replaying records already in the snapshot doesn't count them twice.
+func (j *journal) swarm(hash storage.Hash, peermap *PeerMap) {
+	var record [journalHeaderSize + journalSwarmSize]byte
+	record[0] = journalSwarm
+	copy(record[1:21], hash[:])
+	binary.LittleEndian.PutUint32(record[41:45], peermap.Downloaded)
+	binary.LittleEndian.PutUint64(record[45:53], peermap.UploadedBytes)
+	binary.LittleEndian.PutUint64(record[53:61], peermap.DownloadedBytes)
+	j.write(hash, record[:])
+}
+
+// flush writes the buffered records to the file and syncs it, journal must be locked.
+func (j *journal) flush() error {
+	if j.file == nil {
+		return nil
+	}
+
+	for i := range j.buffers {
+		buffer := &j.buffers[i]
+		buffer.mutex.Lock()
+		records := buffer.records
+		buffer.records = j.spare[:0]
+		buffer.mutex.Unlock()
+
+		j.spare = records
+		if len(records) == 0 {
+			continue
+		}
+		if _, err := j.file.Write(records); err != nil {
+			return errors.Wrap(err, "failed to flush journal")
+		}
+		j.size += int64(len(records))
+	}
+	return errors.Wrap(j.file.Sync(), "failed to sync journal")
+}
+
+// close flushes the journal and closes its file, records made afterwards are never written.
+func (j *journal) close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.flush()
+	if closeErr := j.file.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "failed to close journal")
+	}
+	j.file = nil
+	return err
+}
+
+// rotate moves the journal to `rotated` and continues in a new journal.
+// If `rotated` still exists because the last compaction failed it's left untouched and the current journal is kept.
+func (j *journal) rotate(filename, rotated string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+	if err := j.flush(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(rotated); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to stat rotated journal")
+	}
+
+	if err := os.Rename(filename, rotated); err != nil {
+		return errors.Wrap(err, "failed to rotate journal")
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open journal")
+	}
+
+	j.file.Close()
+	j.file = file
+	j.size = 0
+
+	return nil
+}
+
+// JournalBackup logs every change to a journal and compacts it into a snapshot periodically and whenever it reaches journalCompactSize.
+// On load the snapshot is restored and the journal replayed on top of it.
+type JournalBackup struct {
+	db    *Memory
+	mutex sync.Mutex // serializes compactions
+}
+
+func (bck *JournalBackup) Init(db storage.Database) error {
+	bck.db = db.(*Memory)
+	if bck.db == nil {
+		return errors.New("database is not type `Memory` for `JournalBackup`")
+	}
+	return nil
+}
+
+func (bck *JournalBackup) paths() (snapshot, journal, rotated string) {
+	snapshot = config.Config.DB.Backup.Path
+	journal = snapshot + ".journal"
+	rotated = journal + ".old"
+	return
+}
+
+func (bck *JournalBackup) Load() error {
+	config.Logger.Info("Loading database from journal")
+	start := time.Now()
+	snapshotPath, journalPath, rotatedPath := bck.paths()
+
+	if _, err := os.Stat(snapshotPath); err == nil {
+		// there's only one snapshot so what's left of a damaged one is kept
+		var skipped *skippedBlocksError
+		if _, _, err := bck.db.loadFile(snapshotPath); errors.As(err, &skipped) {
+			config.Logger.Warn("Snapshot skipped blocks", zap.String("filepath", snapshotPath), zap.Error(err))
+		} else if err != nil {
+			return errors.Wrap(err, "failed to load snapshot")
+		}
+	} else if os.IsNotExist(err) {
+		bck.db.make()
+	} else {
+		return errors.Wrap(err, "failed to stat snapshot")
+	}
+
+	// the rotated journal only exists if the last compaction didn't complete, it's older than the current one
+	var records int
+	for _, filename := range []string{rotatedPath, journalPath} {
+		replayed, err := bck.db.replayJournal(filename)
+		if err != nil {
+			return errors.Wrap(err, "failed to replay journal")
+		}
+		records += replayed
+	}
+
+	// compact everything into a fresh snapshot so the journals can be discarded
+	if err := bck.db.writeSnapshot(snapshotPath); err != nil {
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+	for _, filename := range []string{rotatedPath, journalPath} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove journal")
+		}
+	}
+
+	journal, err := openJournal(journalPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open journal")
+	}
+	bck.db.journal = journal
+
+	go utils.RunOn(journalFlushInterval, bck.flush)
+
+	config.Logger.Info("Loaded database", zap.Duration("time", time.Since(start)), zap.Int("hashes", bck.db.Hashes()), zap.Int("replayed", records))
+
+	return nil
+}
+
+// flush writes the journaled changes to disk and compacts the journal once it reached journalCompactSize.
+func (bck *JournalBackup) flush() {
+	journal := bck.db.journal
+	journal.mutex.Lock()
+	err := journal.flush()
+	full := journal.size >= journalCompactSize
+	journal.mutex.Unlock()
+
+	if err != nil {
+		config.Logger.Error("Failed to flush journal", zap.Error(err))
+		return
+	}
+	if full {
+		if err := bck.Save(); err != nil {
+			config.Logger.Error("Failed to compact full journal", zap.Error(err))
+		}
+	}
+}
+
+// Save compacts the journal into a snapshot
+func (bck *JournalBackup) Save() error {
+	bck.mutex.Lock()
+	defer bck.mutex.Unlock()
+
+	config.Logger.Info("Compacting journal")
+	start := time.Now()
+	snapshotPath, journalPath, rotatedPath := bck.paths()
+
+	if err := bck.db.journal.rotate(journalPath, rotatedPath); err != nil {
+		return errors.Wrap(err, "failed to rotate journal")
+	}
+
+	// the snapshot contains everything in the rotated journal, changes made while encoding end up in both which is fine as replay is idempotent
+	if err := bck.db.writeSnapshot(snapshotPath); err != nil {
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+	if err := os.Remove(rotatedPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove rotated journal")
+	}
+
+	config.Logger.Info("Compacted journal", zap.Int("hashes", bck.db.Hashes()), zap.Duration("duration", time.Since(start)))
+
+	return nil
+}
+
+// writeSnapshot atomically replaces the file with the encoded database.
+func (db *Memory) writeSnapshot(filename string) error {
+	_, err := writeFileAtomic(filename, db.writeBackup, nil)
+	return err
+}
+
+// replayJournal applies the records in the journal to the database.
+// A partially written record at the end of the journal from a crash is ignored.
+func (db *Memory) replayJournal(filename string) (records int, err error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var record [journalHeaderSize + journalSaveSize + 16]byte
+
+	for {
+		if _, err = io.ReadFull(reader, record[:journalHeaderSize]); err != nil {
+			break
+		}
+
+		var hash storage.Hash
+		var id storage.PeerID
+		copy(hash[:], record[1:21])
+		copy(id[:], record[21:41])
+
+		switch record[0] {
+		case journalSave:
+			body := record[journalHeaderSize : journalHeaderSize+journalSaveSize]
+			if _, err = io.ReadFull(reader, body); err != nil {
+				break
+			}
+			var ip netip.Addr
+			if ip, err = readJournalAddr(reader, record[journalHeaderSize+journalSaveSize:], body[journalSaveSize-1]); err != nil {
+				break
+			}
+
+			db.restore(hash, id, storage.Peer{
+				Complete:   body[0] == 1,
+				IP:         ip,
+				Port:       binary.LittleEndian.Uint16(body[9:11]),
+				LastSeen:   int64(binary.LittleEndian.Uint64(body[1:9])),
+				FirstSeen:  int64(binary.LittleEndian.Uint64(body[11:19])),
+				Announces:  binary.LittleEndian.Uint32(body[19:23]),
+				Uploaded:   binary.LittleEndian.Uint64(body[23:31]),
+				Downloaded: binary.LittleEndian.Uint64(body[31:39]),
+				Left:       binary.LittleEndian.Uint64(body[39:47]),
+				Key:        binary.LittleEndian.Uint32(body[47:51]),
+			})
+		case journalDrop:
+			db.drop(hash, id)
+		case journalSwarm:
+			body := record[journalHeaderSize : journalHeaderSize+journalSwarmSize]
+			if _, err = io.ReadFull(reader, body); err != nil {
+				break
+			}
+			if peermap, ok := db.peermap(hash); ok {
+				peermap.mutex.Lock()
+				peermap.Downloaded = binary.LittleEndian.Uint32(body[0:4])
+				peermap.UploadedBytes = binary.LittleEndian.Uint64(body[4:12])
+				peermap.DownloadedBytes = binary.LittleEndian.Uint64(body[12:20])
+				peermap.mutex.Unlock()
+			}
+		default:
+			err = errors.Errorf("invalid record type %q", record[0])
+		}
+		if err != nil {
+			break
+		}
+
+		records++
+	}
+
+	if errors.Is(err, io.EOF) {
+		err = nil
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		config.Logger.Warn("Journal ends with a partial record", zap.String("filepath", filename), zap.Int("records", records))
+		err = nil
+	}
+
+	return
+}
+
+// readJournalAddr reads an ip of length addrLen into buf.
+func readJournalAddr(reader io.Reader, buf []byte, addrLen byte) (ip netip.Addr, err error) {
+	if addrLen != 4 && addrLen != 16 {
+		return ip, errors.Errorf("invalid address length %d", addrLen)
+	}
+	if _, err = io.ReadFull(reader, buf[:addrLen]); err != nil {
+		return
+	}
+	ip, _ = netip.AddrFromSlice(buf[:addrLen])
+	return
+}
+
+// restore saves the peer as it was recorded.
+func (db *Memory) restore(hash storage.Hash, id storage.PeerID, peer storage.Peer) {
+	// the record is trusted, replace the peer instead of checking who owns it or the address limits
+	db.drop(hash, id)
+	db.save(peer.IP, peer.Port, peer.Complete, hash, id, false, storage.Transfer{}, peer.Key, false)
+
+	peermap, _ := db.peermap(hash)
+	peermap.mutex.Lock()
+	peermap.update(peermap.ids[id], &peer)
+	peermap.mutex.Unlock()
+}
@@ -0,0 +1,165 @@
+package gomap
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+func openJournalDatabase(t *testing.T) *Memory {
+	config.Config.DB.Backup.Frequency = 0
+	config.Config.DB.Trim = 0
+	config.Config.DB.Expiry = time.Hour
+
+	var db Memory
+	if err := db.Init(&JournalBackup{}); err != nil {
+		t.Fatal("failed to init database with journal:", err)
+	}
+	return &db
+}
+
+// crash flushes the journal and abandons the database without compacting it.
+func crash(db *Memory) {
+	db.journal.close()
+}
+
+func TestJournalReplay(t *testing.T) {
+	pools.Initialize(10)
+	config.Config.DB.Backup.Path = filepath.Join(t.TempDir(), "trakx.db")
+	testId2 := storage.PeerID{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+	testIP6 := netip.MustParseAddr("::1")
+
+	db := openJournalDatabase(t)
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(testIP6, 4321, false, testHash, testId2, false, storage.Transfer{}, 0)
+	if err := db.backup.Save(); err != nil {
+		t.Fatal("failed to compact journal:", err)
+	}
+	// changes after the snapshot only exist in the journal
+	db.Save(testIP6, 4321, true, testHash, testId2, true, storage.Transfer{Uploaded: 10, Downloaded: 20}, 0xabcd)
+	db.Drop(testHash, testId, testIP, 0)
+	crash(db)
+
+	db = openJournalDatabase(t)
+	peermap, ok := db.peermap(testHash)
+	if !ok {
+		t.Fatal("hash missing after replay")
+	}
+	if _, ok := peermap.get(testId); ok {
+		t.Error("dropped peer exists after replay")
+	}
+	peer, ok := peermap.get(testId2)
+	if !ok {
+		t.Fatal("peer missing after replay")
+	}
+	if !peer.Complete || peer.IP != testIP6 || peer.Port != 4321 || peer.Key != 0xabcd {
+		t.Errorf("peer after replay = %+v; want complete [::1]:4321 with key 0xabcd", peer)
+	}
+	if peermap.Complete != 1 || peermap.Incomplete != 0 || peermap.Downloaded != 1 {
+		t.Errorf("counts after replay = %v, %v, %v; want 1, 0, 1", peermap.Complete, peermap.Incomplete, peermap.Downloaded)
+	}
+	if peer.Uploaded != 10 || peer.Downloaded != 20 || peer.Announces != 2 {
+		t.Errorf("peer transfer after replay = %v, %v over %v announces; want 10, 20 over 2", peer.Uploaded, peer.Downloaded, peer.Announces)
+	}
+	if peermap.UploadedBytes != 10 || peermap.DownloadedBytes != 20 {
+		t.Errorf("swarm transferred after replay = %v, %v; want 10, 20", peermap.UploadedBytes, peermap.DownloadedBytes)
+	}
+	crash(db)
+}
+
+func TestJournalPartialRecord(t *testing.T) {
+	pools.Initialize(10)
+	config.Config.DB.Backup.Path = filepath.Join(t.TempDir(), "trakx.db")
+
+	db := openJournalDatabase(t)
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	crash(db)
+
+	// a record cut short by the crash
+	file, err := os.OpenFile(config.Config.DB.Backup.Path+".journal", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	file.Write([]byte{journalSave, 1, 2, 3})
+	file.Close()
+
+	db = openJournalDatabase(t)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 1 {
+		t.Errorf("HashStats() after replay = %v, %v; want 0, 1", complete, incomplete)
+	}
+	crash(db)
+}
+
+func TestJournalConcurrentSaves(t *testing.T) {
+	pools.Initialize(10)
+	config.Config.DB.Backup.Path = filepath.Join(t.TempDir(), "trakx.db")
+
+	// every worker announces its own peers into swarms shared with the others
+	const workers, peers = 8, 100
+	db := openJournalDatabase(t)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < peers; i++ {
+				hash := storage.Hash{byte(i % 10)}
+				id := storage.PeerID{byte(w), byte(i)}
+				db.Save(testIP, uint16(i), false, hash, id, false, storage.Transfer{}, 0)
+				db.Save(testIP, uint16(i), true, hash, id, true, storage.Transfer{}, 0)
+				if i%3 == 0 {
+					db.Drop(hash, id, testIP, 0)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatal("Close() =", err)
+	}
+
+	db = openJournalDatabase(t)
+	var complete uint32
+	for i := 0; i < 10; i++ {
+		seeds, leeches, _ := db.HashStats(storage.Hash{byte(i)})
+		if leeches != 0 {
+			t.Errorf("HashStats() of swarm %v after replay has %v leeches; want 0", i, leeches)
+		}
+		complete += seeds
+	}
+	if want := uint32(workers * (peers - (peers+2)/3)); complete != want {
+		t.Errorf("seeds after replay = %v; want %v", complete, want)
+	}
+	crash(db)
+}
+
+func TestJournalCompactFull(t *testing.T) {
+	pools.Initialize(10)
+	config.Config.DB.Backup.Path = filepath.Join(t.TempDir(), "trakx.db")
+	journalPath := config.Config.DB.Backup.Path + ".journal"
+	defer func(size int64) { journalCompactSize = size }(journalCompactSize)
+	journalCompactSize = 1
+
+	// without periodic saves the journal is compacted once it's full
+	db := openJournalDatabase(t)
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.backup.(*JournalBackup).flush()
+
+	if info, err := os.Stat(journalPath); err != nil || info.Size() != 0 {
+		t.Fatalf("journal after flushing a full journal = %v, %v; want empty", info, err)
+	}
+	crash(db)
+
+	db = openJournalDatabase(t)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 1 {
+		t.Errorf("HashStats() after loading the compacted snapshot = %v, %v; want 0, 1", complete, incomplete)
+	}
+	crash(db)
+}
@@ -1,7 +1,10 @@
 package gomap
 
 import (
+	"bufio"
+	"bytes"
 	"database/sql"
+	"io"
 	"strconv"
 	"strings"
 	"time"
@@ -27,8 +30,43 @@ const (
 
 	// Time to wait for if backup is older than backupRecentWindow
 	backupRecentWait = 7 * time.Second
+
+	// large object access modes
+	pgInvWrite = 0x20000
+	pgInvRead  = 0x40000
+
+	// bytes sent per large object read or write
+	pgChunkSize = 1 << 20
 )
 
+// largeObject streams a postgres large object through the server side functions, the transaction must stay open while it's in use.
+type largeObject struct {
+	tx *sql.Tx
+	fd int
+}
+
+func (lo *largeObject) Write(p []byte) (int, error) {
+	var written int
+	if err := lo.tx.QueryRow("SELECT lowrite($1, $2)", lo.fd, p).Scan(&written); err != nil {
+		return 0, err
+	}
+	if written < len(p) {
+		return written, io.ErrShortWrite
+	}
+	return written, nil
+}
+
+func (lo *largeObject) Read(p []byte) (int, error) {
+	var data []byte
+	if err := lo.tx.QueryRow("SELECT loread($1, $2)", lo.fd, len(p)).Scan(&data); err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	return copy(p, data), nil
+}
+
 // PgBackup backs up the peer database to a postgres sql database.
 type PgBackup struct {
 	pg *sql.DB
@@ -58,43 +96,68 @@ func (bck *PgBackup) Init(db storage.Database) error {
 		return errors.Wrap(err, "failed to `CREATE TABLE`")
 	}
 
+	// backups are streamed to large objects, rows from older versions hold the backup in bytes
+	_, err = bck.pg.Exec("ALTER TABLE trakx ADD COLUMN IF NOT EXISTS oid OID")
+	if err != nil {
+		return errors.Wrap(err, "failed to `ALTER TABLE`")
+	}
+
 	return nil
 }
 
 func (bck PgBackup) Save() error {
 	config.Logger.Info("Saving database to pg")
-	var data []byte
-	var err error
 	start := time.Now()
 
-	data, err = bck.db.encodeBinary()
-
+	tx, err := bck.pg.Begin()
 	if err != nil {
-		return errors.Wrap(err, "failed to encode database")
+		return errors.Wrap(err, "failed to begin transaction")
 	}
-	config.Logger.Info("Encoded database", zap.Duration("duration", time.Since(start)))
-	start = time.Now()
+	defer tx.Rollback()
 
-	_, err = bck.pg.Query("INSERT INTO trakx(bytes) VALUES($1)", data)
-	if err != nil {
+	var oid uint32
+	if err := tx.QueryRow("SELECT lo_create(0)").Scan(&oid); err != nil {
+		return errors.Wrap(err, "failed to create large object")
+	}
+	var fd int
+	if err := tx.QueryRow("SELECT lo_open($1, $2)", oid, pgInvWrite).Scan(&fd); err != nil {
+		return errors.Wrap(err, "failed to open large object")
+	}
+
+	writer := bufio.NewWriterSize(&largeObject{tx: tx, fd: fd}, pgChunkSize)
+	if err := bck.db.writeBackup(writer); err != nil {
+		return errors.Wrap(err, "failed to write database")
+	}
+	if err := writer.Flush(); err != nil {
+		return errors.Wrap(err, "failed to write database")
+	}
+
+	if _, err := tx.Exec("SELECT lo_close($1)", fd); err != nil {
+		return errors.Wrap(err, "failed to close large object")
+	}
+	if _, err := tx.Exec("INSERT INTO trakx(oid) VALUES($1)", oid); err != nil {
 		return errors.Wrap(err, "`INSERT` statement failed")
 	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
 
-	config.Logger.Info("Saved database to pg", zap.Any("hash", data[:20]), zap.Duration("pg duration", time.Since(start)))
+	config.Logger.Info("Saved database to pg", zap.Uint32("oid", oid), zap.Duration("duration", time.Since(start)))
 
 	return nil
 }
 
 func (bck PgBackup) Load() error {
 	firstTry := true
-	var bytes []byte
+	var data []byte
+	var oid sql.NullInt64
 	var ts time.Time
 
 	config.Logger.Info("Loading stored database from postgres")
 
 attemptLoad:
 
-	err := bck.pg.QueryRow("SELECT bytes, ts FROM trakx ORDER BY ts DESC LIMIT 1").Scan(&bytes, &ts)
+	err := bck.pg.QueryRow("SELECT bytes, oid, ts FROM trakx ORDER BY ts DESC LIMIT 1").Scan(&data, &oid, &ts)
 	if err != nil {
 		// if postgres is empty than create an empty database and return success
 		if strings.Contains(err.Error(), "no rows in result set") {
@@ -118,20 +181,51 @@ attemptLoad:
 		goto attemptLoad
 	}
 
-	peers, hashes, err := bck.db.decodeBinary(bytes)
-	if err != nil {
+	var peers, hashes int
+	if oid.Valid {
+		peers, hashes, err = bck.loadLargeObject(oid.Int64)
+	} else {
+		peers, hashes, err = bck.db.readBackup(bytes.NewReader(data))
+	}
+	// only the newest backup is read so what's left of a damaged one is kept
+	var skipped *skippedBlocksError
+	if errors.As(err, &skipped) {
+		config.Logger.Warn("Stored database skipped blocks", zap.Int64("oid", oid.Int64), zap.Error(err))
+	} else if err != nil {
 		return errors.Wrap(err, "failed to decode data")
 	}
 
-	config.Logger.Info("Loaded stored database from pg", zap.Int("size", len(bytes)), zap.Any("hash", bytes[:20]), zap.Int("peers", peers), zap.Int("hashes", hashes))
+	config.Logger.Info("Loaded stored database from pg", zap.Int64("oid", oid.Int64), zap.Int("peers", peers), zap.Int("hashes", hashes))
 
 	return nil
 }
 
+func (bck PgBackup) loadLargeObject(oid int64) (peers, hashes int, err error) {
+	tx, err := bck.pg.Begin()
+	if err != nil {
+		err = errors.Wrap(err, "failed to begin transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var fd int
+	if err = tx.QueryRow("SELECT lo_open($1, $2)", oid, pgInvRead).Scan(&fd); err != nil {
+		err = errors.Wrap(err, "failed to open large object")
+		return
+	}
+
+	return bck.db.readBackup(bufio.NewReaderSize(&largeObject{tx: tx, fd: fd}, pgChunkSize))
+}
+
 func (bck PgBackup) trim() (int64, error) {
 	var trimmed int64
 
 	if len(maxDate) != 0 {
+		_, err := bck.pg.Exec("SELECT lo_unlink(oid) FROM trakx WHERE oid IS NOT NULL AND ts < NOW() - INTERVAL '" + maxDate + "'")
+		if err != nil {
+			return -1, err
+		}
+
 		result, err := bck.pg.Exec("DELETE FROM trakx WHERE ts < NOW() - INTERVAL '" + maxDate + "'")
 		if err != nil {
 			return -1, err
@@ -144,6 +238,11 @@ func (bck PgBackup) trim() (int64, error) {
 	}
 
 	if maxRows != -1 {
+		_, err := bck.pg.Exec("SELECT lo_unlink(oid) FROM trakx WHERE oid IS NOT NULL AND ctid IN (SELECT ctid FROM trakx ORDER BY ctid DESC OFFSET " + strconv.Itoa(maxRows) + ")")
+		if err != nil {
+			return -1, err
+		}
+
 		result, err := bck.pg.Exec("DELETE FROM trakx WHERE ctid IN (SELECT ctid FROM trakx ORDER BY ctid DESC OFFSET " + strconv.Itoa(maxRows) + ")")
 		if err != nil {
 			return -1, err
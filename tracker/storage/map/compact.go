@@ -0,0 +1,189 @@
+package gomap
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"go.uber.org/zap"
+)
+
+// maps that never held more entries than this aren't worth rebuilding
+const compactMinPeak = 64
+
+// size of the entries of the maps for estimating the memory reclaimed
+const (
+	idEntrySize      = unsafe.Sizeof(storage.PeerID{}) + unsafe.Sizeof(uint32(0))
+	hashEntrySize    = unsafe.Sizeof(storage.Hash{}) + unsafe.Sizeof(&PeerMap{})
+	addressEntrySize = unsafe.Sizeof([16]byte{}) + unsafe.Sizeof(uint32(0))
+)
+
+// shrunk returns true if a map holding length entries should be rebuilt to return the memory of its peak.
+func shrunk(length, peak int) bool {
+	ratio := config.Config.DB.Compact.Ratio
+	return config.Config.DB.Compact.Interval > 0 && ratio >= 2 && peak >= compactMinPeak && length < peak/ratio
+}
+
+// mapBytes estimates the memory of a map sized for entries of size bytes, maps grow in powers of two and are kept at most 7/8 full.
+func mapBytes(entries int, size uintptr) int64 {
+	slots := 8
+	for slots*7/8 < entries {
+		slots *= 2
+	}
+	// every slot has a control byte
+	return int64(slots) * int64(size+1)
+}
+
+// queueShrunk queues the swarm to be compacted if it shrank below the ratio of its peak, the peermap must be locked.
+func (db *Memory) queueShrunk(hash storage.Hash, peermap *PeerMap) {
+	if peermap.queued || !shrunk(peermap.len(), int(peermap.peak)) {
+		return
+	}
+	peermap.queued = true
+
+	shard := db.shard(hash)
+	shard.compactMutex.Lock()
+	shard.shrunk = append(shard.shrunk, hash)
+	shard.compactMutex.Unlock()
+}
+
+// Compact rebuilds the maps that shrank well below their peak.
+func (db *Memory) Compact() {
+	start := time.Now()
+	maps, reclaimed := db.compact()
+	if maps > 0 {
+		config.Logger.Info("Compacted database", zap.Int("maps", maps), zap.Int64("reclaimed", reclaimed), zap.Duration("duration", time.Since(start)))
+	}
+}
+
+// compact rebuilds the queued swarms, the shards and the address index if they shrank below 1/`db.compact.ratio` of their peak.
+// Every map is rebuilt under its own lock and at most `db.compact.budget` entries are copied so no lock is held for longer than copying the budget takes.
+// Swarms left over wait for the next compaction and swarms larger than the budget are dropped from the queue, they're never rebuilt.
+// It returns the number of maps rebuilt and the estimated bytes reclaimed.
+func (db *Memory) compact() (maps int, reclaimed int64) {
+	budget := config.Config.DB.Compact.Budget
+	copied := 0
+	fits := func(entries int) bool {
+		return budget <= 0 || copied+entries <= budget
+	}
+
+	for i := range db.shards {
+		shard := &db.shards[i]
+
+		shard.compactMutex.Lock()
+		queue := shard.shrunk
+		shard.shrunk = nil
+		shard.compactMutex.Unlock()
+
+		for n, hash := range queue {
+			peermap, ok := db.peermap(hash)
+			if !ok {
+				continue
+			}
+
+			peermap.mutex.Lock()
+			if budget > 0 && peermap.len() > budget {
+				// queued again by its next drop in case it shrank to fit
+				peermap.queued = false
+				peermap.mutex.Unlock()
+				continue
+			}
+			if !fits(peermap.len()) {
+				peermap.mutex.Unlock()
+
+				shard.compactMutex.Lock()
+				shard.shrunk = append(shard.shrunk, queue[n:]...)
+				shard.compactMutex.Unlock()
+				break
+			}
+			peermap.queued = false
+			// it may have grown back since it was queued
+			if shrunk(peermap.len(), int(peermap.peak)) {
+				copied += peermap.len()
+				reclaimed += peermap.compact()
+				maps++
+			}
+			peermap.mutex.Unlock()
+		}
+	}
+
+	for i := range db.shards {
+		shard := &db.shards[i]
+
+		shard.mutex.Lock()
+		if length := len(shard.hashmap); shrunk(length, shard.peak) && fits(length) {
+			hashmap := make(map[storage.Hash]*PeerMap, length)
+			for hash, peermap := range shard.hashmap {
+				hashmap[hash] = peermap
+			}
+			reclaimed += mapBytes(shard.peak, hashEntrySize) - mapBytes(length, hashEntrySize)
+			shard.hashmap = hashmap
+			shard.peak = length
+
+			copied += length
+			maps++
+		}
+		shard.mutex.Unlock()
+	}
+
+	if index := db.addresses; index != nil {
+		for i := range index.shards {
+			shard := &index.shards[i]
+
+			shard.mutex.Lock()
+			if length := len(shard.peers); shrunk(length, shard.peak) && fits(length) {
+				peers := make(map[[16]byte]uint32, length)
+				for address, count := range shard.peers {
+					peers[address] = count
+				}
+				reclaimed += mapBytes(shard.peak, addressEntrySize) - mapBytes(length, addressEntrySize)
+				shard.peers = peers
+				shard.peak = length
+
+				copied += length
+				maps++
+			}
+			shard.mutex.Unlock()
+		}
+	}
+
+	stats.Compacted.Add(reclaimed)
+	return
+}
+
+// compact rebuilds the maps and slices of the swarm at its current size and returns the estimated bytes reclaimed, the peermap must be locked.
+func (peermap *PeerMap) compact() (reclaimed int64) {
+	length := peermap.len()
+
+	reclaimed = mapBytes(int(peermap.peak), idEntrySize) - mapBytes(length, idEntrySize)
+	ids := make(map[storage.PeerID]uint32, length)
+	for id, index := range peermap.ids {
+		ids[id] = index
+	}
+	peermap.ids = ids
+
+	// the addresses are never more than the peers
+	if peermap.addresses != nil {
+		reclaimed += mapBytes(int(peermap.peak), addressEntrySize) - mapBytes(len(peermap.addresses), addressEntrySize)
+		addresses := make(map[[16]byte]uint32, len(peermap.addresses))
+		for address, count := range peermap.addresses {
+			addresses[address] = count
+		}
+		peermap.addresses = addresses
+	}
+
+	reclaimed += int64(cap(peermap.slots)-length) * int64(unsafe.Sizeof(slot{}))
+	peermap.slots = append(make([]slot, 0, length), peermap.slots...)
+	for list := range peermap.lists {
+		compact := &peermap.lists[list]
+		reclaimed += int64(cap(compact.entries) - len(compact.entries))
+		reclaimed += int64(cap(compact.slots)-len(compact.slots)) * int64(unsafe.Sizeof(uint32(0)))
+		compact.entries = append(make([]byte, 0, len(compact.entries)), compact.entries...)
+		compact.slots = append(make([]uint32, 0, len(compact.slots)), compact.slots...)
+	}
+
+	peermap.peak = uint32(length)
+	return
+}
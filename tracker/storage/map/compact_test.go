@@ -0,0 +1,80 @@
+package gomap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+func TestCompact(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	config.Config.DB.Compact.Interval = time.Minute
+	config.Config.DB.Compact.Ratio = 4
+	config.Config.DB.Compact.Budget = 150
+	defer func() { config.Config.DB.Compact.Interval = 0 }()
+
+	var db Memory
+	db.make()
+
+	// two swarms drain from 1000 to 100 peers
+	hashes := []storage.Hash{{1}, {2}}
+	for _, hash := range hashes {
+		for i := 0; i < 1000; i++ {
+			db.Save(testIP, uint16(i), i%2 == 0, hash, mixedPeerID(i), false, storage.Transfer{}, 0)
+		}
+		for i := 100; i < 1000; i++ {
+			db.Drop(hash, mixedPeerID(i), testIP, 0)
+		}
+	}
+	if queued := len(db.shards[0].shrunk); queued != 2 {
+		t.Fatalf("%v swarms queued; want 2", queued)
+	}
+
+	// the budget fits one swarm and the shard
+	maps, reclaimed := db.compact()
+	if maps != 2 || reclaimed <= 0 {
+		t.Errorf("compact() = %v, %v; want 2 maps and bytes reclaimed", maps, reclaimed)
+	}
+	if queued := len(db.shards[0].shrunk); queued != 1 {
+		t.Errorf("%v swarms queued after compact(); want 1", queued)
+	}
+	if db.shards[0].peak != 2 {
+		t.Errorf("shard peak = %v; want 2", db.shards[0].peak)
+	}
+
+	if maps, _ = db.compact(); maps != 1 {
+		t.Errorf("second compact() = %v maps; want 1", maps)
+	}
+	for _, hash := range hashes {
+		peermap, _ := db.peermap(hash)
+		if peermap.peak != 100 || cap(peermap.slots) != 100 || peermap.queued {
+			t.Errorf("swarm after compact() peak = %v, slots = %v, queued = %v; want 100, 100, false", peermap.peak, cap(peermap.slots), peermap.queued)
+		}
+		checkSwarm(t, peermap)
+	}
+
+	// nothing is left to rebuild
+	if maps, reclaimed = db.compact(); maps != 0 || reclaimed != 0 {
+		t.Errorf("third compact() = %v, %v; want 0, 0", maps, reclaimed)
+	}
+
+	// a swarm larger than the budget isn't rebuilt, not even first
+	config.Config.DB.Compact.Budget = 50
+	defer func() { config.Config.DB.Compact.Budget = 0 }()
+	large := storage.Hash{3}
+	for i := 0; i < 1000; i++ {
+		db.Save(testIP, uint16(i), false, large, mixedPeerID(i), false, storage.Transfer{}, 0)
+	}
+	for i := 100; i < 1000; i++ {
+		db.Drop(large, mixedPeerID(i), testIP, 0)
+	}
+	if maps, _ = db.compact(); maps != 0 {
+		t.Errorf("compact() with a swarm over the budget = %v maps; want 0", maps)
+	}
+	peermap, _ := db.peermap(large)
+	if peermap.peak != 1000 || peermap.queued || len(db.shards[0].shrunk) != 0 {
+		t.Errorf("swarm over the budget peak = %v, queued = %v with %v swarms queued; want 1000, false, 0", peermap.peak, peermap.queued, len(db.shards[0].shrunk))
+	}
+}
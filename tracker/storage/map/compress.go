@@ -0,0 +1,99 @@
+package gomap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/crimist/trakx/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// compression types for `db.backup.compression`
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter wraps w with the compression set in `db.backup.compression`, closing it flushes the compressor but not w.
+func compressWriter(w io.Writer) (io.WriteCloser, error) {
+	switch config.Config.DB.Backup.Compression {
+	case compressionNone, "":
+		return nopWriteCloser{w}, nil
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+	case compressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, errors.Errorf("unknown compression type %q", config.Config.DB.Backup.Compression)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// decompressReader detects the compression of r by its magic bytes so backups can be loaded after `db.backup.compression` changes.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(r)
+	magic, err := reader.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(magic, gzipMagic) {
+		return gzip.NewReader(reader)
+	} else if bytes.HasPrefix(magic, zstdMagic) {
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{decoder}, nil
+	}
+	return io.NopCloser(reader), nil
+}
+
+// writeBackup streams the compressed database to w.
+func (db *Memory) writeBackup(w io.Writer) error {
+	compressor, err := compressWriter(w)
+	if err != nil {
+		return errors.Wrap(err, "failed to create compressor")
+	}
+	if err := db.encodeBinary(compressor); err != nil {
+		compressor.Close()
+		return errors.Wrap(err, "failed to encode db")
+	}
+	return errors.Wrap(compressor.Close(), "failed to flush compressor")
+}
+
+// readBackup replaces the database with the one streamed from r.
+func (db *Memory) readBackup(r io.Reader) (peers, hashes int, err error) {
+	decompressor, err := decompressReader(r)
+	if err != nil {
+		err = errors.Wrap(err, "failed to create decompressor")
+		return
+	}
+	defer decompressor.Close()
+
+	peers, hashes, err = db.decodeBinary(decompressor)
+	err = errors.Wrap(err, "failed to decode saved data")
+	return
+}
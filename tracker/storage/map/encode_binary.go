@@ -5,133 +5,550 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"net/netip"
+	"time"
 
-	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/config"
 	"github.com/crimist/trakx/tracker/storage"
+	"go.uber.org/zap"
 )
 
-func (db *Memory) encodeBinary() ([]byte, error) {
-	var buff bytes.Buffer
-	writer := bufio.NewWriter(&buff)
+/*
+	Binary backup format (little endian):
 
-	db.mutex.RLock()
-	for hash, submap := range db.hashmap {
-		db.mutex.RUnlock()
+	header:
+		magic [8]byte "trakxdb\x00"
+		version uint16
+		created at int64 (unix)
+		peers uint64, hashes uint64 (counted when the backup started)
+		crc32c uint32 of the above
 
-		// write hash and peermap size
-		if err := binary.Write(writer, binary.LittleEndian, &hash); err != nil {
-			return nil, err
-		}
-		if err := binary.Write(writer, binary.LittleEndian, uint32(len(submap.Peers))); err != nil {
-			return nil, err
+	followed by blocks until EOF:
+		marker [4]byte "blk\x00"
+		length uint32
+		crc32c uint32 of the payload
+		payload: whole peermaps as hash [20]byte, peer count uint32, downloaded uint32, uploaded bytes uint64, downloaded bytes uint64 and per peer:
+			id [20]byte, complete bool, ip length int32, ip, port uint16, lastseen int64,
+			firstseen int64, announces uint32, uploaded uint64, downloaded uint64, left uint64, key uint32
+
+	Peermaps of more than peermapChunk peers are split over consecutive peermaps with the same hash so no block grows far past blockSize, every part holds the swarm totals.
+	A backup with a corrupt header isn't loaded, a corrupt block is skipped by scanning for the next marker.
+	Backups from before the header are a bare list of legacy peermaps: hash, peer count and per peer the fields up to lastseen.
+*/
+
+const (
+	binaryVersion = 1
+
+	// payload size at which a block is written out, blocks only end between peermaps
+	blockSize = 64 << 10
+	// largest encoded peer: id, complete, ip length, ipv6 address, port, lastseen, firstseen, announces, uploaded, downloaded, left, key
+	maxPeerSize = 20 + 1 + 4 + 16 + 2 + 8 + 8 + 4 + 8 + 8 + 8 + 4
+	// peers per encoded peermap, larger peermaps are split so a swarm isn't limited by maxBlockSize
+	peermapChunk = blockSize / maxPeerSize
+	// largest block accepted when decoding, larger lengths are corrupt
+	maxBlockSize = 64 << 20
+
+	headerSize      = 8 + 2 + 8 + 8 + 8 + 4
+	blockHeaderSize = 4 + 4 + 4
+)
+
+var (
+	binaryMagic = [8]byte{'t', 'r', 'a', 'k', 'x', 'd', 'b', 0}
+	blockMarker = [4]byte{'b', 'l', 'k', 0}
+	crcTable    = crc32.MakeTable(crc32.Castagnoli)
+
+	errVersion       = errors.New("unsupported backup version")
+	errCorruptHeader = errors.New("backup header checksum mismatch")
+)
+
+// binaryHeader describes a binary backup.
+type binaryHeader struct {
+	version   uint16
+	createdAt int64
+	peers     uint64
+	hashes    uint64
+}
+
+func (header *binaryHeader) marshal() []byte {
+	data := make([]byte, headerSize)
+	copy(data[0:8], binaryMagic[:])
+	binary.LittleEndian.PutUint16(data[8:10], header.version)
+	binary.LittleEndian.PutUint64(data[10:18], uint64(header.createdAt))
+	binary.LittleEndian.PutUint64(data[18:26], header.peers)
+	binary.LittleEndian.PutUint64(data[26:34], header.hashes)
+	binary.LittleEndian.PutUint32(data[34:38], crc32.Checksum(data[:34], crcTable))
+	return data
+}
+
+// unmarshal parses the header and reports whether its checksum matched.
+func (header *binaryHeader) unmarshal(data []byte) (valid bool) {
+	header.version = binary.LittleEndian.Uint16(data[8:10])
+	header.createdAt = int64(binary.LittleEndian.Uint64(data[10:18]))
+	header.peers = binary.LittleEndian.Uint64(data[18:26])
+	header.hashes = binary.LittleEndian.Uint64(data[26:34])
+	return binary.LittleEndian.Uint32(data[34:38]) == crc32.Checksum(data[:34], crcTable)
+}
+
+// count returns the number of peers and hashes in the database.
+func (db *Memory) count() (peers, hashes uint64) {
+	for i := range db.shards {
+		shard := &db.shards[i]
+
+		shard.mutex.RLock()
+		for _, peermap := range shard.hashmap {
+			peermap.mutex.RLock()
+			peers += uint64(peermap.len())
+			peermap.mutex.RUnlock()
 		}
+		hashes += uint64(len(shard.hashmap))
+		shard.mutex.RUnlock()
+	}
+	return
+}
 
-		// write peerid and peer
-		submap.mutex.RLock()
-		for id, peer := range submap.Peers {
-			if err := binary.Write(writer, binary.LittleEndian, &id); err != nil {
-				return nil, err
-			}
+// encodeBinary streams the database to w.
+func (db *Memory) encodeBinary(w io.Writer) error {
+	writer := bufio.NewWriter(w)
 
-			addrSlice := peer.IP.AsSlice()
-			if err := binary.Write(writer, binary.LittleEndian, peer.Complete); err != nil {
-				return nil, err
-			}
-			if err := binary.Write(writer, binary.LittleEndian, int32(len(addrSlice))); err != nil {
-				return nil, err
-			}
-			if err := binary.Write(writer, binary.LittleEndian, addrSlice); err != nil {
-				return nil, err
-			}
-			if err := binary.Write(writer, binary.LittleEndian, peer.Port); err != nil {
-				return nil, err
+	header := binaryHeader{
+		version:   binaryVersion,
+		createdAt: time.Now().Unix(),
+	}
+	header.peers, header.hashes = db.count()
+	if _, err := writer.Write(header.marshal()); err != nil {
+		return err
+	}
+
+	var block bytes.Buffer
+	block.Grow(blockSize + blockHeaderSize)
+
+	for i := range db.shards {
+		shard := &db.shards[i]
+
+		shard.mutex.RLock()
+		for hash, submap := range shard.hashmap {
+			shard.mutex.RUnlock()
+
+			if err := writePeermap(writer, &block, hash, submap); err != nil {
+				return err
 			}
-			if err := binary.Write(writer, binary.LittleEndian, peer.LastSeen); err != nil {
-				return nil, err
+
+			shard.mutex.RLock()
+		}
+		shard.mutex.RUnlock()
+	}
+
+	if block.Len() > 0 {
+		if err := writeBlock(writer, block.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+func writeBlock(writer io.Writer, payload []byte) error {
+	var header [blockHeaderSize]byte
+	copy(header[0:4], blockMarker[:])
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[8:12], crc32.Checksum(payload, crcTable))
+
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := writer.Write(payload)
+	return err
+}
+
+// writePeermap encodes the peermap into block in parts of up to peermapChunk peers and writes block out every time it reaches blockSize.
+func writePeermap(writer io.Writer, block *bytes.Buffer, hash storage.Hash, submap *PeerMap) error {
+	submap.mutex.RLock()
+	defer submap.mutex.RUnlock()
+
+	for start := 0; ; start += peermapChunk {
+		end := start + peermapChunk
+		if end > len(submap.slots) {
+			end = len(submap.slots)
+		}
+		if err := encodePeers(block, hash, submap, submap.slots[start:end], false); err != nil {
+			return err
+		}
+		if block.Len() >= blockSize {
+			if err := writeBlock(writer, block.Bytes()); err != nil {
+				return err
 			}
+			block.Reset()
+		}
+		if end == len(submap.slots) {
+			return nil
 		}
-		submap.mutex.RUnlock()
+	}
+}
+
+// encodePeermap writes the whole peermap, legacy writes it as a headerless backup from before versioning did.
+func encodePeermap(writer io.Writer, hash storage.Hash, submap *PeerMap, legacy bool) error {
+	submap.mutex.RLock()
+	defer submap.mutex.RUnlock()
+
+	return encodePeers(writer, hash, submap, submap.slots, legacy)
+}
 
-		db.mutex.RLock()
+// encodePeers writes a peermap holding the slots of submap, the peermap must be locked.
+func encodePeers(writer io.Writer, hash storage.Hash, submap *PeerMap, slots []slot, legacy bool) error {
+	// write hash and peermap size
+	if err := binary.Write(writer, binary.LittleEndian, &hash); err != nil {
+		return err
 	}
-	db.mutex.RUnlock()
+	if err := binary.Write(writer, binary.LittleEndian, uint32(len(slots))); err != nil {
+		return err
+	}
+	if !legacy {
+		if err := binary.Write(writer, binary.LittleEndian, submap.Downloaded); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, []uint64{submap.UploadedBytes, submap.DownloadedBytes}); err != nil {
+			return err
+		}
+	}
+
+	// write peerid and peer
+	for index := range slots {
+		id := slots[index].id
+		peer := slots[index].peer()
+		if err := binary.Write(writer, binary.LittleEndian, &id); err != nil {
+			return err
+		}
 
-	if err := writer.Flush(); err != nil {
-		return nil, err
+		addrSlice := peer.IP.AsSlice()
+		if err := binary.Write(writer, binary.LittleEndian, peer.Complete); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, int32(len(addrSlice))); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, addrSlice); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, peer.Port); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, peer.LastSeen); err != nil {
+			return err
+		}
+		if legacy {
+			continue
+		}
+		if err := binary.Write(writer, binary.LittleEndian, peer.FirstSeen); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, peer.Announces); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, []uint64{peer.Uploaded, peer.Downloaded, peer.Left}); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, peer.Key); err != nil {
+			return err
+		}
 	}
 
-	return buff.Bytes(), nil
+	return nil
 }
 
-func (db *Memory) decodeBinary(data []byte) (peers, hashes int, err error) {
+// decodeBinary replaces the database with the one streamed from r.
+// Peers that exceeded `db.expiry` are dropped. A corrupt header returns errCorruptHeader.
+// Corrupt blocks are skipped and a truncated backup loads up to the truncation, either returns a *skippedBlocksError once the rest is loaded.
+func (db *Memory) decodeBinary(r io.Reader) (peers, hashes int, err error) {
 	db.make()
-	reader := bufio.NewReader(bytes.NewBuffer(data))
+	reader := bufio.NewReaderSize(r, blockSize)
+	cutoff := time.Now().Unix() - int64(config.Config.DB.Expiry.Seconds())
+
+	magic, err := reader.Peek(len(binaryMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return
+	}
+	if !bytes.Equal(magic, binaryMagic[:]) {
+		// headerless backup from an older version
+		peers, hashes, err = db.decodePeermaps(reader, cutoff, true)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			config.Logger.Warn("Backup ended unexpectedly", zap.Int("loaded peers", peers))
+			err = nil
+		}
+		return
+	}
+
+	headerData := make([]byte, headerSize)
+	if _, err = io.ReadFull(reader, headerData); err != nil {
+		return
+	}
+	// the version decides how every block is read so blocks behind a corrupt header can't be trusted
+	var header binaryHeader
+	if !header.unmarshal(headerData) {
+		err = errCorruptHeader
+		return
+	} else if header.version != binaryVersion {
+		err = errVersion
+		return
+	}
 
+	var corrupt int
+	var payload []byte
 	for {
-		// decode hash and number of peers
-		var hash storage.Hash
-		err = binary.Read(reader, binary.LittleEndian, &hash)
+		payload, err = readBlock(reader, payload)
 		if errors.Is(err, io.EOF) {
 			err = nil
 			break
+		} else if errors.Is(err, errCorruptBlock) {
+			corrupt++
+			continue
 		} else if err != nil {
+			// truncated or unreadable, keep what was loaded
+			config.Logger.Warn("Backup ended unexpectedly", zap.Error(err))
+			corrupt++
+			err = nil
+			break
+		}
+
+		blockPeers, blockHashes, blockErr := db.decodePeermaps(bytes.NewReader(payload), cutoff, false)
+		peers += blockPeers
+		hashes += blockHashes
+		if blockErr != nil && !errors.Is(blockErr, io.EOF) {
+			corrupt++
+		}
+	}
+
+	if corrupt > 0 {
+		config.Logger.Warn("Skipped corrupt backup blocks", zap.Int("blocks", corrupt), zap.Uint64("backup peers", header.peers), zap.Int("loaded peers", peers))
+		err = &skippedBlocksError{blocks: corrupt}
+	}
+
+	return
+}
+
+// skippedBlocksError is returned by decodeBinary along with everything it did load when corrupt or truncated blocks were skipped.
+type skippedBlocksError struct {
+	blocks int
+}
+
+func (err *skippedBlocksError) Error() string {
+	return fmt.Sprintf("skipped %d corrupt or truncated backup blocks", err.blocks)
+}
+
+var errCorruptBlock = errors.New("corrupt block")
+
+// readBlock reads the next block into payload. If the stream is corrupt it skips to the next marker and returns errCorruptBlock.
+func readBlock(reader *bufio.Reader, payload []byte) ([]byte, error) {
+	marker, err := reader.Peek(len(blockMarker))
+	if errors.Is(err, io.EOF) && len(marker) == 0 {
+		return payload, io.EOF
+	} else if err != nil {
+		return payload, io.ErrUnexpectedEOF
+	}
+
+	if !bytes.Equal(marker, blockMarker[:]) {
+		// resync by sliding over the stream until the next marker
+		for !bytes.Equal(marker, blockMarker[:]) {
+			reader.Discard(1)
+			if marker, err = reader.Peek(len(blockMarker)); err != nil {
+				// nothing left to recover
+				reader.Discard(len(marker))
+				break
+			}
+		}
+		return payload, errCorruptBlock
+	}
+
+	var header [blockHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return payload, io.ErrUnexpectedEOF
+	}
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length > maxBlockSize {
+		return payload, errCorruptBlock
+	}
+
+	if cap(payload) < int(length) {
+		payload = make([]byte, length)
+	}
+	payload = payload[:length]
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return payload, io.ErrUnexpectedEOF
+	}
+	if binary.LittleEndian.Uint32(header[8:12]) != crc32.Checksum(payload, crcTable) {
+		return payload, errCorruptBlock
+	}
+
+	return payload, nil
+}
+
+// decodePeermaps decodes peermaps until reader is exhausted, returning io.EOF if it ended cleanly.
+// Peers last seen before cutoff are dropped along with peermaps left empty. legacy decodes a headerless backup from before versioning.
+func (db *Memory) decodePeermaps(reader io.Reader, cutoff int64, legacy bool) (peers, hashes int, err error) {
+	for {
+		// decode hash and number of peers
+		var hash storage.Hash
+		if err = binary.Read(reader, binary.LittleEndian, &hash); err != nil {
 			return
 		}
 
-		var count uint32
-		var complete uint16
-		peermap := db.makePeermap(hash)
+		var count, downloaded uint32
+		var transferred [2]uint64
 		if err = binary.Read(reader, binary.LittleEndian, &count); err != nil {
+			err = unexpectedEOF(err)
 			return
 		}
+		if !legacy {
+			if err = binary.Read(reader, binary.LittleEndian, &downloaded); err != nil {
+				err = unexpectedEOF(err)
+				return
+			}
+			if err = binary.Read(reader, binary.LittleEndian, &transferred); err != nil {
+				err = unexpectedEOF(err)
+				return
+			}
+		}
+
+		shard := db.shard(hash)
+		peermap, exists := shard.hashmap[hash]
+		if !exists {
+			peermap = shard.makePeermap(hash)
+		}
+		if downloaded > peermap.Downloaded {
+			peermap.Downloaded = downloaded
+		}
+		if transferred[0] > peermap.UploadedBytes {
+			peermap.UploadedBytes = transferred[0]
+		}
+		if transferred[1] > peermap.DownloadedBytes {
+			peermap.DownloadedBytes = transferred[1]
+		}
 
 		// decode peerid and peers
 		for ; count > 0; count-- {
 			var id storage.PeerID
-			if err = binary.Read(reader, binary.LittleEndian, &id); err != nil {
-				return
+			var peer storage.Peer
+			if id, peer, err = decodePeer(reader, legacy); err != nil {
+				err = unexpectedEOF(err)
+				break
 			}
 
-			peer := pools.Peers.Get()
-			var addrSliceLen int32
-			if err = binary.Read(reader, binary.LittleEndian, &peer.Complete); err != nil {
-				return
-			}
-			if err = binary.Read(reader, binary.LittleEndian, &addrSliceLen); err != nil {
-				return
+			if peer.LastSeen < cutoff {
+				continue
 			}
-			addrSlice := make([]byte, addrSliceLen)
-			if err = binary.Read(reader, binary.LittleEndian, &addrSlice); err != nil {
-				return
-			}
-			ip, ok := netip.AddrFromSlice(addrSlice)
-			if !ok {
-				err = errors.New("AddrFromSlice failed")
-				return
-			}
-			peer.IP = ip
-			if err = binary.Read(reader, binary.LittleEndian, &peer.Port); err != nil {
-				return
+
+			if index, ok := peermap.ids[id]; ok {
+				old := &peermap.slots[index]
+				if old.complete {
+					peermap.Complete--
+				} else {
+					peermap.Incomplete--
+				}
+				if db.addresses != nil {
+					db.addresses.release(peermap, db.addresses.address(old.addr()))
+				}
+				peermap.update(index, &peer)
+			} else {
+				db.schedule(hash, &peermap.slots[peermap.insert(id, &peer)])
+				peers++
 			}
-			if err = binary.Read(reader, binary.LittleEndian, &peer.LastSeen); err != nil {
-				return
+
+			// a backup may hold more peers than the limits allow, they expire like any other
+			if db.addresses != nil {
+				db.addresses.add(peermap, db.addresses.address(peer.IP))
 			}
-			peermap.Peers[id] = peer
-			peers++
 
 			if peer.Complete {
-				complete++
+				peermap.Complete++
+			} else {
+				peermap.Incomplete++
 			}
 		}
 
-		// set complete and incomplete
-		peermap.Complete = complete
-		peermap.Incomplete = uint16(len(peermap.Peers)) - complete
+		if peermap.len() == 0 {
+			delete(shard.hashmap, hash)
+		} else if !exists {
+			hashes++
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
 
-		hashes++
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF for reads in the middle of a peermap.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func decodePeer(reader io.Reader, legacy bool) (id storage.PeerID, peer storage.Peer, err error) {
+	if err = binary.Read(reader, binary.LittleEndian, &id); err != nil {
+		return
+	}
+
+	var complete bool
+	var addrSliceLen int32
+	if err = binary.Read(reader, binary.LittleEndian, &complete); err != nil {
+		return
+	}
+	if err = binary.Read(reader, binary.LittleEndian, &addrSliceLen); err != nil {
+		return
+	}
+	if addrSliceLen != 4 && addrSliceLen != 16 {
+		err = errors.New("invalid address length")
+		return
+	}
+	addrSlice := make([]byte, addrSliceLen)
+	if err = binary.Read(reader, binary.LittleEndian, &addrSlice); err != nil {
+		return
+	}
+	ip, _ := netip.AddrFromSlice(addrSlice)
+
+	var port uint16
+	var lastSeen int64
+	if err = binary.Read(reader, binary.LittleEndian, &port); err != nil {
+		return
+	}
+	if err = binary.Read(reader, binary.LittleEndian, &lastSeen); err != nil {
+		return
+	}
+
+	// legacy peers are first seen when they were last seen
+	firstSeen := lastSeen
+	var announces, key uint32
+	var transfer [3]uint64
+	if !legacy {
+		if err = binary.Read(reader, binary.LittleEndian, &firstSeen); err != nil {
+			return
+		}
+		if err = binary.Read(reader, binary.LittleEndian, &announces); err != nil {
+			return
+		}
+		if err = binary.Read(reader, binary.LittleEndian, &transfer); err != nil {
+			return
+		}
+		if err = binary.Read(reader, binary.LittleEndian, &key); err != nil {
+			return
+		}
 	}
 
+	peer.Complete = complete
+	peer.IP = ip
+	peer.Port = port
+	peer.LastSeen = lastSeen
+	peer.FirstSeen = firstSeen
+	peer.Announces = announces
+	peer.Uploaded = transfer[0]
+	peer.Downloaded = transfer[1]
+	peer.Left = transfer[2]
+	peer.Key = key
 	return
 }
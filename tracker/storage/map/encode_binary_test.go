@@ -1,16 +1,22 @@
 package gomap
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net/netip"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/crimist/trakx/config"
 	"github.com/crimist/trakx/pools"
 	"github.com/crimist/trakx/tracker/storage"
 )
 
 func TestEncodeDecodeBinary(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
 	var db Memory
 	db.make()
 	pools.Initialize(10)
@@ -23,29 +29,30 @@ func TestEncodeDecodeBinary(t *testing.T) {
 		Port:     0x4f50,
 		LastSeen: time.Now().Unix(),
 	}
-	db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid)
+	db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid, false, storage.Transfer{Uploaded: 1 << 20, Downloaded: 1 << 30, Left: 1 << 10}, 0)
 
-	oldhahmap := db.hashmap
-	data, err := db.encodeBinary()
-	if err != nil {
+	oldhahmap := db.shard(hash).hashmap
+	var data bytes.Buffer
+	if err := db.encodeBinary(&data); err != nil {
 		t.Fatal("encodeBinary threw error: ", err)
 	}
 	db = Memory{}
-	if _, _, err := db.decodeBinary(data); err != nil {
+	if _, _, err := db.decodeBinary(&data); err != nil {
 		t.Fatal("decodeBinary threw error: ", err)
 	}
 
-	if _, ok := db.hashmap[hash]; !ok {
+	if _, ok := db.shard(hash).hashmap[hash]; !ok {
 		t.Fatal("hashmap not equal, missing hash entry")
 	}
-	if oldhahmap[hash].Complete != db.hashmap[hash].Complete {
-		t.Fatalf("Complete not equal: should %v, got %v", oldhahmap[hash].Complete, db.hashmap[hash].Complete)
+	if oldhahmap[hash].Complete != db.shard(hash).hashmap[hash].Complete {
+		t.Fatalf("Complete not equal: should %v, got %v", oldhahmap[hash].Complete, db.shard(hash).hashmap[hash].Complete)
 	}
-	if oldhahmap[hash].Incomplete != db.hashmap[hash].Incomplete {
-		t.Fatalf("Incomplete not equal: should %v, got %v", oldhahmap[hash].Incomplete, db.hashmap[hash].Incomplete)
+	if oldhahmap[hash].Incomplete != db.shard(hash).hashmap[hash].Incomplete {
+		t.Fatalf("Incomplete not equal: should %v, got %v", oldhahmap[hash].Incomplete, db.shard(hash).hashmap[hash].Incomplete)
 	}
-	if !reflect.DeepEqual(oldhahmap[hash].Peers, db.hashmap[hash].Peers) {
-		t.Fatalf("Peer not equal: should %v, got %v", oldhahmap[hash].Peers, db.hashmap[hash].Peers)
+	oldPeer, _ := oldhahmap[hash].get(peerid)
+	if newPeer, ok := db.shard(hash).hashmap[hash].get(peerid); !ok || !reflect.DeepEqual(oldPeer, newPeer) {
+		t.Fatalf("Peer not equal: should %v, got %v", oldPeer, newPeer)
 	}
 }
 
@@ -56,19 +63,194 @@ func BenchmarkEncodeBinary(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		db.encodeBinary()
+		db.encodeBinary(io.Discard)
 	}
 }
 
 func BenchmarkDecodeBinary(b *testing.B) {
 	db := dbWithHashesAndPeers(benchHashes, benchPeers)
-	buff, err := db.encodeBinary()
-	if err != nil {
+	var buff bytes.Buffer
+	if err := db.encodeBinary(&buff); err != nil {
 		b.Fatal(err)
 	}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		db.decodeBinary(buff)
+		db.decodeBinary(bytes.NewReader(buff.Bytes()))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	defer func() { config.Config.DB.Backup.Compression = "" }()
+	config.Config.DB.Expiry = time.Hour
+
+	db := dbWithHashesAndPeers(1000, 3)
+	for _, compression := range []string{compressionNone, compressionGzip, compressionZstd} {
+		config.Config.DB.Backup.Compression = compression
+
+		var data bytes.Buffer
+		if err := db.writeBackup(&data); err != nil {
+			t.Fatalf("writeBackup(%v) threw error: %v", compression, err)
+		}
+
+		// loading doesn't depend on the configured compression
+		config.Config.DB.Backup.Compression = compressionNone
+		var loaded Memory
+		peers, hashes, err := loaded.readBackup(&data)
+		if err != nil {
+			t.Fatalf("readBackup(%v) threw error: %v", compression, err)
+		}
+		if peers != 3000 || hashes != 1000 {
+			t.Errorf("readBackup(%v) = %v, %v; want 3000, 1000", compression, peers, hashes)
+		}
+	}
+
+	config.Config.DB.Backup.Compression = "lz4"
+	if err := db.writeBackup(io.Discard); err == nil {
+		t.Error("writeBackup with unknown compression didn't error")
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	db := dbWithHashesAndPeers(100, 3)
+
+	// headerless format written by older versions
+	var data bytes.Buffer
+	for hash, peermap := range db.shards[0].hashmap {
+		if err := encodePeermap(&data, hash, peermap, true); err != nil {
+			t.Fatal("encodePeermap threw error: ", err)
+		}
+	}
+
+	var loaded Memory
+	peers, hashes, err := loaded.decodeBinary(&data)
+	if err != nil {
+		t.Fatal("decodeBinary threw error: ", err)
+	}
+	if peers != 300 || hashes != 100 {
+		t.Errorf("decodeBinary() = %v, %v; want 300, 100", peers, hashes)
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	// enough peers for several blocks
+	db := dbWithHashesAndPeers(10_000, 3)
+
+	var data bytes.Buffer
+	if err := db.encodeBinary(&data); err != nil {
+		t.Fatal("encodeBinary threw error: ", err)
+	}
+	encoded := data.Bytes()
+
+	var header binaryHeader
+	if !header.unmarshal(encoded[:headerSize]) || header.version != binaryVersion || header.peers != 30_000 || header.hashes != 10_000 {
+		t.Fatalf("header = %+v; want valid version %v with 30000 peers and 10000 hashes", header, binaryVersion)
+	}
+
+	// corrupt a byte in the first block
+	corrupted := append([]byte(nil), encoded...)
+	corrupted[headerSize+blockHeaderSize+100] ^= 0xff
+
+	var loaded Memory
+	var skipped *skippedBlocksError
+	peers, hashes, err := loaded.decodeBinary(bytes.NewReader(corrupted))
+	if !errors.As(err, &skipped) || skipped.blocks != 1 {
+		t.Fatalf("decodeBinary() of corrupt backup = %v; want 1 skipped block", err)
+	}
+	if hashes == 0 || hashes >= 10_000 || peers != hashes*3 {
+		t.Errorf("decodeBinary() of corrupt backup = %v, %v; want some but not all of the 10000 hashes", peers, hashes)
+	}
+
+	// corrupt a block marker, the decoder has to resync
+	corrupted = append([]byte(nil), encoded...)
+	corrupted[headerSize] ^= 0xff
+	if _, resynced, err := loaded.decodeBinary(bytes.NewReader(corrupted)); !errors.As(err, &skipped) || resynced != hashes {
+		t.Errorf("decodeBinary() with corrupt marker = %v, %v; want %v hashes and skipped blocks", resynced, err, hashes)
+	}
+
+	// the version in a corrupt header can't be trusted to decode the blocks
+	corrupted = append([]byte(nil), encoded...)
+	corrupted[8] ^= 0xff
+	if _, _, err := loaded.decodeBinary(bytes.NewReader(corrupted)); err != errCorruptHeader {
+		t.Errorf("decodeBinary() with corrupt header = %v; want errCorruptHeader", err)
+	}
+
+	// truncate in the middle of the last block
+	peers, hashes, err = loaded.decodeBinary(bytes.NewReader(encoded[:len(encoded)-10]))
+	if !errors.As(err, &skipped) {
+		t.Fatalf("decodeBinary() of truncated backup = %v; want skipped blocks", err)
+	}
+	if hashes == 0 || hashes >= 10_000 {
+		t.Errorf("decodeBinary() of truncated backup = %v, %v; want some but not all of the 10000 hashes", peers, hashes)
+	}
+}
+
+func TestEncodeLargeSwarm(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	// one swarm spread over several blocks
+	swarmPeers := 5*peermapChunk + 7
+	db := dbWithHashesAndPeers(1, swarmPeers)
+
+	var data bytes.Buffer
+	if err := db.encodeBinary(&data); err != nil {
+		t.Fatal("encodeBinary threw error: ", err)
+	}
+	encoded := data.Bytes()
+
+	// every block ends close to blockSize even though the swarm is larger
+	var blocks []int
+	for pos := headerSize; pos < len(encoded); {
+		length := int(binary.LittleEndian.Uint32(encoded[pos+4 : pos+8]))
+		if length > blockSize+peermapChunk*maxPeerSize+20+4+4+16 {
+			t.Errorf("block %v holds %v bytes; want at most a part past %v", len(blocks), length, blockSize)
+		}
+		blocks = append(blocks, pos)
+		pos += blockHeaderSize + length
+	}
+	if len(blocks) < 2 {
+		t.Fatalf("swarm of %v peers was encoded in %v blocks; want several", swarmPeers, len(blocks))
+	}
+
+	var loaded Memory
+	if peers, hashes, err := loaded.decodeBinary(bytes.NewReader(encoded)); err != nil || peers != swarmPeers || hashes != 1 {
+		t.Errorf("decodeBinary() = %v, %v, %v; want %v, 1, nil", peers, hashes, err, swarmPeers)
+	}
+
+	// a corrupt block only loses the peers in it
+	corrupted := append([]byte(nil), encoded...)
+	corrupted[blocks[1]+blockHeaderSize+100] ^= 0xff
+	var skipped *skippedBlocksError
+	peers, hashes, err := loaded.decodeBinary(bytes.NewReader(corrupted))
+	if !errors.As(err, &skipped) || skipped.blocks != 1 {
+		t.Fatalf("decodeBinary() of corrupt backup = %v; want 1 skipped block", err)
+	}
+	if hashes != 1 || peers == 0 || peers >= swarmPeers {
+		t.Errorf("decodeBinary() of corrupt backup = %v, %v; want 1 hash with some but not all of the %v peers", peers, hashes, swarmPeers)
+	}
+}
+
+func TestDecodeExpired(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+
+	var db Memory
+	db.make()
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(testIP, 1234, true, testHash, storage.PeerID{1}, false, storage.Transfer{}, 0)
+	peermap := db.shard(testHash).hashmap[testHash]
+	peermap.slots[peermap.ids[testId]].lastSeen = time.Now().Add(-2 * time.Hour).Unix()
+
+	var data bytes.Buffer
+	if err := db.encodeBinary(&data); err != nil {
+		t.Fatal("encodeBinary threw error: ", err)
+	}
+
+	var loaded Memory
+	if peers, hashes, err := loaded.decodeBinary(&data); err != nil || peers != 1 || hashes != 1 {
+		t.Errorf("decodeBinary() = %v, %v, %v; want 1, 1, nil", peers, hashes, err)
+	}
+	if complete, incomplete, _ := loaded.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() = %v, %v; want 1, 0", complete, incomplete)
 	}
 }
@@ -4,18 +4,52 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/gob"
+
+	"github.com/crimist/trakx/tracker/storage"
 )
 
+// gobPeermap is the gob encoding of a PeerMap, the fields match the PeerMap of older versions so their backups still decode.
+type gobPeermap struct {
+	Complete        uint32
+	Incomplete      uint32
+	Downloaded      uint32
+	UploadedBytes   uint64
+	DownloadedBytes uint64
+	Peers           map[storage.PeerID]*storage.Peer
+}
+
 func (db *Memory) encodeGob() ([]byte, error) {
 	var buff bytes.Buffer
 	w := bufio.NewWriter(&buff)
 	encoder := gob.NewEncoder(w)
 
-	db.mutex.RLock()
-	if err := encoder.Encode(db.hashmap); err != nil {
+	// flatten the shards so the encoding doesn't depend on the shard count
+	hashmap := make(map[storage.Hash]*gobPeermap, db.Hashes())
+	for i := range db.shards {
+		db.shards[i].mutex.RLock()
+		for hash, peermap := range db.shards[i].hashmap {
+			peermap.mutex.RLock()
+			encoded := &gobPeermap{
+				Complete:        peermap.Complete,
+				Incomplete:      peermap.Incomplete,
+				Downloaded:      peermap.Downloaded,
+				UploadedBytes:   peermap.UploadedBytes,
+				DownloadedBytes: peermap.DownloadedBytes,
+				Peers:           make(map[storage.PeerID]*storage.Peer, peermap.len()),
+			}
+			for index := range peermap.slots {
+				peer := peermap.slots[index].peer()
+				encoded.Peers[peermap.slots[index].id] = &peer
+			}
+			peermap.mutex.RUnlock()
+			hashmap[hash] = encoded
+		}
+		db.shards[i].mutex.RUnlock()
+	}
+
+	if err := encoder.Encode(hashmap); err != nil {
 		return nil, err
 	}
-	db.mutex.RUnlock()
 
 	if err := w.Flush(); err != nil {
 		return nil, err
@@ -29,7 +63,26 @@ func (db *Memory) decodeGob(data []byte) (err error) {
 	buff := bytes.NewBuffer(data)
 	decoder := gob.NewDecoder(bufio.NewReader(buff))
 
-	err = decoder.Decode(&db.hashmap)
+	var hashmap map[storage.Hash]*gobPeermap
+	if err = decoder.Decode(&hashmap); err != nil {
+		return
+	}
+
+	for hash, encoded := range hashmap {
+		peermap := db.shard(hash).makePeermap(hash)
+		peermap.Complete = encoded.Complete
+		peermap.Incomplete = encoded.Incomplete
+		peermap.Downloaded = encoded.Downloaded
+		peermap.UploadedBytes = encoded.UploadedBytes
+		peermap.DownloadedBytes = encoded.DownloadedBytes
+
+		for id, peer := range encoded.Peers {
+			db.schedule(hash, &peermap.slots[peermap.insert(id, peer)])
+			if db.addresses != nil {
+				db.addresses.add(peermap, db.addresses.address(peer.IP))
+			}
+		}
+	}
 
 	return
 }
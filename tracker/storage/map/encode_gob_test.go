@@ -21,9 +21,9 @@ func TestEncodeDecodeGob(t *testing.T) {
 		Port:     0x4f50,
 		LastSeen: time.Now().Unix(),
 	}
-	db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid)
+	db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid, false, storage.Transfer{}, 0)
 
-	oldhahmap := db.hashmap
+	oldhahmap := db.shard(hash).hashmap
 	data, err := db.encodeGob()
 	if err != nil {
 		t.Fatal("encodeGob threw error: ", err)
@@ -33,17 +33,18 @@ func TestEncodeDecodeGob(t *testing.T) {
 		t.Fatal("decodeGob threw error: ", err)
 	}
 
-	if _, ok := db.hashmap[hash]; !ok {
+	if _, ok := db.shard(hash).hashmap[hash]; !ok {
 		t.Fatal("hashmap not equal, missing hash entry")
 	}
-	if oldhahmap[hash].Complete != db.hashmap[hash].Complete {
-		t.Fatalf("Complete not equal: should %v, got %v", oldhahmap[hash].Complete, db.hashmap[hash].Complete)
+	if oldhahmap[hash].Complete != db.shard(hash).hashmap[hash].Complete {
+		t.Fatalf("Complete not equal: should %v, got %v", oldhahmap[hash].Complete, db.shard(hash).hashmap[hash].Complete)
 	}
-	if oldhahmap[hash].Incomplete != db.hashmap[hash].Incomplete {
-		t.Fatalf("Incomplete not equal: should %v, got %v", oldhahmap[hash].Incomplete, db.hashmap[hash].Incomplete)
+	if oldhahmap[hash].Incomplete != db.shard(hash).hashmap[hash].Incomplete {
+		t.Fatalf("Incomplete not equal: should %v, got %v", oldhahmap[hash].Incomplete, db.shard(hash).hashmap[hash].Incomplete)
 	}
-	if !reflect.DeepEqual(oldhahmap[hash].Peers, db.hashmap[hash].Peers) {
-		t.Fatalf("Peer not equal: should %v, got %v", oldhahmap[hash].Peers, db.hashmap[hash].Peers)
+	oldPeer, _ := oldhahmap[hash].get(peerid)
+	if newPeer, ok := db.shard(hash).hashmap[hash].get(peerid); !ok || !reflect.DeepEqual(oldPeer, newPeer) {
+		t.Fatalf("Peer not equal: should %v, got %v", oldPeer, newPeer)
 	}
 }
 
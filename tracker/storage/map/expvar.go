@@ -13,13 +13,16 @@ func (db *Memory) SyncExpvars() error {
 	var seeds, leeches int64
 
 	// Called on main thread before thread/queue dispatch no locking needed
-	for _, peermap := range db.hashmap {
-		for _, peer := range peermap.Peers {
-			stats.IPStats.Inc(peer.IP)
-			if peer.Complete {
-				seeds++
-			} else {
-				leeches++
+	for i := range db.shards {
+		for _, peermap := range db.shards[i].hashmap {
+			for index := range peermap.slots {
+				peer := &peermap.slots[index]
+				stats.IPStats.Inc(peer.addr())
+				if peer.complete {
+					seeds++
+				} else {
+					leeches++
+				}
 			}
 		}
 	}
@@ -1,23 +1,64 @@
 package gomap
 
 import (
-	"encoding/binary"
+	"bytes"
 
 	"github.com/crimist/trakx/pools"
 	"github.com/crimist/trakx/tracker/storage"
 )
 
 // Hashes gets the number of hashes
-func (db *Memory) Hashes() int {
+func (db *Memory) Hashes() (hashes int) {
 	// race condition but doesn't matter as it's just for metrics
-	return len(db.hashmap)
+	for i := range db.shards {
+		hashes += len(db.shards[i].hashmap)
+	}
+	return
+}
+
+// peermap returns the peermap for the hash if it exists
+func (db *Memory) peermap(hash storage.Hash) (peermap *PeerMap, ok bool) {
+	shard := db.shard(hash)
+	shard.mutex.RLock()
+	peermap, ok = shard.hashmap[hash]
+	shard.mutex.RUnlock()
+	return
 }
 
-// HashStats returns number of complete and incomplete peers associated with the hash
-func (db *Memory) HashStats(hash storage.Hash) (complete, incomplete uint16) {
-	db.mutex.RLock()
-	peermap, ok := db.hashmap[hash]
-	db.mutex.RUnlock()
+// createPeermap returns the peermap for the hash, creating it if it doesn't exist
+func (db *Memory) createPeermap(hash storage.Hash) *PeerMap {
+	shard := db.shard(hash)
+	shard.mutex.RLock()
+	peermap, ok := shard.hashmap[hash]
+	shard.mutex.RUnlock()
+
+	// another goroutine may beat us to creating it
+	if !ok {
+		shard.mutex.Lock()
+		if peermap, ok = shard.hashmap[hash]; !ok {
+			peermap = shard.makePeermap(hash)
+		}
+		shard.mutex.Unlock()
+	}
+	return peermap
+}
+
+// lockPeermap returns the write locked peermap for the hash, creating it if it doesn't exist
+func (db *Memory) lockPeermap(hash storage.Hash) *PeerMap {
+	for {
+		peermap := db.createPeermap(hash)
+		peermap.mutex.Lock()
+		if !peermap.removed {
+			return peermap
+		}
+		// it was emptied and removed after we found it
+		peermap.mutex.Unlock()
+	}
+}
+
+// HashStats returns number of complete and incomplete peers associated with the hash and its completed downloads
+func (db *Memory) HashStats(hash storage.Hash) (complete, incomplete, downloaded uint32) {
+	peermap, ok := db.peermap(hash)
 	if !ok {
 		return
 	}
@@ -25,104 +66,175 @@ func (db *Memory) HashStats(hash storage.Hash) (complete, incomplete uint16) {
 	peermap.mutex.RLock()
 	complete = peermap.Complete
 	incomplete = peermap.Incomplete
+	downloaded = peermap.Downloaded
 	peermap.mutex.RUnlock()
 
 	return
 }
 
-// PeerList returns a peer list for the given hash capped at max
-func (db *Memory) PeerList(hash storage.Hash, numWant uint, removePeerId bool) (peers [][]byte) {
-	db.mutex.RLock()
-	peermap, ok := db.hashmap[hash]
-	db.mutex.RUnlock()
+// PeerList returns a random sample of up to numWant peers for the given hash other than the requester, mixed by its role (see storage.PeerMix)
+func (db *Memory) PeerList(hash storage.Hash, numWant uint, requester storage.Requester, removePeerId bool) (peers [][]byte) {
+	peermap, ok := db.peermap(hash)
 	if !ok {
 		return
 	}
 
 	peermap.mutex.RLock()
+	peers = peermap.peerList(numWant, &requester, removePeerId)
+	peermap.mutex.RUnlock()
 
-	if numPeers := uint(len(peermap.Peers)); numWant > numPeers {
-		numWant = numPeers
+	return
+}
+
+// PeerListBytes returns byte encoded random samples of up to numWant ipv4 and up to numWant ipv6 peers for the given hash other than the requester, mixed by its role (see storage.PeerMix)
+// The peers are copied entry by entry out of the compact lists of the swarm.
+func (db *Memory) PeerListBytes(hash storage.Hash, numWant uint, requester storage.Requester) (peers4 []byte, peers6 []byte) {
+	peers4 = pools.Peerlists4.Get()
+	peers6 = pools.Peerlists6.Get()
+
+	peermap, ok := db.peermap(hash)
+	if !ok {
+		return peers4[:0], peers6[:0]
 	}
 
+	peermap.mutex.RLock()
+	peers4, peers6 = peermap.peerListBytes(peers4, peers6, numWant, &requester)
+	peermap.mutex.RUnlock()
+
+	return
+}
+
+// peerList is PeerList on a locked peermap.
+func (peermap *PeerMap) peerList(numWant uint, requester *storage.Requester, removePeerId bool) (peers [][]byte) {
 	if numWant == 0 {
-		peermap.mutex.RUnlock()
 		return
 	}
 
-	var i uint
-	peers = make([][]byte, numWant)
+	rng := newSampler()
 	dictionary := pools.Dictionaries.Get()
 
-	for id, peer := range peermap.Peers {
-		if !removePeerId {
-			dictionary.String("peer id", string(id[:]))
-		}
-		dictionary.String("ip", peer.IP.String())
-		dictionary.Int64("port", int64(peer.Port))
+	excluded := peermap.exclude(requester)
+	seedCount4, seedCount6 := peermap.available(seeds4, &excluded), peermap.available(seeds6, &excluded)
+	leechCount4, leechCount6 := peermap.available(leeches4, &excluded), peermap.available(leeches6, &excluded)
 
-		dictBytes := dictionary.GetBytes()
-		peers[i] = make([]byte, len(dictBytes))
-		copy(peers[i], dictBytes)
+	wantSeeds, wantLeeches := storage.PeerMix(numWant, seedCount4+seedCount6, leechCount4+leechCount6, requester.Complete)
+	peers = make([][]byte, 0, wantSeeds+wantLeeches)
 
-		dictionary.Reset()
+	encode := func(list int, n uint) {
+		compact := &peermap.lists[list]
+		compact.sample(&rng, n, func(pos uint) bool {
+			peer := &peermap.slots[compact.slots[pos]]
+			ip := peer.addr()
+			if requester.Is(peer.id, ip, peer.port) {
+				return false
+			}
 
-		i++
-		if i == numWant {
-			break
-		}
+			if !removePeerId {
+				dictionary.String("peer id", string(peer.id[:]))
+			}
+			dictionary.String("ip", ip.String())
+			dictionary.Int64("port", int64(peer.port))
+
+			dictBytes := dictionary.GetBytes()
+			peerBytes := make([]byte, len(dictBytes))
+			copy(peerBytes, dictBytes)
+			peers = append(peers, peerBytes)
+
+			dictionary.Reset()
+			return true
+		})
 	}
 
-	peermap.mutex.RUnlock()
+	// the families are split as if the peers were sampled from both at once
+	want4, want6 := rng.split(wantSeeds, seedCount4, seedCount6)
+	encode(seeds4, want4)
+	encode(seeds6, want6)
+	want4, want6 = rng.split(wantLeeches, leechCount4, leechCount6)
+	encode(leeches4, want4)
+	encode(leeches6, want6)
+
 	pools.Dictionaries.Put(dictionary)
 
 	return
 }
 
-// PeerListBytes returns a byte encoded peer list for the given hash capped at num
-func (db *Memory) PeerListBytes(hash storage.Hash, numWant uint) (peers4 []byte, peers6 []byte) {
-	peers4 = pools.Peerlists4.Get()
-	peers6 = pools.Peerlists6.Get()
-
-	db.mutex.RLock()
-	peermap, ok := db.hashmap[hash]
-	db.mutex.RUnlock()
-	if !ok {
-		return
+// peerListBytes is PeerListBytes on a locked peermap, the peers are appended to the emptied peers4 and peers6 up to their capacity.
+func (peermap *PeerMap) peerListBytes(peers4, peers6 []byte, numWant uint, requester *storage.Requester) ([]byte, []byte) {
+	want4, want6 := numWant, numWant
+	if limit := uint(cap(peers4) / 6); want4 > limit {
+		want4 = limit
+	}
+	if limit := uint(cap(peers6) / 18); want6 > limit {
+		want6 = limit
 	}
 
-	peermap.mutex.RLock()
-	if numPeers := uint(len(peermap.Peers)); numWant > numPeers {
-		numWant = numPeers
+	rng := newSampler()
+	peers4, peers6 = peers4[:0], peers6[:0]
+	excluded := peermap.exclude(requester)
+
+	wantSeeds, wantLeeches := storage.PeerMix(want4, peermap.available(seeds4, &excluded), peermap.available(leeches4, &excluded), requester.Complete)
+	peers4 = peermap.appendEntries(peers4, seeds4, wantSeeds, &rng, &excluded)
+	peers4 = peermap.appendEntries(peers4, leeches4, wantLeeches, &rng, &excluded)
+
+	wantSeeds, wantLeeches = storage.PeerMix(want6, peermap.available(seeds6, &excluded), peermap.available(leeches6, &excluded), requester.Complete)
+	peers6 = peermap.appendEntries(peers6, seeds6, wantSeeds, &rng, &excluded)
+	peers6 = peermap.appendEntries(peers6, leeches6, wantLeeches, &rng, &excluded)
+
+	return peers4, peers6
+}
+
+// excluded locates the requester in the compact lists so it's left out of its own peer list.
+type excluded struct {
+	list  int // list of the entry of the requester's peer id, -1 if the peer id isn't in the swarm
+	entry uint32
+	addr  []byte // compact entry of the requester's announced address
+}
+
+// exclude returns where the requester is in the compact lists, the peermap must be locked.
+func (peermap *PeerMap) exclude(requester *storage.Requester) (ex excluded) {
+	ex.list = -1
+	if index, ok := peermap.ids[requester.ID]; ok {
+		ex.list = peermap.slots[index].list()
+		ex.entry = peermap.slots[index].entry
 	}
 
-	if numWant == 0 {
-		peermap.mutex.RUnlock()
-		return
+	if ip := requester.Addr.Addr(); ip.IsValid() {
+		var s slot
+		s.set(&storage.Peer{IP: ip, Port: requester.Addr.Port()})
+		ex.addr = make([]byte, entrySize(s.list()))
+		s.writeEntry(ex.addr)
 	}
+	return
+}
 
-	var pos4, pos6 int
-	for _, peer := range peermap.Peers {
-		if peer.IP.Is6() {
-			copy(peers6[pos6:pos6+16], peer.IP.AsSlice())
-			binary.BigEndian.PutUint16(peers6[pos6+16:pos6+18], peer.Port)
-			pos6 += 18
-			if pos6+18 > cap(peers6) {
-				break
-			}
-		} else {
-			copy(peers4[pos4:pos4+4], peer.IP.AsSlice())
-			binary.BigEndian.PutUint16(peers4[pos4+4:pos4+6], peer.Port)
-			pos4 += 6
-			if pos4+6 > cap(peers4) {
-				break
-			}
-		}
+// is returns true if the entry at pos of the list is the requester.
+func (ex *excluded) is(list int, pos uint32, entry []byte) bool {
+	return (list == ex.list && pos == ex.entry) || bytes.Equal(entry, ex.addr)
+}
+
+// available returns the number of peers of the list other than the requester's peer id.
+// Other peers announcing from the requester's address are only found while copying.
+func (peermap *PeerMap) available(list int, ex *excluded) uint {
+	count := peermap.lists[list].len()
+	if list == ex.list {
+		count--
 	}
-	peermap.mutex.RUnlock()
+	return count
+}
 
-	peers4 = peers4[:pos4]
-	peers6 = peers6[:pos6]
+// appendEntries appends up to n random compact entries of the list to buf leaving out the requester, the peermap must be locked.
+func (peermap *PeerMap) appendEntries(buf []byte, list int, n uint, rng *sampler, ex *excluded) []byte {
+	compact := &peermap.lists[list]
+	size := entrySize(list)
 
-	return
+	compact.sample(rng, n, func(pos uint) bool {
+		entry := compact.entries[int(pos)*size : int(pos+1)*size]
+		if ex.is(list, uint32(pos), entry) {
+			return false
+		}
+		buf = append(buf, entry...)
+		return true
+	})
+
+	return buf
 }
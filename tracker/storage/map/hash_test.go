@@ -1,10 +1,14 @@
 package gomap
 
 import (
+	"encoding/binary"
 	"math/rand"
 	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
 	"github.com/crimist/trakx/tracker/storage"
 )
 
@@ -28,7 +32,7 @@ func dbWithHashesAndPeers(hashes, peers int) *Memory {
 
 		for i := 0; i < peers; i++ {
 			rand.Read(peerid[:])
-			db.Save(peer.IP, peer.Port, peer.Complete, h, peerid)
+			db.Save(peer.IP, peer.Port, peer.Complete, h, peerid, false, storage.Transfer{}, 0)
 		}
 	}
 
@@ -53,7 +57,7 @@ func dbWithHashes(count int) *Memory {
 		rand.Read(hash)
 		copy(h[:], hash)
 
-		db.Save(peer.IP, peer.Port, peer.Complete, h, peerid)
+		db.Save(peer.IP, peer.Port, peer.Complete, h, peerid, false, storage.Transfer{}, 0)
 	}
 
 	return &db
@@ -78,12 +82,264 @@ func dbWithPeers(count int) (*Memory, storage.Hash) {
 		rand.Read(peerid)
 		copy(p[:], peerid)
 
-		db.Save(peer.IP, peer.Port, peer.Complete, hash, p)
+		db.Save(peer.IP, peer.Port, peer.Complete, hash, p, false, storage.Transfer{}, 0)
 	}
 
 	return &db, hash
 }
 
+// dbWithMixedPeers returns a database with a swarm of v4 and v6 peers, each peer has a unique port.
+func dbWithMixedPeers(v4, v6 int) (*Memory, storage.Hash) {
+	var db Memory
+	db.make()
+
+	hash := storage.Hash{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	for i := 0; i < v4+v6; i++ {
+		ip := netip.MustParseAddr("1.2.3.4")
+		if i >= v4 {
+			ip = netip.MustParseAddr("::1")
+		}
+		db.Save(ip, uint16(i), false, hash, mixedPeerID(i), false, storage.Transfer{}, 0)
+	}
+
+	return &db, hash
+}
+
+// mixedPeerID returns the id of the i'th peer of dbWithMixedPeers, it starts with the port and is never zero.
+func mixedPeerID(i int) (peerid storage.PeerID) {
+	binary.BigEndian.PutUint16(peerid[:], uint16(i))
+	binary.BigEndian.PutUint16(peerid[2:], uint16(i>>16))
+	peerid[19] = 1
+	return
+}
+
+// checkUniform fails if any of the peers wasn't sampled within 15% of its expected count.
+func checkUniform(t *testing.T, name string, counts map[uint16]int, peers int, expected float64) {
+	if len(counts) != peers {
+		t.Errorf("%v sampled %v distinct peers; want %v", name, len(counts), peers)
+	}
+	for port, count := range counts {
+		if deviation := (float64(count) - expected) / expected; deviation > 0.15 || deviation < -0.15 {
+			t.Errorf("%v sampled peer %v %v times; want %.0f±15%%", name, port, count, expected)
+		}
+	}
+}
+
+func TestPeerListBytesDistribution(t *testing.T) {
+	const v4, v6, numWant, rounds = 100, 50, 10, 20_000
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(numWant)
+	db, hash := dbWithMixedPeers(v4, v6)
+
+	counts4 := make(map[uint16]int)
+	counts6 := make(map[uint16]int)
+	for i := 0; i < rounds; i++ {
+		peers4, peers6 := db.PeerListBytes(hash, numWant, storage.Requester{Complete: false})
+
+		// both families are filled independently
+		if len(peers4) != numWant*6 || len(peers6) != numWant*18 {
+			t.Fatalf("PeerListBytes() returned %v v4 and %v v6 peers; want %v of each", len(peers4)/6, len(peers6)/18, numWant)
+		}
+
+		seen := make(map[uint16]bool)
+		for pos := 0; pos < len(peers4); pos += 6 {
+			port := binary.BigEndian.Uint16(peers4[pos+4:])
+			counts4[port]++
+			seen[port] = true
+		}
+		for pos := 0; pos < len(peers6); pos += 18 {
+			port := binary.BigEndian.Uint16(peers6[pos+16:])
+			counts6[port]++
+			seen[port] = true
+		}
+		if len(seen) != 2*numWant {
+			t.Fatalf("PeerListBytes() returned duplicate peers")
+		}
+
+		pools.Peerlists4.Put(peers4)
+		pools.Peerlists6.Put(peers6)
+	}
+
+	checkUniform(t, "v4", counts4, v4, rounds*numWant/float64(v4))
+	checkUniform(t, "v6", counts6, v6, rounds*numWant/float64(v6))
+}
+
+func TestPeerListDistribution(t *testing.T) {
+	const peers, numWant, rounds = 100, 10, 10_000
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(numWant)
+	db, hash := dbWithMixedPeers(peers, 0)
+
+	counts := make(map[uint16]int)
+	for i := 0; i < rounds; i++ {
+		list := db.PeerList(hash, numWant, storage.Requester{Complete: false}, false)
+		if len(list) != numWant {
+			t.Fatalf("PeerList() returned %v peers; want %v", len(list), numWant)
+		}
+		for _, peer := range list {
+			// the peer id starts with the port
+			id := peer[len("d7:peer id20:"):]
+			counts[binary.BigEndian.Uint16(id)]++
+		}
+	}
+
+	checkUniform(t, "PeerList", counts, peers, rounds*numWant/float64(peers))
+
+	// small swarms are returned whole
+	if list := db.PeerList(hash, peers*2, storage.Requester{Complete: false}, true); len(list) != peers {
+		t.Errorf("PeerList() over the swarm size returned %v peers; want %v", len(list), peers)
+	}
+}
+
+// checkPairs fails if any two peers were returned together more than 20% away from the expected count, sampling runs of neighbouring peers returns the same groups over and over.
+func checkPairs(t *testing.T, name string, pairs map[[2]uint16]int, peers int, expected float64) {
+	if len(pairs) != peers*(peers-1)/2 {
+		t.Errorf("%v returned %v distinct pairs; want %v", name, len(pairs), peers*(peers-1)/2)
+	}
+	for pair, count := range pairs {
+		if deviation := (float64(count) - expected) / expected; deviation > 0.2 || deviation < -0.2 {
+			t.Errorf("%v returned peers %v and %v together %v times; want %.0f±20%%", name, pair[0], pair[1], count, expected)
+		}
+	}
+}
+
+// countPairs counts every pair of the ports.
+func countPairs(pairs map[[2]uint16]int, ports []uint16) {
+	for i := range ports {
+		for j := i + 1; j < len(ports); j++ {
+			a, b := ports[i], ports[j]
+			if a > b {
+				a, b = b, a
+			}
+			pairs[[2]uint16{a, b}]++
+		}
+	}
+}
+
+func TestPeerListPairs(t *testing.T) {
+	const peers, numWant, rounds = 20, 5, 20_000
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(numWant)
+	db, hash := dbWithMixedPeers(peers, 0)
+
+	// a pair is returned together with probability numWant*(numWant-1) / (peers*(peers-1))
+	expected := rounds * float64(numWant*(numWant-1)) / float64(peers*(peers-1))
+
+	pairs := make(map[[2]uint16]int)
+	for i := 0; i < rounds; i++ {
+		peers4, peers6 := db.PeerListBytes(hash, numWant, storage.Requester{Complete: false})
+		var ports []uint16
+		for pos := 0; pos < len(peers4); pos += 6 {
+			ports = append(ports, binary.BigEndian.Uint16(peers4[pos+4:]))
+		}
+		countPairs(pairs, ports)
+
+		pools.Peerlists4.Put(peers4)
+		pools.Peerlists6.Put(peers6)
+	}
+	checkPairs(t, "PeerListBytes", pairs, peers, expected)
+
+	pairs = make(map[[2]uint16]int)
+	for i := 0; i < rounds; i++ {
+		var ports []uint16
+		for _, peer := range db.PeerList(hash, numWant, storage.Requester{Complete: false}, false) {
+			// the peer id starts with the port
+			ports = append(ports, binary.BigEndian.Uint16(peer[len("d7:peer id20:"):]))
+		}
+		countPairs(pairs, ports)
+	}
+	checkPairs(t, "PeerList", pairs, peers, expected)
+}
+
+func TestPeerListRoles(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	config.Config.Numwant.SeedRatio = 0.5
+	pools.Initialize(10)
+
+	var db Memory
+	db.make()
+	hash := storage.Hash{1}
+
+	// ports below 100 are seeds
+	save := func(port uint16, complete bool) {
+		var peerid storage.PeerID
+		binary.BigEndian.PutUint16(peerid[:], port)
+		db.Save(netip.MustParseAddr("1.2.3.4"), port, complete, hash, peerid, false, storage.Transfer{}, 0)
+	}
+	roles := func(peers4 []byte) (seeds, leeches int) {
+		for pos := 0; pos < len(peers4); pos += 6 {
+			if binary.BigEndian.Uint16(peers4[pos+4:]) < 100 {
+				seeds++
+			} else {
+				leeches++
+			}
+		}
+		return
+	}
+
+	for i := uint16(0); i < 20; i++ {
+		save(i, true)
+		save(100+i, false)
+	}
+
+	peers4, _ := db.PeerListBytes(hash, 10, storage.Requester{Complete: false})
+	if seeds, leeches := roles(peers4); seeds != 5 || leeches != 5 {
+		t.Errorf("leech got %v seeds and %v leeches; want 5, 5", seeds, leeches)
+	}
+	peers4, _ = db.PeerListBytes(hash, 10, storage.Requester{Complete: true})
+	if seeds, leeches := roles(peers4); seeds != 0 || leeches != 10 {
+		t.Errorf("seed got %v seeds and %v leeches; want 0, 10", seeds, leeches)
+	}
+	if peers := db.PeerList(hash, 10, storage.Requester{Complete: true}, true); len(peers) != 10 {
+		t.Errorf("PeerList() for seed returned %v peers; want 10", len(peers))
+	}
+
+	// leeches are topped up with seeds when there aren't enough leeches
+	for i := uint16(0); i < 18; i++ {
+		var peerid storage.PeerID
+		binary.BigEndian.PutUint16(peerid[:], 100+i)
+		db.Drop(hash, peerid, netip.MustParseAddr("1.2.3.4"), 0)
+	}
+	peers4, _ = db.PeerListBytes(hash, 10, storage.Requester{Complete: false})
+	if seeds, leeches := roles(peers4); seeds != 8 || leeches != 2 {
+		t.Errorf("leech in seeded swarm got %v seeds and %v leeches; want 8, 2", seeds, leeches)
+	}
+	peers4, _ = db.PeerListBytes(hash, 10, storage.Requester{Complete: true})
+	if seeds, leeches := roles(peers4); seeds != 0 || leeches != 2 {
+		t.Errorf("seed in seeded swarm got %v seeds and %v leeches; want 0, 2", seeds, leeches)
+	}
+	if peers := db.PeerList(hash, 10, storage.Requester{Complete: false}, true); len(peers) != 10 {
+		t.Errorf("PeerList() for leech returned %v peers; want 10", len(peers))
+	}
+}
+
+func TestPeerListRequester(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	db, hash := dbWithMixedPeers(5, 0)
+	// ports are the peer index, peer 0 announces and peer 1 shares its address under another id
+	requester := storage.Requester{ID: mixedPeerID(0), Addr: netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), 1)}
+
+	peers4, _ := db.PeerListBytes(hash, 10, requester)
+	if len(peers4) != 3*6 {
+		t.Fatalf("PeerListBytes() returned %v peers; want 3", len(peers4)/6)
+	}
+	for pos := 0; pos < len(peers4); pos += 6 {
+		if port := binary.BigEndian.Uint16(peers4[pos+4:]); port == 0 || port == 1 {
+			t.Errorf("PeerListBytes() returned the requester (port %v)", port)
+		}
+	}
+	if peers := db.PeerList(hash, 10, requester, false); len(peers) != 3 {
+		t.Errorf("PeerList() returned %v peers; want 3", len(peers))
+	}
+
+	// the requester is left out without lowering the count returned
+	if peers4, _ = db.PeerListBytes(hash, 3, requester); len(peers4) != 3*6 {
+		t.Errorf("PeerListBytes(3) returned %v peers; want 3", len(peers4)/6)
+	}
+}
+
 func benchmarkHashes(b *testing.B, count int) {
 	db := dbWithHashes(count)
 
@@ -98,7 +354,7 @@ func BenchmarkHashes5000(b *testing.B)   { benchmarkHashes(b, 5000) }
 func BenchmarkHashes50000(b *testing.B)  { benchmarkHashes(b, 50000) }
 func BenchmarkHashes500000(b *testing.B) { benchmarkHashes(b, 500000) }
 
-// more/less peers doesn't change performance
+// sampling is linear in the number of peers
 const numPeers = 1000
 
 func benchmarkPeerList(b *testing.B, cap uint) {
@@ -106,7 +362,7 @@ func benchmarkPeerList(b *testing.B, cap uint) {
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		db.PeerList(hash, cap, false)
+		db.PeerList(hash, cap, storage.Requester{Complete: false}, false)
 	}
 }
 
@@ -120,7 +376,7 @@ func benchmarkPeerListNopeerid(b *testing.B, cap uint) {
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		db.PeerList(hash, cap, true)
+		db.PeerList(hash, cap, storage.Requester{Complete: false}, true)
 	}
 }
 
@@ -134,7 +390,7 @@ func benchmarkPeerListBytes(b *testing.B, cap uint) {
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		db.PeerListBytes(hash, cap)
+		db.PeerListBytes(hash, cap, storage.Requester{Complete: false})
 	}
 }
 
@@ -154,3 +410,15 @@ func benchmarkHashStats(b *testing.B, peers int) {
 
 func BenchmarkHashStats100(b *testing.B)  { benchmarkHashStats(b, 100) }
 func BenchmarkHashStats1000(b *testing.B) { benchmarkHashStats(b, 1000) }
+
+func TestHashStatsLarge(t *testing.T) {
+	// counts past the range of uint16
+	const peers = 70_000
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+	db, hash := dbWithMixedPeers(peers, 0)
+
+	if complete, incomplete, _ := db.HashStats(hash); complete != 0 || incomplete != peers {
+		t.Errorf("HashStats() = %v, %v; want 0, %v", complete, incomplete, peers)
+	}
+}
@@ -1,16 +1,30 @@
 /*
 	Map implements a trakx database through go maps in local memory. It is heavily optimized for performance but cannot be shared accross multiple trackers as it resides in local memory.
+
+	Swarms store their peers by value in slots found through a map of peer id to slot, so no peer holds a pointer for the collector to scan.
+	Every swarm also keeps the compact ip and port of its peers in one list per family and role, compact peer lists copy entries sampled uniformly out of them (see compactList.sample).
+
+	Peers expire through a timing wheel per shard holding them at their last seen time. Announces don't touch the wheel, a peer seen since it was scheduled is put back at its new time when it comes due.
+	Trims only visit the peers that are due and swarms are removed once their last peer leaves.
+
+	The infohash space can be split into independently locked shards (the "gomap-sharded" driver) to reduce lock contention between workers.
+
+	Go maps never shrink so swarms that shrank well below their peak are queued and rebuilt in the background along with the shards and the address index (see compact).
+
+	It's the only driver that enforces `db.limits.address`, the peers of every address are counted per swarm and globally (see addressIndex).
 */
 
 package gomap
 
 import (
+	"encoding/binary"
 	"sync"
 	"time"
 
 	"github.com/crimist/trakx/config"
 	"github.com/crimist/trakx/tracker/storage"
 	"github.com/crimist/trakx/tracker/utils"
+	"github.com/crimist/trakx/tracker/utils/timingwheel"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
@@ -18,25 +32,66 @@ import (
 const (
 	hashMapPrealloc = 250_000
 	peerMapPrealloc = 1
+
+	// number of shards used by "gomap-sharded" if `db.shards` isn't set
+	defaultShards = 64
 )
 
+// PeerMap is a swarm, its peers are stored by value in slots found through their id.
 type PeerMap struct {
-	mutex      sync.RWMutex // can't be embedded (https://github.com/golang/go/issues/5819#issuecomment-250596051)
-	Complete   uint16
-	Incomplete uint16
-	Peers      map[storage.PeerID]*storage.Peer
+	mutex           sync.RWMutex // can't be embedded (https://github.com/golang/go/issues/5819#issuecomment-250596051)
+	Complete        uint32
+	Incomplete      uint32
+	Downloaded      uint32 // completed announces, each peer is counted once while it stays a seed
+	UploadedBytes   uint64 // bytes uploaded by peers of the swarm
+	DownloadedBytes uint64 // bytes downloaded by peers of the swarm
+
+	ids   map[storage.PeerID]uint32 // slot of every peer
+	slots []slot
+	lists [4]compactList // compact entries of the peers by family and role
+
+	oldest, newest uint32 // ends of the slots ordered by last seen time, noSlot if there are none
+	unordered      bool   // peers were stored out of order, the oldest is found after orderSeen
+
+	addresses map[[16]byte]uint32 // peers per address, nil unless the addresses are indexed
+	removed   bool                // the peermap was empty and deleted from its shard
+
+	peak   uint32 // most peers held since the maps and slices were built
+	queued bool   // waiting in its shard to be compacted
 }
 
-type Memory struct {
+// peerKey locates a peer in the expiry wheel.
+type peerKey struct {
+	hash storage.Hash
+	id   storage.PeerID
+}
+
+// shard holds a portion of the infohash space under its own lock.
+type shard struct {
 	mutex   sync.RWMutex
 	hashmap map[storage.Hash]*PeerMap
+	peak    int // most hashes the hashmap was sized for since it was built
+
+	expiryMutex sync.Mutex // locked after the peermap mutex
+	expiry      timingwheel.Wheel[peerKey]
+
+	compactMutex sync.Mutex     // locked after the peermap mutex
+	shrunk       []storage.Hash // swarms queued to be compacted
+}
+
+type Memory struct {
+	shards  []shard
+	sharded bool // split the hashmap into `db.shards` shards
 
-	backup storage.Backup
+	backup    storage.Backup
+	journal   *journal      // set by JournalBackup to log changes
+	addresses *addressIndex // nil unless `db.limits.address` is set
 }
 
 func (db *Memory) Init(backup storage.Backup) error {
 	*db = Memory{
-		backup: backup,
+		sharded: db.sharded,
+		backup:  backup,
 	}
 
 	if err := db.backup.Init(db); err != nil {
@@ -56,19 +111,49 @@ func (db *Memory) Init(backup storage.Backup) error {
 	if config.Config.DB.Trim > 0 {
 		go utils.RunOn(config.Config.DB.Trim, db.Trim)
 	}
+	if config.Config.DB.Compact.Interval > 0 {
+		go utils.RunOn(config.Config.DB.Compact.Interval, db.Compact)
+	}
 
 	return nil
 }
 
 func (db *Memory) make() {
-	db.hashmap = make(map[storage.Hash]*PeerMap, hashMapPrealloc)
+	count := 1
+	if db.sharded {
+		count = config.Config.DB.Shards
+		if count < 1 {
+			count = defaultShards
+		}
+	}
+
+	db.addresses = newAddressIndex(count)
+	db.shards = make([]shard, count)
+	for i := range db.shards {
+		db.shards[i].hashmap = make(map[storage.Hash]*PeerMap, hashMapPrealloc/count)
+		db.shards[i].peak = hashMapPrealloc / count
+	}
 }
 
-func (db *Memory) makePeermap(h storage.Hash) (peermap *PeerMap) {
+// shard returns the shard responsible for the given hash.
+func (db *Memory) shard(hash storage.Hash) *shard {
+	if len(db.shards) == 1 {
+		return &db.shards[0]
+	}
+	// infohashes are sha1 digests so any 4 bytes are uniformly distributed
+	return &db.shards[binary.LittleEndian.Uint32(hash[:4])%uint32(len(db.shards))]
+}
+
+// makePeermap creates an empty peermap for the hash, shard write lock must be held.
+func (s *shard) makePeermap(h storage.Hash) (peermap *PeerMap) {
 	// build struct and assign
 	peermap = new(PeerMap)
-	peermap.Peers = make(map[storage.PeerID]*storage.Peer, peerMapPrealloc)
-	db.hashmap[h] = peermap
+	peermap.ids = make(map[storage.PeerID]uint32, peerMapPrealloc)
+	peermap.oldest, peermap.newest = noSlot, noSlot
+	s.hashmap[h] = peermap
+	if len(s.hashmap) > s.peak {
+		s.peak = len(s.hashmap)
+	}
 	return
 }
 
@@ -77,7 +162,15 @@ func (db *Memory) Backup() storage.Backup {
 }
 
 func (db *Memory) Check() bool {
-	return db.hashmap != nil
+	return db.shards != nil
+}
+
+// Close flushes and closes the journal if there is one.
+func (db *Memory) Close() error {
+	if db.journal == nil {
+		return nil
+	}
+	return db.journal.close()
 }
 
 func (db *Memory) Trim() {
@@ -87,33 +180,69 @@ func (db *Memory) Trim() {
 	config.Logger.Info("Trimmed database", zap.Int("peers", peers), zap.Int("hashes", hashes), zap.Duration("duration", time.Since(start)))
 }
 
+// trim deletes the peers of the expiry wheels last seen before the expiry and removes the swarms they leave empty.
 func (db *Memory) trim() (peers, hashes int) {
-	now := time.Now().Unix()
-	peerTimeout := int64(config.Config.DB.Expiry.Seconds())
-
-	db.mutex.RLock()
-	for hash, peermap := range db.hashmap {
-		db.mutex.RUnlock()
-
-		peermap.mutex.Lock()
-		for id, peer := range peermap.Peers {
-			if now-peer.LastSeen > peerTimeout {
-				db.delete(peer, peermap, id)
-				peers++
+	cutoff := time.Now().Unix() - int64(config.Config.DB.Expiry.Seconds())
+
+	for i := range db.shards {
+		shard := &db.shards[i]
+
+		shard.expiryMutex.Lock()
+		expired := shard.expiry.Expire(cutoff)
+		shard.expiryMutex.Unlock()
+
+		for _, entry := range expired {
+			hash := entry.Key.hash
+			peermap, ok := db.peermap(hash)
+			if !ok {
+				continue
+			}
+
+			peermap.mutex.Lock()
+			// entries of peers that were deleted or scheduled again since are stale
+			if index, ok := peermap.ids[entry.Key.id]; ok && peermap.slots[index].scheduled == entry.Time {
+				if peermap.slots[index].lastSeen < cutoff {
+					db.delete(peermap, hash, index)
+					peers++
+				} else {
+					db.schedule(hash, &peermap.slots[index])
+				}
+			}
+			empty := peermap.len() == 0
+			peermap.mutex.Unlock()
+
+			if empty && db.removeEmpty(hash, peermap) {
+				hashes++
 			}
 		}
-		peersize := len(peermap.Peers)
-		peermap.mutex.Unlock()
-
-		if peersize == 0 {
-			db.mutex.Lock()
-			delete(db.hashmap, hash)
-			db.mutex.Unlock()
-			hashes++
-		}
-		db.mutex.RLock()
 	}
-	db.mutex.RUnlock()
+
+	return
+}
+
+// schedule puts the peer in the expiry wheel at its last seen time, the peermap must be locked.
+func (db *Memory) schedule(hash storage.Hash, peer *slot) {
+	peer.scheduled = peer.lastSeen
+
+	shard := db.shard(hash)
+	shard.expiryMutex.Lock()
+	shard.expiry.Schedule(peerKey{hash, peer.id}, peer.lastSeen)
+	shard.expiryMutex.Unlock()
+}
+
+// removeEmpty deletes the peermap from its shard if it has no peers and returns true if it did.
+// Announces that found the peermap before it was removed see that it was and look it up again (see lockPeermap).
+func (db *Memory) removeEmpty(hash storage.Hash, peermap *PeerMap) (removed bool) {
+	shard := db.shard(hash)
+	shard.mutex.Lock()
+	peermap.mutex.Lock()
+	if peermap.len() == 0 && !peermap.removed {
+		delete(shard.hashmap, hash)
+		peermap.removed = true
+		removed = true
+	}
+	peermap.mutex.Unlock()
+	shard.mutex.Unlock()
 
 	return
 }
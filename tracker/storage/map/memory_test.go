@@ -1,10 +1,14 @@
 package gomap
 
 import (
+	"bytes"
+	"math/rand"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/storage"
 )
 
 const (
@@ -30,6 +34,95 @@ func TestTrim(t *testing.T) {
 	db.trim()
 }
 
+func TestTrimWheel(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+
+	var db Memory
+	db.make()
+
+	expired, seen := storage.PeerID{1}, storage.PeerID{2}
+	db.Save(testIP, 1, false, testHash, expired, false, storage.Transfer{}, 0)
+	db.Save(testIP, 2, false, testHash, seen, false, storage.Transfer{}, 0)
+
+	// both peers come due, only one of them wasn't seen since
+	peermap, _ := db.peermap(testHash)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	for _, id := range []storage.PeerID{expired, seen} {
+		peer := &peermap.slots[peermap.ids[id]]
+		peer.lastSeen = old
+		db.schedule(testHash, peer)
+	}
+	peermap.slots[peermap.ids[seen]].lastSeen = time.Now().Unix()
+
+	if peers, hashes := db.trim(); peers != 1 || hashes != 0 {
+		t.Errorf("trim() = %v, %v; want 1, 0", peers, hashes)
+	}
+	if _, ok := peermap.get(expired); ok {
+		t.Error("trim() kept the expired peer")
+	}
+	peer := &peermap.slots[peermap.ids[seen]]
+	if _, ok := peermap.get(seen); !ok || peer.scheduled != peer.lastSeen {
+		t.Errorf("trim() didn't schedule the seen peer again at %v", peer.lastSeen)
+	}
+
+	// stale entries of the rescheduled peer don't delete it twice
+	config.Config.DB.Expiry = -1 * time.Second
+	if peers, hashes := db.trim(); peers != 1 || hashes != 1 {
+		t.Errorf("trim() = %v, %v; want 1, 1", peers, hashes)
+	}
+	if db.Hashes() != 0 || db.shards[0].expiry.Len() != 0 {
+		t.Errorf("trim() left %v hashes and %v scheduled peers; want none", db.Hashes(), db.shards[0].expiry.Len())
+	}
+}
+
+func TestSharded(t *testing.T) {
+	config.Config.DB.Shards = 16
+	config.Config.DB.Expiry = time.Hour
+
+	db := Memory{sharded: true}
+	db.make()
+	if len(db.shards) != 16 {
+		t.Fatalf("shards = %v; want 16", len(db.shards))
+	}
+
+	var hash storage.Hash
+	peerid := storage.PeerID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	for i := 0; i < 1000; i++ {
+		rand.Read(hash[:])
+		db.Save(testIP, 1234, false, hash, peerid, false, storage.Transfer{}, 0)
+	}
+
+	if hashes := db.Hashes(); hashes != 1000 {
+		t.Errorf("Hashes() = %v; want 1000", hashes)
+	}
+	for i := range db.shards {
+		if len(db.shards[i].hashmap) == 0 {
+			t.Errorf("shard %v is empty", i)
+		}
+	}
+
+	// sharded backups must load into any shard count
+	var data bytes.Buffer
+	if err := db.encodeBinary(&data); err != nil {
+		t.Fatal("encodeBinary threw error: ", err)
+	}
+	var single Memory
+	if _, _, err := single.decodeBinary(&data); err != nil {
+		t.Fatal("decodeBinary threw error: ", err)
+	}
+	if hashes := single.Hashes(); hashes != 1000 {
+		t.Errorf("Hashes() after decode = %v; want 1000", hashes)
+	}
+
+	config.Config.DB.Expiry = -1 * time.Second
+	if peers, hashes := db.trim(); peers != 1000 || hashes != 1000 {
+		t.Errorf("trim() = %v, %v; want 1000, 1000", peers, hashes)
+	}
+	if hashes := db.Hashes(); hashes != 0 {
+		t.Errorf("Hashes() after trim = %v; want 0", hashes)
+	}
+}
+
 func BenchmarkTrim(b *testing.B) {
 	config.Config.DB.Expiry = -1 * time.Second
 
@@ -44,3 +137,29 @@ func BenchmarkTrim(b *testing.B) {
 		b.StopTimer()
 	}
 }
+
+// BenchmarkTrimUnexpired trims a database where no peer is due, it only advances the wheels.
+func BenchmarkTrimUnexpired(b *testing.B) {
+	config.Config.DB.Expiry = time.Hour
+	peerdb := dbWithHashesAndPeers(benchHashes, benchPeers)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peerdb.trim()
+	}
+}
+
+// benchmarkGC measures a full collection with the database live, the time grows with the pointers the collector has to scan.
+func benchmarkGC(b *testing.B, db *Memory) {
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+	}
+	runtime.KeepAlive(db)
+}
+
+func BenchmarkGC(b *testing.B) { benchmarkGC(b, dbWithHashesAndPeers(benchHashes, benchPeers)) }
+func BenchmarkGCSwarm(b *testing.B) {
+	db, _ := dbWithPeers(benchPeersTotal)
+	benchmarkGC(b, db)
+}
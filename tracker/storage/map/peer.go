@@ -4,34 +4,81 @@ import (
 	"net/netip"
 	"time"
 
-	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/config"
 	"github.com/crimist/trakx/tracker/stats"
 	"github.com/crimist/trakx/tracker/storage"
 )
 
-func (memoryDb *Memory) Save(ip netip.Addr, port uint16, complete bool, hash storage.Hash, id storage.PeerID) {
-	// get/create the map
-	memoryDb.mutex.RLock()
-	peermap, ok := memoryDb.hashmap[hash]
-	memoryDb.mutex.RUnlock()
+// Save stores the peer unless it's owned by another client or its address reached a limit
+func (memoryDb *Memory) Save(ip netip.Addr, port uint16, complete bool, hash storage.Hash, id storage.PeerID, completed bool, transfer storage.Transfer, key uint32) error {
+	return memoryDb.save(ip, port, complete, hash, id, completed, transfer, key, true)
+}
 
-	// if submap doesn't exist create it
-	if !ok {
-		memoryDb.mutex.Lock()
-		peermap = memoryDb.makePeermap(hash)
-		memoryDb.mutex.Unlock()
+// save is Save with the address limits optional so trusted records can be restored
+func (memoryDb *Memory) save(ip netip.Addr, port uint16, complete bool, hash storage.Hash, id storage.PeerID, completed bool, transfer storage.Transfer, key uint32, enforce bool) error {
+	peermap := memoryDb.lockPeermap(hash)
+	change, err := memoryDb.upsert(peermap, ip, port, complete, hash, id, completed, transfer, key, enforce)
+	empty := peermap.len() == 0
+	peermap.mutex.Unlock()
+
+	if err != nil {
+		// don't keep the swarm a rejected peer created
+		if empty {
+			memoryDb.removeEmpty(hash, peermap)
+		}
+		return err
 	}
 
-	// get peer
-	peermap.mutex.RLock()
-	peer, peerExists := peermap.Peers[id]
-	peermap.mutex.RUnlock()
+	change.updateMetrics(ip, complete)
+	return nil
+}
+
+// upserted is what an upsert changed, the metrics are updated from it once the peermap is unlocked
+type upserted struct {
+	peerExists  bool
+	wasComplete bool
+	oldIP       netip.Addr
+	uploaded    uint64
+	downloaded  uint64
+}
 
-	peermap.mutex.Lock()
-	// if peer does not exist then create
+// upsert stores the peer in the peermap unless it's owned by another client or its address reached a limit, the peermap must be locked.
+func (memoryDb *Memory) upsert(peermap *PeerMap, ip netip.Addr, port uint16, complete bool, hash storage.Hash, id storage.PeerID, completed bool, transfer storage.Transfer, key uint32, enforce bool) (change upserted, err error) {
+	now := time.Now().Unix()
+
+	index, peerExists := peermap.ids[id]
+	var peer storage.Peer
+	if peerExists {
+		peer = peermap.slots[index].peer()
+		if !peer.Owns(key, ip) {
+			return change, storage.ErrPeerOwned
+		}
+	}
+
+	// count the peer under its new address before anything changes
+	if addresses := memoryDb.addresses; addresses != nil {
+		address := addresses.address(ip)
+		if !peerExists || address != addresses.address(peer.IP) {
+			if enforce {
+				if err = addresses.acquire(peermap, address); err != nil {
+					return
+				}
+			} else {
+				addresses.add(peermap, address)
+			}
+			if peerExists {
+				addresses.release(peermap, addresses.address(peer.IP))
+			}
+		}
+	}
+
+	// make room for a new peer
 	if !peerExists {
-		peer = pools.Peers.Get()
-		peermap.Peers[id] = peer
+		if limit := config.Config.DB.Limits.Peers; limit > 0 {
+			for uint32(peermap.len()) >= limit {
+				memoryDb.evict(peermap, hash)
+			}
+		}
 	}
 
 	// update peermap completion counts
@@ -51,109 +98,172 @@ func (memoryDb *Memory) Save(ip netip.Addr, port uint16, complete bool, hash sto
 			peermap.Incomplete++
 		}
 	}
-	peermap.mutex.Unlock()
 
-	// update metrics
-	if !fast {
-		if peerExists {
-			// They completed
-			if !peer.Complete && complete {
-				stats.Leeches.Add(-1)
-				stats.Seeds.Add(1)
-			} else if peer.Complete && !complete { // They uncompleted?
-				stats.Seeds.Add(-1)
-				stats.Leeches.Add(1)
-			}
-			// IP changed
-			if peer.IP != ip {
-				stats.IPStats.Lock()
-				stats.IPStats.Remove(peer.IP)
-				stats.IPStats.Inc(ip)
-				stats.IPStats.Unlock()
-			}
-		} else {
-			stats.IPStats.Lock()
-			stats.IPStats.Inc(ip)
-			stats.IPStats.Unlock()
+	// count completed downloads once per peer
+	snatched := completed && !(peerExists && peer.Complete)
+	if snatched {
+		peermap.Downloaded++
+	}
 
-			if complete {
-				stats.Seeds.Add(1)
-			} else {
-				stats.Leeches.Add(1)
-			}
-		}
+	uploaded, downloaded := peer.Account(transfer, now, peerExists)
+	peermap.UploadedBytes += uploaded
+	peermap.DownloadedBytes += downloaded
+
+	// announces without a key keep the stored one
+	if key != 0 {
+		peer.Key = key
 	}
 
-	// update peer
+	change = upserted{
+		peerExists:  peerExists,
+		wasComplete: peer.Complete,
+		oldIP:       peer.IP,
+		uploaded:    uploaded,
+		downloaded:  downloaded,
+	}
 	peer.Complete = complete
 	peer.IP = ip
 	peer.Port = port
-	peer.LastSeen = time.Now().Unix()
+	peer.LastSeen = now
+	if peerExists {
+		peermap.update(index, &peer)
+	} else {
+		memoryDb.schedule(hash, &peermap.slots[peermap.insert(id, &peer)])
+	}
+
+	if memoryDb.journal != nil {
+		memoryDb.journal.save(hash, id, &peer)
+		if snatched || uploaded > 0 || downloaded > 0 {
+			memoryDb.journal.swarm(hash, peermap)
+		}
+	}
+
+	return
 }
 
-// delete is similar to drop but doesn't lock
-func (db *Memory) delete(peer *storage.Peer, peermap *PeerMap, id storage.PeerID) {
-	delete(peermap.Peers, id)
+// updateMetrics applies the change to the peer now at ip to the global stats
+func (change *upserted) updateMetrics(ip netip.Addr, complete bool) {
+	if fast {
+		return
+	}
+
+	stats.AddTransfer(change.uploaded, change.downloaded)
 
-	if peer.Complete {
+	if change.peerExists {
+		// They completed
+		if !change.wasComplete && complete {
+			stats.Leeches.Add(-1)
+			stats.Seeds.Add(1)
+		} else if change.wasComplete && !complete { // They uncompleted?
+			stats.Seeds.Add(-1)
+			stats.Leeches.Add(1)
+		}
+		// IP changed
+		if change.oldIP != ip {
+			stats.IPStats.Lock()
+			stats.IPStats.Remove(change.oldIP)
+			stats.IPStats.Inc(ip)
+			stats.IPStats.Unlock()
+		}
+	} else {
+		stats.IPStats.Lock()
+		stats.IPStats.Inc(ip)
+		stats.IPStats.Unlock()
+
+		if complete {
+			stats.Seeds.Add(1)
+		} else {
+			stats.Leeches.Add(1)
+		}
+	}
+}
+
+// delete is similar to drop but doesn't lock, the last slot of the peermap is moved into the deleted one
+func (db *Memory) delete(peermap *PeerMap, hash storage.Hash, index uint32) {
+	peer := &peermap.slots[index]
+	complete, ip := peer.complete, peer.addr()
+
+	if db.journal != nil {
+		db.journal.drop(hash, peer.id)
+	}
+	peermap.remove(index)
+	db.queueShrunk(hash, peermap)
+
+	if complete {
 		peermap.Complete--
 	} else {
 		peermap.Incomplete--
 	}
 
+	if db.addresses != nil {
+		db.addresses.release(peermap, db.addresses.address(ip))
+	}
+
 	if !fast {
-		if peer.Complete {
+		if complete {
 			stats.Seeds.Add(-1)
 		} else {
 			stats.Leeches.Add(-1)
 		}
 
 		stats.IPStats.Lock()
-		stats.IPStats.Remove(peer.IP)
+		stats.IPStats.Remove(ip)
 		stats.IPStats.Unlock()
 	}
+}
 
-	pools.Peers.Put(peer)
+// evict deletes the least recently seen peer of the peermap to make room for a new one, the peermap must be locked.
+func (db *Memory) evict(peermap *PeerMap, hash storage.Hash) {
+	if peermap.len() == 0 {
+		return
+	}
+
+	if peermap.unordered {
+		peermap.orderSeen()
+	}
+	db.delete(peermap, hash, peermap.oldest)
+	stats.Evictions.Add(1)
 }
 
-// Drop deletes peer
-func (db *Memory) Drop(hash storage.Hash, id storage.PeerID) {
+// Drop deletes the peer unless it's owned by another client
+func (db *Memory) Drop(hash storage.Hash, id storage.PeerID, ip netip.Addr, key uint32) error {
 	// get the peermap
-	db.mutex.RLock()
-	peermap, ok := db.hashmap[hash]
-	db.mutex.RUnlock()
+	peermap, ok := db.peermap(hash)
 	if !ok {
-		return
+		return nil
 	}
 
 	// get the peer and remove it
 	peermap.mutex.Lock()
-	peer, ok := peermap.Peers[id]
+	index, ok := peermap.ids[id]
 	if !ok {
 		peermap.mutex.Unlock()
-		return
+		return nil
 	}
-	delete(peermap.Peers, id)
-
-	if peer.Complete {
-		peermap.Complete--
-	} else {
-		peermap.Incomplete--
+	if peer := peermap.slots[index].peer(); !peer.Owns(key, ip) {
+		peermap.mutex.Unlock()
+		return storage.ErrPeerOwned
 	}
+	db.delete(peermap, hash, index)
+	empty := peermap.len() == 0
 	peermap.mutex.Unlock()
 
-	if !fast {
-		if peer.Complete {
-			stats.Seeds.Add(-1)
-		} else {
-			stats.Leeches.Add(-1)
-		}
+	if empty {
+		db.removeEmpty(hash, peermap)
+	}
+	return nil
+}
 
-		stats.IPStats.Lock()
-		stats.IPStats.Remove(peer.IP)
-		stats.IPStats.Unlock()
+// drop deletes the peer regardless of who owns it
+func (db *Memory) drop(hash storage.Hash, id storage.PeerID) {
+	peermap, ok := db.peermap(hash)
+	if !ok {
+		return
 	}
 
-	// free the peer back to the pool
-	pools.Peers.Put(peer)
+	peermap.mutex.Lock()
+	if index, ok := peermap.ids[id]; ok {
+		db.delete(peermap, hash, index)
+	}
+	peermap.mutex.Unlock()
 }
@@ -1,10 +1,16 @@
 package gomap
 
 import (
+	"bytes"
+	"math/rand"
 	"net/netip"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/stats"
 	"github.com/crimist/trakx/tracker/storage"
 )
 
@@ -23,8 +29,8 @@ func TestSaveDrop(t *testing.T) {
 		IP:       testIP,
 		Port:     4321,
 	}
-	db.Save(peerWrite.IP, peerWrite.Port, peerWrite.Complete, testHash, testId)
-	peerRead, ok := db.hashmap[testHash].Peers[testId]
+	db.Save(peerWrite.IP, peerWrite.Port, peerWrite.Complete, testHash, testId, false, storage.Transfer{}, 0)
+	peerRead, ok := db.shard(testHash).hashmap[testHash].get(testId)
 
 	if !ok {
 		t.Error("Failed to read peer from database map")
@@ -42,17 +48,20 @@ func TestSaveDrop(t *testing.T) {
 		t.Errorf("Peer LastSeen not correct %v:%v", peerRead.LastSeen, time.Now().Unix())
 	}
 
-	db.Drop(testHash, testId)
-	_, ok = db.hashmap[testHash].Peers[testId]
-
-	if ok {
-		t.Error("Failed top drop peer from database")
+	db.Drop(testHash, testId, testIP, 0)
+	if peermap, exists := db.peermap(testHash); exists {
+		if _, ok = peermap.get(testId); ok {
+			t.Error("Failed top drop peer from database")
+		}
+	}
+	if db.Hashes() != 0 {
+		t.Error("Dropping the last peer left its swarm")
 	}
 }
 
 func benchmarkSave(b *testing.B, db *Memory, peer storage.Peer, hash storage.Hash, peerid storage.PeerID) {
 	for n := 0; n < b.N; n++ {
-		db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid)
+		db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid, false, storage.Transfer{}, 0)
 	}
 }
 
@@ -76,7 +85,7 @@ func BenchmarkSave(b *testing.B) {
 
 func benchmarkDrop(b *testing.B, db *Memory, hash storage.Hash, peerid storage.PeerID) {
 	for n := 0; n < b.N; n++ {
-		db.Drop(hash, peerid)
+		db.Drop(hash, peerid, testIP, 0)
 	}
 }
 
@@ -94,8 +103,8 @@ func BenchmarkDrop(b *testing.B) {
 
 func benchmarkSaveDrop(b *testing.B, db *Memory, peer storage.Peer, hash storage.Hash, peerid storage.PeerID) {
 	for n := 0; n < b.N; n++ {
-		db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid)
-		db.Drop(hash, peerid)
+		db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid, false, storage.Transfer{}, 0)
+		db.Drop(hash, peerid, peer.IP, 0)
 	}
 }
 
@@ -135,8 +144,8 @@ func benchmarkSaveDropParallel(b *testing.B, routines int) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid)
-			db.Drop(hash, peerid)
+			db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid, false, storage.Transfer{}, 0)
+			db.Drop(hash, peerid, peer.IP, 0)
 		}
 	})
 }
@@ -147,3 +156,305 @@ func BenchmarkSaveDropParallel64(b *testing.B)  { benchmarkSaveDropParallel(b, 6
 func BenchmarkSaveDropParallel128(b *testing.B) { benchmarkSaveDropParallel(b, 128) }
 func BenchmarkSaveDropParallel256(b *testing.B) { benchmarkSaveDropParallel(b, 256) }
 func BenchmarkSaveDropParallel512(b *testing.B) { benchmarkSaveDropParallel(b, 512) }
+
+func benchmarkSaveParallelHashes(b *testing.B, db *Memory) {
+	pools.Initialize(10)
+	db.make()
+
+	peer := storage.Peer{
+		Complete: true,
+		IP:       testIP,
+		Port:     4321,
+	}
+
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var hash storage.Hash
+		var peerid storage.PeerID
+		for pb.Next() {
+			rand.Read(hash[:])
+			db.Save(peer.IP, peer.Port, peer.Complete, hash, peerid, false, storage.Transfer{}, 0)
+		}
+	})
+}
+
+func BenchmarkSaveParallelHashes(b *testing.B) { benchmarkSaveParallelHashes(b, &Memory{}) }
+func BenchmarkSaveParallelHashesSharded(b *testing.B) {
+	config.Config.DB.Shards = defaultShards
+	benchmarkSaveParallelHashes(b, &Memory{sharded: true})
+}
+
+func TestDownloaded(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	var db Memory
+	db.make()
+	testId2 := storage.PeerID{1}
+
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(testIP, 1234, true, testHash, testId, true, storage.Transfer{}, 0)
+	// repeated completed announces count once
+	db.Save(testIP, 1234, true, testHash, testId, true, storage.Transfer{}, 0)
+	db.Save(testIP, 4321, true, testHash, testId2, true, storage.Transfer{}, 0)
+	if _, _, downloaded := db.HashStats(testHash); downloaded != 2 {
+		t.Errorf("downloaded = %v; want 2", downloaded)
+	}
+
+	// the count survives backups
+	var data bytes.Buffer
+	if err := db.encodeBinary(&data); err != nil {
+		t.Fatal("encodeBinary threw error: ", err)
+	}
+	var loaded Memory
+	if _, _, err := loaded.decodeBinary(&data); err != nil {
+		t.Fatal("decodeBinary threw error: ", err)
+	}
+	if _, _, downloaded := loaded.HashStats(testHash); downloaded != 2 {
+		t.Errorf("downloaded after decode = %v; want 2", downloaded)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	var db Memory
+	db.make()
+
+	// the first announce only sets the baseline
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{Uploaded: 100, Downloaded: 1000, Left: 5000}, 0)
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{Uploaded: 300, Downloaded: 4000, Left: 2000}, 0)
+	// a client restart resets its counters
+	db.Save(testIP, 1234, false, testHash, testId, false, storage.Transfer{Uploaded: 50, Downloaded: 500, Left: 1500}, 0)
+
+	peermap, _ := db.peermap(testHash)
+	if peermap.UploadedBytes != 250 || peermap.DownloadedBytes != 3500 {
+		t.Errorf("swarm transferred = %v, %v; want 250, 3500", peermap.UploadedBytes, peermap.DownloadedBytes)
+	}
+	peer, _ := peermap.get(testId)
+	if peer.Uploaded != 50 || peer.Downloaded != 500 || peer.Left != 1500 || peer.Announces != 3 || peer.FirstSeen == 0 {
+		t.Errorf("peer = %+v; want 50 uploaded, 500 downloaded, 1500 left over 3 announces", peer)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	pools.Initialize(10)
+	var db Memory
+	db.make()
+
+	ip, other := netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("4.3.2.1")
+
+	// without a key the peer id is owned by its ip
+	if err := db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0); err != nil {
+		t.Fatal("Save() of a new peer was rejected:", err)
+	}
+	if err := db.Save(other, 1234, false, testHash, testId, false, storage.Transfer{}, 0); err != storage.ErrPeerOwned {
+		t.Errorf("Save() from another ip without a key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Drop(testHash, testId, other, 0); err != storage.ErrPeerOwned {
+		t.Errorf("Drop() from another ip without a key = %v; want storage.ErrPeerOwned", err)
+	}
+
+	// a key sent from the owning ip is stored, after that the key owns the peer id from any ip
+	if err := db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Error("Save() with a key from the owning ip was rejected:", err)
+	}
+	if err := db.Save(other, 1234, false, testHash, testId, false, storage.Transfer{}, 0x1234); err != storage.ErrPeerOwned {
+		t.Errorf("Save() with the wrong key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Save(other, 1234, true, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Error("Save() with the key from another ip was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() = %v, %v; want 1, 0", complete, incomplete)
+	}
+
+	if err := db.Drop(testHash, testId, other, 0x1234); err != storage.ErrPeerOwned {
+		t.Errorf("Drop() with the wrong key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Drop(testHash, testId, ip, 0xabcd); err != nil {
+		t.Error("Drop() with the key was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after drop = %v, %v; want 0, 0", complete, incomplete)
+	}
+}
+
+func TestPeerLimit(t *testing.T) {
+	pools.Initialize(10)
+	config.Config.DB.Limits.Peers = 3
+	defer func() { config.Config.DB.Limits.Peers = 0 }()
+
+	var db Memory
+	db.make()
+
+	// peer i was last seen i seconds ago
+	now := time.Now().Unix()
+	for i := byte(0); i < 3; i++ {
+		db.Save(testIP, 1000+uint16(i), i == 0, testHash, storage.PeerID{i}, false, storage.Transfer{}, 0)
+		peermap := db.shard(testHash).hashmap[testHash]
+		peer, _ := peermap.get(storage.PeerID{i})
+		peer.LastSeen = now - int64(i)
+		peermap.update(peermap.ids[storage.PeerID{i}], &peer)
+	}
+
+	evictions := stats.Evictions.Load()
+	db.Save(testIP, 2000, false, testHash, storage.PeerID{3}, false, storage.Transfer{}, 0)
+	peermap := db.shard(testHash).hashmap[testHash]
+	if _, ok := peermap.get(storage.PeerID{2}); ok || peermap.len() != 3 {
+		t.Errorf("swarm after a new peer = %v peers with the oldest %v; want 3 without the oldest", peermap.len(), ok)
+	}
+	if peermap.Complete != 1 || peermap.Incomplete != 2 {
+		t.Errorf("counts = %v, %v; want 1, 2", peermap.Complete, peermap.Incomplete)
+	}
+	if evicted := stats.Evictions.Load() - evictions; evicted != 1 {
+		t.Errorf("evictions = %v; want 1", evicted)
+	}
+	checkSwarm(t, peermap)
+
+	// announces of existing peers don't evict
+	db.Save(testIP, 1000, true, testHash, storage.PeerID{0}, false, storage.Transfer{}, 0)
+	if peermap.len() != 3 || stats.Evictions.Load()-evictions != 1 {
+		t.Errorf("existing peer announce evicted a peer")
+	}
+}
+
+func TestAddressLimit(t *testing.T) {
+	pools.Initialize(10)
+	config.Config.DB.Limits.Address.Swarm = 2
+	config.Config.DB.Limits.Address.Global = 3
+	config.Config.DB.Limits.Prefix = 64
+	defer func() {
+		config.Config.DB.Limits.Address.Swarm = 0
+		config.Config.DB.Limits.Address.Global = 0
+	}()
+
+	var db Memory
+	db.make()
+
+	otherHash := storage.Hash{1}
+	cases := []struct {
+		name string
+		ip   string
+		hash storage.Hash
+		id   byte
+		key  uint32
+		want error
+	}{
+		{"first", "1.2.3.4", testHash, 0, 0, nil},
+		{"second", "1.2.3.4", testHash, 1, 0, nil},
+		{"swarm full", "1.2.3.4", testHash, 2, 0, storage.ErrAddressLimit},
+		{"other address", "1.2.3.5", testHash, 2, 0xabcd, nil},
+		{"other swarm", "1.2.3.4", otherHash, 3, 0, nil},
+		{"global full", "1.2.3.4", otherHash, 4, 0, storage.ErrAddressLimit},
+		{"existing peer", "1.2.3.4", testHash, 0, 0, nil},
+		{"ipv6 prefix", "2001:db8::1", testHash, 5, 0, nil},
+		{"ipv6 same prefix", "2001:db8::ffff:1", testHash, 6, 0, nil},
+		{"ipv6 prefix full", "2001:db8::2", testHash, 7, 0, storage.ErrAddressLimit},
+		{"ipv6 other prefix", "2001:db8:0:1::1", testHash, 7, 0, nil},
+		{"move to full address", "2001:db8::1", testHash, 2, 0xabcd, storage.ErrAddressLimit},
+	}
+	for _, c := range cases {
+		err := db.Save(netip.MustParseAddr(c.ip), 1234, false, c.hash, storage.PeerID{c.id}, false, storage.Transfer{}, c.key)
+		if err != c.want {
+			t.Errorf("%v: Save() = %v; want %v", c.name, err, c.want)
+		}
+	}
+
+	// a rejected peer isn't stored and a rejected move keeps the peer where it was
+	peermap := db.shard(testHash).hashmap[testHash]
+	if peermap.len() != 6 || peermap.Incomplete != 6 {
+		t.Errorf("swarm = %v peers, %v incomplete; want 6, 6", peermap.len(), peermap.Incomplete)
+	}
+	if peer, _ := peermap.get(storage.PeerID{2}); peer.IP != netip.MustParseAddr("1.2.3.5") {
+		t.Errorf("ip of the rejected move = %v; want 1.2.3.5", peer.IP)
+	}
+
+	// dropping a peer frees its slot
+	db.Drop(testHash, storage.PeerID{1}, netip.MustParseAddr("1.2.3.4"), 0)
+	if err := db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, otherHash, storage.PeerID{4}, false, storage.Transfer{}, 0); err != nil {
+		t.Error("Save() after a drop =", err)
+	}
+	if count := db.addresses.peers(netip.MustParseAddr("1.2.3.4").As16()); count != 3 {
+		t.Errorf("global peers of 1.2.3.4 = %v; want 3", count)
+	}
+
+	// loading a backup counts its peers
+	config.Config.DB.Expiry = time.Hour
+	var buf bytes.Buffer
+	if err := db.encodeBinary(&buf); err != nil {
+		t.Fatal("encodeBinary() failed:", err)
+	}
+	var loaded Memory
+	if _, _, err := loaded.decodeBinary(&buf); err != nil {
+		t.Fatal("decodeBinary() failed:", err)
+	}
+	if counts, want := addressCounts(loaded.addresses), addressCounts(db.addresses); !reflect.DeepEqual(counts, want) {
+		t.Errorf("loaded address index = %v; want %v", counts, want)
+	}
+
+	// expired peers are uncounted
+	config.Config.DB.Expiry = -1 * time.Second
+	db.trim()
+	if counts := addressCounts(db.addresses); len(counts) != 0 {
+		t.Errorf("address index after trim = %v; want empty", counts)
+	}
+}
+
+// addressCounts returns the peers of every address in the index.
+func addressCounts(index *addressIndex) map[[16]byte]uint32 {
+	counts := make(map[[16]byte]uint32)
+	for i := range index.shards {
+		for address, count := range index.shards[i].peers {
+			counts[address] = count
+		}
+	}
+	return counts
+}
+
+func TestAddressLimitSharded(t *testing.T) {
+	pools.Initialize(10)
+	config.Config.DB.Limits.Address.Global = 3
+	config.Config.DB.Shards = 8
+	defer func() {
+		config.Config.DB.Limits.Address.Global = 0
+		config.Config.DB.Shards = 0
+	}()
+
+	db := Memory{sharded: true}
+	db.make()
+	if len(db.addresses.shards) != len(db.shards) {
+		t.Fatalf("address index shards = %v; want %v", len(db.addresses.shards), len(db.shards))
+	}
+
+	// the global limit holds for swarms in different shards
+	for a := byte(0); a < 16; a++ {
+		ip := netip.AddrFrom4([4]byte{10, 0, 0, a})
+		for i := byte(0); i < 5; i++ {
+			err := db.Save(ip, 1234, false, storage.Hash{i}, storage.PeerID{a, i}, false, storage.Transfer{}, 0)
+			want := error(nil)
+			if i >= 3 {
+				want = storage.ErrAddressLimit
+			}
+			if err != want {
+				t.Errorf("Save() of peer %v of %v = %v; want %v", i, ip, err, want)
+			}
+		}
+		if count := db.addresses.peers(ip.As16()); count != 3 {
+			t.Errorf("global peers of %v = %v; want 3", ip, count)
+		}
+	}
+
+	// the addresses are spread over the shards
+	used := 0
+	for i := range db.addresses.shards {
+		if len(db.addresses.shards[i].peers) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("addresses are in %v shards; want them spread out", used)
+	}
+}
@@ -13,6 +13,33 @@ func init() {
 				Name: "file",
 				Back: &FileBackup{},
 			},
+			{
+				Name: "journal",
+				Back: &JournalBackup{},
+			},
+			{
+				Name: "pg",
+				Back: &PgBackup{},
+			},
+			{
+				Name: "none",
+				Back: &NoneBackup{},
+			},
+		},
+	})
+
+	storage.Register(storage.DatabaseInfo{
+		Name: "gomap-sharded",
+		DB:   &Memory{sharded: true},
+		Backups: []storage.BackupInfo{
+			{
+				Name: "file",
+				Back: &FileBackup{},
+			},
+			{
+				Name: "journal",
+				Back: &JournalBackup{},
+			},
 			{
 				Name: "pg",
 				Back: &PgBackup{},
@@ -0,0 +1,78 @@
+package gomap
+
+import (
+	"math/bits"
+	"math/rand"
+)
+
+// sampler draws the random numbers for reservoir sampling a peer list without contending on the global rand lock.
+type sampler struct {
+	state uint64
+}
+
+func newSampler() sampler {
+	return sampler{state: rand.Uint64()}
+}
+
+// next returns the next value of the generator (wyrand).
+func (s *sampler) next() uint64 {
+	s.state += 0xa0761d6478bd642f
+	hi, lo := bits.Mul64(s.state, s.state^0xe7037ed1a0b428db)
+	return hi ^ lo
+}
+
+// intn returns a number in [0, n).
+func (s *sampler) intn(n uint) uint {
+	hi, _ := bits.Mul64(s.next(), uint64(n))
+	return uint(hi)
+}
+
+// split divides n between two groups of a and b as drawing n of the a+b without replacement would, n must not exceed a+b.
+func (s *sampler) split(n, a, b uint) (fromA, fromB uint) {
+	for ; n > 0; n-- {
+		if s.intn(a+b) < a {
+			a--
+			fromA++
+		} else {
+			b--
+			fromB++
+		}
+	}
+	return
+}
+
+// sample visits entries of the list in a uniformly random order until take accepted n of them or every entry was visited, take returns false for the entries it leaves out.
+// The positions are drawn one at a time with a partial Fisher–Yates shuffle so every set of n entries is as likely, peers that are next to each other in the list aren't returned together.
+func (l *compactList) sample(rng *sampler, n uint, take func(pos uint) bool) {
+	count := l.len()
+	if n == 0 || count == 0 {
+		return
+	}
+
+	// every entry is taken so the order doesn't matter
+	if n >= count {
+		for pos := uint(0); pos < count && n > 0; pos++ {
+			if take(pos) {
+				n--
+			}
+		}
+		return
+	}
+
+	// only the shuffled positions that moved are stored
+	moved := make(map[uint]uint, n+1)
+	at := func(i uint) uint {
+		if pos, ok := moved[i]; ok {
+			return pos
+		}
+		return i
+	}
+	for i := uint(0); n > 0 && i < count; i++ {
+		j := i + rng.intn(count-i)
+		pos := at(j)
+		moved[j] = at(i)
+		if take(pos) {
+			n--
+		}
+	}
+}
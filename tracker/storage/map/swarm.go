@@ -0,0 +1,277 @@
+package gomap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sort"
+
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+// compact lists of a swarm, peers are split by family and role
+const (
+	seeds4 = iota
+	leeches4
+	seeds6
+	leeches6
+)
+
+// noSlot ends the list of slots ordered by last seen time
+const noSlot = ^uint32(0)
+
+// slot is a peer stored by value, it holds no pointers so swarms of any size add nothing for the collector to scan.
+type slot struct {
+	id        storage.PeerID
+	ip        [16]byte // ipv4 addresses use the first 4 bytes
+	v6        bool
+	complete  bool
+	port      uint16
+	key       uint32
+	announces uint32
+	entry     uint32 // position of the peer in its compact list
+	lastSeen  int64
+	firstSeen int64
+	scheduled int64  // last seen time of the peer's entry in the expiry wheel
+	older     uint32 // neighbours in the order the peers were last seen, noSlot at the ends
+	newer     uint32
+
+	uploaded   uint64
+	downloaded uint64
+	left       uint64
+}
+
+func (s *slot) addr() netip.Addr {
+	if s.v6 {
+		return netip.AddrFrom16(s.ip)
+	}
+	return netip.AddrFrom4([4]byte{s.ip[0], s.ip[1], s.ip[2], s.ip[3]})
+}
+
+// peer returns the peer stored in the slot.
+func (s *slot) peer() storage.Peer {
+	return storage.Peer{
+		Complete:   s.complete,
+		IP:         s.addr(),
+		Port:       s.port,
+		LastSeen:   s.lastSeen,
+		FirstSeen:  s.firstSeen,
+		Announces:  s.announces,
+		Uploaded:   s.uploaded,
+		Downloaded: s.downloaded,
+		Left:       s.left,
+		Key:        s.key,
+	}
+}
+
+// set stores the peer in the slot, the id, entry and schedule are left as they are.
+func (s *slot) set(peer *storage.Peer) {
+	s.v6 = !peer.IP.Is4()
+	s.ip = peer.IP.As16()
+	if !s.v6 {
+		copy(s.ip[:4], s.ip[12:])
+	}
+	s.complete = peer.Complete
+	s.port = peer.Port
+	s.key = peer.Key
+	s.announces = peer.Announces
+	s.lastSeen = peer.LastSeen
+	s.firstSeen = peer.FirstSeen
+	s.uploaded = peer.Uploaded
+	s.downloaded = peer.Downloaded
+	s.left = peer.Left
+}
+
+// list returns the compact list the peer belongs in.
+func (s *slot) list() int {
+	list := leeches4
+	if s.complete {
+		list = seeds4
+	}
+	if s.v6 {
+		list += seeds6
+	}
+	return list
+}
+
+// writeEntry encodes the compact ip and port of the peer into entry.
+func (s *slot) writeEntry(entry []byte) {
+	size := copy(entry, s.ip[:4])
+	if s.v6 {
+		size = copy(entry, s.ip[:])
+	}
+	binary.BigEndian.PutUint16(entry[size:], s.port)
+}
+
+// entrySize returns the size of the compact entries of the list.
+func entrySize(list int) int {
+	if list >= seeds6 {
+		return 18
+	}
+	return 6
+}
+
+// compactList holds the compact ip and port of peers back to back so peer lists are copied out of it rather than encoded.
+type compactList struct {
+	entries []byte
+	slots   []uint32 // slot of every entry
+}
+
+func (l *compactList) len() uint {
+	return uint(len(l.slots))
+}
+
+// insert stores the peer in a new slot and returns its index, the peermap must be locked and the id must not exist.
+func (peermap *PeerMap) insert(id storage.PeerID, peer *storage.Peer) (index uint32) {
+	index = uint32(len(peermap.slots))
+	peermap.slots = append(peermap.slots, slot{id: id})
+	peermap.slots[index].set(peer)
+	peermap.ids[id] = index
+	peermap.link(index)
+	peermap.linkSeen(index)
+	if uint32(len(peermap.slots)) > peermap.peak {
+		peermap.peak = uint32(len(peermap.slots))
+	}
+	return
+}
+
+// update stores the peer in an existing slot, moving its compact entry if its family or role changed.
+func (peermap *PeerMap) update(index uint32, peer *storage.Peer) {
+	s := &peermap.slots[index]
+	list := s.list()
+	seen := s.lastSeen != peer.LastSeen
+	if seen {
+		peermap.unlinkSeen(index)
+	}
+	s.set(peer)
+	if seen {
+		peermap.linkSeen(index)
+	}
+
+	if s.list() != list {
+		peermap.unlink(index, list)
+		peermap.link(index)
+		return
+	}
+	size := entrySize(list)
+	pos := int(s.entry) * size
+	s.writeEntry(peermap.lists[list].entries[pos : pos+size])
+}
+
+// remove deletes the peer in the slot, the last slot is moved into its place.
+func (peermap *PeerMap) remove(index uint32) {
+	s := &peermap.slots[index]
+	peermap.unlink(index, s.list())
+	peermap.unlinkSeen(index)
+	delete(peermap.ids, s.id)
+
+	last := uint32(len(peermap.slots) - 1)
+	if index != last {
+		*s = peermap.slots[last]
+		peermap.ids[s.id] = index
+		peermap.lists[s.list()].slots[s.entry] = index
+		if s.older == noSlot {
+			peermap.oldest = index
+		} else {
+			peermap.slots[s.older].newer = index
+		}
+		if s.newer == noSlot {
+			peermap.newest = index
+		} else {
+			peermap.slots[s.newer].older = index
+		}
+	}
+	peermap.slots = peermap.slots[:last]
+}
+
+// link appends the compact entry of the slot to its list.
+func (peermap *PeerMap) link(index uint32) {
+	s := &peermap.slots[index]
+	l := &peermap.lists[s.list()]
+	size := entrySize(s.list())
+
+	s.entry = uint32(l.len())
+	l.slots = append(l.slots, index)
+	pos := len(l.entries)
+	l.entries = append(l.entries, make([]byte, size)...)
+	s.writeEntry(l.entries[pos:])
+}
+
+// unlink removes the compact entry of the slot from list, the last entry is moved into its place.
+func (peermap *PeerMap) unlink(index uint32, list int) {
+	l := &peermap.lists[list]
+	size := entrySize(list)
+	entry := peermap.slots[index].entry
+
+	last := uint32(l.len() - 1)
+	if entry != last {
+		copy(l.entries[int(entry)*size:], l.entries[int(last)*size:int(last+1)*size])
+		moved := l.slots[last]
+		l.slots[entry] = moved
+		peermap.slots[moved].entry = entry
+	}
+	l.slots = l.slots[:last]
+	l.entries = l.entries[:int(last)*size]
+}
+
+// linkSeen appends the slot as the most recently seen peer.
+// Announces are seen in order, a peer loaded or restored with an earlier time marks the list unordered until it's sorted by orderSeen.
+func (peermap *PeerMap) linkSeen(index uint32) {
+	s := &peermap.slots[index]
+	s.older, s.newer = peermap.newest, noSlot
+	if peermap.newest == noSlot {
+		peermap.oldest = index
+	} else {
+		newest := &peermap.slots[peermap.newest]
+		if s.lastSeen < newest.lastSeen {
+			peermap.unordered = true
+		}
+		newest.newer = index
+	}
+	peermap.newest = index
+}
+
+// unlinkSeen removes the slot from the list ordered by last seen time.
+func (peermap *PeerMap) unlinkSeen(index uint32) {
+	s := &peermap.slots[index]
+	if s.older == noSlot {
+		peermap.oldest = s.newer
+	} else {
+		peermap.slots[s.older].newer = s.newer
+	}
+	if s.newer == noSlot {
+		peermap.newest = s.older
+	} else {
+		peermap.slots[s.newer].older = s.older
+	}
+}
+
+// orderSeen rebuilds the list of slots sorted by last seen time.
+func (peermap *PeerMap) orderSeen() {
+	order := make([]uint32, len(peermap.slots))
+	for index := range order {
+		order[index] = uint32(index)
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return peermap.slots[order[a]].lastSeen < peermap.slots[order[b]].lastSeen
+	})
+
+	peermap.oldest, peermap.newest = noSlot, noSlot
+	peermap.unordered = false
+	for _, index := range order {
+		peermap.linkSeen(index)
+	}
+}
+
+// get returns the peer with the id, the peermap must be locked.
+func (peermap *PeerMap) get(id storage.PeerID) (peer storage.Peer, ok bool) {
+	index, ok := peermap.ids[id]
+	if ok {
+		peer = peermap.slots[index].peer()
+	}
+	return
+}
+
+// len returns the number of peers, the peermap must be locked.
+func (peermap *PeerMap) len() int {
+	return len(peermap.slots)
+}
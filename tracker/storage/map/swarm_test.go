@@ -0,0 +1,129 @@
+package gomap
+
+import (
+	"bytes"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+// checkSwarm fails if the slots, ids and compact lists of the peermap disagree.
+func checkSwarm(t *testing.T, peermap *PeerMap) {
+	t.Helper()
+
+	if len(peermap.ids) != len(peermap.slots) {
+		t.Fatalf("%v ids for %v slots", len(peermap.ids), len(peermap.slots))
+	}
+	var complete, linked int
+	for index := range peermap.slots {
+		s := &peermap.slots[index]
+		if peermap.ids[s.id] != uint32(index) {
+			t.Fatalf("id of slot %v points at slot %v", index, peermap.ids[s.id])
+		}
+		if s.complete {
+			complete++
+		}
+	}
+	for list := range peermap.lists {
+		compact := &peermap.lists[list]
+		size := entrySize(list)
+		if len(compact.entries) != int(compact.len())*size {
+			t.Fatalf("list %v has %v bytes for %v entries", list, len(compact.entries), compact.len())
+		}
+		entry := make([]byte, size)
+		for pos, index := range compact.slots {
+			s := &peermap.slots[index]
+			if s.list() != list || s.entry != uint32(pos) {
+				t.Fatalf("entry %v of list %v points at slot %v in list %v entry %v", pos, list, index, s.list(), s.entry)
+			}
+			s.writeEntry(entry)
+			if !bytes.Equal(entry, compact.entries[pos*size:(pos+1)*size]) {
+				t.Fatalf("entry %v of list %v = %v; want %v", pos, list, compact.entries[pos*size:(pos+1)*size], entry)
+			}
+			linked++
+		}
+	}
+	if linked != len(peermap.slots) {
+		t.Fatalf("%v compact entries for %v slots", linked, len(peermap.slots))
+	}
+	seen, previous := 0, noSlot
+	for index := peermap.oldest; index != noSlot; index = peermap.slots[index].newer {
+		if peermap.slots[index].older != previous {
+			t.Fatalf("slot %v is newer than %v; want %v", index, peermap.slots[index].older, previous)
+		}
+		if !peermap.unordered && previous != noSlot && peermap.slots[previous].lastSeen > peermap.slots[index].lastSeen {
+			t.Fatalf("slot %v was seen before the older slot %v", index, previous)
+		}
+		previous = index
+		if seen++; seen > len(peermap.slots) {
+			t.Fatal("slots ordered by last seen time loop")
+		}
+	}
+	if seen != len(peermap.slots) || peermap.newest != previous {
+		t.Fatalf("%v slots ordered by last seen time ending at %v; want %v ending at %v", seen, previous, len(peermap.slots), peermap.newest)
+	}
+	if complete != int(peermap.Complete) || len(peermap.slots)-complete != int(peermap.Incomplete) {
+		t.Fatalf("counts = %v, %v; want %v, %v", peermap.Complete, peermap.Incomplete, complete, len(peermap.slots)-complete)
+	}
+}
+
+func TestSwarmConsistency(t *testing.T) {
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	var db Memory
+	db.make()
+
+	ips := []netip.Addr{netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("4.3.2.1"), netip.MustParseAddr("::1"), netip.MustParseAddr("2001:db8::1")}
+	for i := 0; i < 20_000; i++ {
+		id := storage.PeerID{byte(rand.Intn(200))}
+		ip := ips[rand.Intn(len(ips))]
+		if rand.Intn(4) == 0 {
+			db.Drop(testHash, id, ip, 1)
+		} else {
+			// peers keep their key so they can move between families and roles
+			db.Save(ip, uint16(rand.Intn(4)), rand.Intn(2) == 0, testHash, id, false, storage.Transfer{}, 1)
+		}
+	}
+
+	peermap, ok := db.peermap(testHash)
+	if !ok {
+		t.Fatal("swarm missing")
+	}
+	checkSwarm(t, peermap)
+
+	config.Config.DB.Expiry = -1 * time.Second
+	db.trim()
+	if peermap.len() != 0 {
+		t.Errorf("swarm after trim = %v peers; want 0", peermap.len())
+	}
+	checkSwarm(t, peermap)
+}
+
+func TestSlotPeer(t *testing.T) {
+	for _, ip := range []string{"1.2.3.4", "::1", "::ffff:1.2.3.4"} {
+		peer := storage.Peer{
+			Complete:   true,
+			IP:         netip.MustParseAddr(ip),
+			Port:       1234,
+			LastSeen:   1,
+			FirstSeen:  2,
+			Announces:  3,
+			Uploaded:   4,
+			Downloaded: 5,
+			Left:       6,
+			Key:        7,
+		}
+
+		var s slot
+		s.set(&peer)
+		if stored := s.peer(); stored != peer {
+			t.Errorf("peer() = %+v; want %+v", stored, peer)
+		}
+	}
+}
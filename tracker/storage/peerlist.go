@@ -0,0 +1,32 @@
+package storage
+
+import "github.com/crimist/trakx/config"
+
+// PeerMix returns how many seeds and leeches to give a peer wanting numWant peers from a swarm with the given number of seeds and leeches.
+// Seeds only get leeches. Leeches get `numwant.seedratio` seeds and leeches for the rest, topped up from the other role if one runs short.
+func PeerMix(numWant, seeds, leeches uint, complete bool) (wantSeeds, wantLeeches uint) {
+	if complete {
+		if leeches > numWant {
+			leeches = numWant
+		}
+		return 0, leeches
+	}
+
+	wantSeeds = uint(float64(numWant)*config.Config.Numwant.SeedRatio + 0.5)
+	if wantSeeds > numWant {
+		wantSeeds = numWant
+	}
+	if wantSeeds > seeds {
+		wantSeeds = seeds
+	}
+	wantLeeches = numWant - wantSeeds
+	if wantLeeches > leeches {
+		wantLeeches = leeches
+	}
+	wantSeeds = numWant - wantLeeches
+	if wantSeeds > seeds {
+		wantSeeds = seeds
+	}
+
+	return
+}
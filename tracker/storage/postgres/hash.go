@@ -0,0 +1,177 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"net/netip"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/storage"
+	"go.uber.org/zap"
+)
+
+// clampUint32 saturates n so large counts don't wrap around.
+func clampUint32(n int64) uint32 {
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// HashStats returns number of complete and incomplete peers associated with the hash and its completed downloads
+func (db *Postgres) HashStats(hash storage.Hash) (complete, incomplete, downloaded uint32) {
+	var seeds, leeches, snatches int64
+
+	err := db.pg.QueryRow(`SELECT
+		(SELECT count(*) FROM peers WHERE hash = $1 AND complete),
+		(SELECT count(*) FROM peers WHERE hash = $1 AND NOT complete),
+		coalesce((SELECT downloaded FROM torrents WHERE hash = $1), 0)`, hash[:]).Scan(&seeds, &leeches, &snatches)
+	if err != nil {
+		config.Logger.Error("Failed to get hash stats from postgres", zap.Error(err))
+		return
+	}
+
+	return clampUint32(seeds), clampUint32(leeches), clampUint32(snatches)
+}
+
+// peerListQuery samples up to $2 random seeds and leeches each other than the requester ($4 peer id, $5 ip and $6 port), leaving out seeds if $3 (the requester is a seed) is set.
+// Seeds and leeches are sampled per address family if $7 is set.
+// Each sample is the peers following $8, a random number, in the peers_sample index wrapping around to the start so swarms aren't sorted.
+const peerListQuery = `
+WITH swarm AS NOT MATERIALIZED (
+	SELECT peer_id, ip, port, complete, sample FROM peers
+	WHERE hash = $1 AND NOT (complete AND $3) AND peer_id <> $4 AND NOT (ip = $5::inet AND port = $6)
+)
+SELECT sampled.peer_id, host(sampled.ip), sampled.port, roles.complete
+FROM (VALUES (true), (false)) AS roles (complete)
+CROSS JOIN unnest(CASE WHEN $7 THEN ARRAY[4, 6] ELSE ARRAY[0] END) AS families (af)
+CROSS JOIN LATERAL (
+	SELECT peer_id, ip, port FROM (
+		(SELECT peer_id, ip, port, sample, 0 AS lap FROM swarm
+		WHERE complete = roles.complete AND (families.af = 0 OR family(ip) = families.af) AND sample >= $8
+		ORDER BY sample LIMIT $2)
+		UNION ALL
+		(SELECT peer_id, ip, port, sample, 1 AS lap FROM swarm
+		WHERE complete = roles.complete AND (families.af = 0 OR family(ip) = families.af) AND sample < $8
+		ORDER BY sample LIMIT $2)
+	) wrapped ORDER BY lap, sample LIMIT $2
+) sampled
+`
+
+type listedPeer struct {
+	id   []byte
+	ip   netip.Addr
+	port uint16
+}
+
+// eachPeer calls fn on up to numWant random peers of the swarm other than the requester mixed by its role (see storage.PeerMix).
+// If byFamily is set the ipv4 and ipv6 peers are sampled and mixed separately so fn is called on up to numWant of each.
+func (db *Postgres) eachPeer(hash storage.Hash, numWant uint, requester storage.Requester, byFamily bool, fn func(id []byte, ip netip.Addr, port uint16)) {
+	if numWant == 0 {
+		return
+	}
+
+	rows, err := db.pg.Query(peerListQuery, hash[:], numWant, requester.Complete, requester.ID[:], requester.Addr.Addr().Unmap().String(), requester.Addr.Port(), byFamily, rand.Float64())
+	if err != nil {
+		config.Logger.Error("Failed to get peer list from postgres", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	// seeds and leeches of every family, ipv6 peers go in the second if byFamily is set
+	var seeds, leeches [2][]listedPeer
+	for rows.Next() {
+		var peer listedPeer
+		var host string
+		var seed bool
+		if err := rows.Scan(&peer.id, &host, &peer.port, &seed); err != nil {
+			config.Logger.Error("Failed to scan peer from postgres", zap.Error(err))
+			return
+		}
+
+		if peer.ip, err = netip.ParseAddr(host); err != nil {
+			continue
+		}
+		family := 0
+		if byFamily && peer.ip.Is6() {
+			family = 1
+		}
+		if seed {
+			seeds[family] = append(seeds[family], peer)
+		} else {
+			leeches[family] = append(leeches[family], peer)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		config.Logger.Error("Failed to get peer list from postgres", zap.Error(err))
+		return
+	}
+
+	for family := range seeds {
+		wantSeeds, wantLeeches := storage.PeerMix(numWant, uint(len(seeds[family])), uint(len(leeches[family])), requester.Complete)
+		for _, peer := range append(seeds[family][:wantSeeds], leeches[family][:wantLeeches]...) {
+			fn(peer.id, peer.ip, peer.port)
+		}
+	}
+}
+
+// PeerList returns a peer list for the given hash capped at max
+func (db *Postgres) PeerList(hash storage.Hash, numWant uint, requester storage.Requester, removePeerId bool) (peers [][]byte) {
+	dictionary := pools.Dictionaries.Get()
+
+	db.eachPeer(hash, numWant, requester, false, func(id []byte, ip netip.Addr, port uint16) {
+		if !removePeerId {
+			dictionary.String("peer id", string(id))
+		}
+		dictionary.String("ip", ip.String())
+		dictionary.Int64("port", int64(port))
+
+		dictBytes := dictionary.GetBytes()
+		peer := make([]byte, len(dictBytes))
+		copy(peer, dictBytes)
+		peers = append(peers, peer)
+
+		dictionary.Reset()
+	})
+
+	pools.Dictionaries.Put(dictionary)
+
+	return
+}
+
+// PeerListBytes returns byte encoded random samples of up to numWant ipv4 and up to numWant ipv6 peers for the given hash other than the requester, mixed by its role (see storage.PeerMix)
+func (db *Postgres) PeerListBytes(hash storage.Hash, numWant uint, requester storage.Requester) (peers4 []byte, peers6 []byte) {
+	peers4 = pools.Peerlists4.Get()
+	peers6 = pools.Peerlists6.Get()
+
+	var pos4, pos6 int
+	db.eachPeer(hash, numWant, requester, true, func(id []byte, ip netip.Addr, port uint16) {
+		if ip.Is6() {
+			if pos6+18 > cap(peers6) {
+				return
+			}
+			copy(peers6[pos6:pos6+16], ip.AsSlice())
+			binary.BigEndian.PutUint16(peers6[pos6+16:pos6+18], port)
+			pos6 += 18
+		} else {
+			if pos4+6 > cap(peers4) {
+				return
+			}
+			copy(peers4[pos4:pos4+4], ip.AsSlice())
+			binary.BigEndian.PutUint16(peers4[pos4+4:pos4+6], port)
+			pos4 += 6
+		}
+	})
+
+	peers4 = peers4[:pos4]
+	peers6 = peers6[:pos6]
+
+	return
+}
+
+// Announce saves the peer and answers it through separate calls (see storage.AnnounceSeparately)
+func (db *Postgres) Announce(announce *storage.Announce) (storage.AnnounceResponse, error) {
+	return storage.AnnounceSeparately(db, announce)
+}
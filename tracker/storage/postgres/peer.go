@@ -0,0 +1,179 @@
+package postgres
+
+import (
+	"database/sql"
+	"math"
+	"net/netip"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// saveQuery upserts the torrent and peer, returning the previous completion of the peer (NULL if it's new), whether the torrent is new and the bytes transferred since the last announce of the peer.
+// Completed downloads are counted once per peer, when it completes and wasn't already a seed.
+// Transferred bytes follow storage.Peer.Account: a new peer sets the baseline and lower counters restart from zero.
+// Peers owned by another client (see storage.Peer.Owns) are left as is and no row is returned.
+const saveQuery = `
+WITH old AS (
+	SELECT complete, uploaded, downloaded, CASE WHEN $10 <> 0 AND announce_key <> 0 THEN announce_key = $10 ELSE ip = $3::inet END AS owned
+	FROM peers WHERE hash = $1 AND peer_id = $2
+), delta AS (
+	SELECT
+		CASE WHEN $7 >= old.uploaded THEN $7 - old.uploaded ELSE $7 END AS uploaded,
+		CASE WHEN $8 >= old.downloaded THEN $8 - old.downloaded ELSE $8 END AS downloaded
+	FROM old
+), torrent AS (
+	INSERT INTO torrents AS t (hash, downloaded, uploaded_bytes, downloaded_bytes)
+	SELECT
+		$1,
+		CASE WHEN $6 AND (SELECT complete FROM old) IS NOT TRUE THEN 1 ELSE 0 END,
+		COALESCE((SELECT uploaded FROM delta), 0),
+		COALESCE((SELECT downloaded FROM delta), 0)
+	WHERE (SELECT owned FROM old) IS NOT FALSE
+	ON CONFLICT (hash) DO UPDATE SET
+		downloaded = t.downloaded + EXCLUDED.downloaded,
+		uploaded_bytes = t.uploaded_bytes + EXCLUDED.uploaded_bytes,
+		downloaded_bytes = t.downloaded_bytes + EXCLUDED.downloaded_bytes
+	WHERE EXCLUDED.downloaded > 0 OR EXCLUDED.uploaded_bytes > 0 OR EXCLUDED.downloaded_bytes > 0
+	RETURNING xmax = 0 AS inserted
+)
+INSERT INTO peers (hash, peer_id, ip, port, complete, last_seen, uploaded, downloaded, remaining, announce_key) VALUES ($1, $2, $3, $4, $5, now(), $7, $8, $9, $10)
+ON CONFLICT (hash, peer_id) DO UPDATE SET
+	ip = EXCLUDED.ip, port = EXCLUDED.port, complete = EXCLUDED.complete, last_seen = EXCLUDED.last_seen, sample = EXCLUDED.sample,
+	uploaded = EXCLUDED.uploaded, downloaded = EXCLUDED.downloaded, remaining = EXCLUDED.remaining, announces = peers.announces + 1,
+	announce_key = CASE WHEN EXCLUDED.announce_key <> 0 THEN EXCLUDED.announce_key ELSE peers.announce_key END
+WHERE CASE WHEN EXCLUDED.announce_key <> 0 AND peers.announce_key <> 0 THEN peers.announce_key = EXCLUDED.announce_key ELSE peers.ip = EXCLUDED.ip END
+RETURNING (SELECT complete FROM old), EXISTS (SELECT 1 FROM torrent WHERE inserted), COALESCE((SELECT uploaded FROM delta), 0), COALESCE((SELECT downloaded FROM delta), 0)
+`
+
+// saveAttempts is the number of times a save is run when a trim deletes its torrent before the peer is inserted.
+const saveAttempts = 3
+
+// torrentDeleted returns true if err is the foreign key violation of a peer inserted after a trim deleted its torrent.
+func torrentDeleted(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// bigint clamps a counter to the range of a postgres BIGINT.
+func bigint(counter uint64) int64 {
+	if counter > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(counter)
+}
+
+// dropQuery deletes the peer if it's owned by the client (see storage.Peer.Owns), returning whether it's owned (NULL if it doesn't exist) and its completion if it was deleted.
+const dropQuery = `
+WITH old AS (
+	SELECT CASE WHEN $4 <> 0 AND announce_key <> 0 THEN announce_key = $4 ELSE ip = $3::inet END AS owned
+	FROM peers WHERE hash = $1 AND peer_id = $2
+), deleted AS (
+	DELETE FROM peers WHERE hash = $1 AND peer_id = $2 AND (SELECT owned FROM old) RETURNING complete
+)
+SELECT (SELECT owned FROM old), (SELECT complete FROM deleted)
+`
+
+// evictQuery deletes the least recently seen peers of the swarm other than the new peer until it's within the limit, returning the number of seeds and leeches deleted.
+const evictQuery = `
+WITH evicted AS (
+	DELETE FROM peers WHERE hash = $1 AND peer_id IN (
+		SELECT peer_id FROM peers WHERE hash = $1 AND peer_id <> $2 ORDER BY last_seen
+		LIMIT GREATEST((SELECT count(*) FROM peers WHERE hash = $1) - $3, 0)
+	) RETURNING complete
+)
+SELECT count(*) FILTER (WHERE complete), count(*) FILTER (WHERE NOT complete) FROM evicted
+`
+
+func (db *Postgres) Save(ip netip.Addr, port uint16, complete bool, hash storage.Hash, id storage.PeerID, completed bool, transfer storage.Transfer, key uint32) error {
+	var old sql.NullBool
+	var newTorrent bool
+	var uploaded, downloaded int64
+
+	var err error
+	for attempt := 0; attempt < saveAttempts; attempt++ {
+		err = db.pg.QueryRow(saveQuery, hash[:], id[:], ip.Unmap().String(), port, complete, completed,
+			bigint(transfer.Uploaded), bigint(transfer.Downloaded), bigint(transfer.Left), int64(key)).Scan(&old, &newTorrent, &uploaded, &downloaded)
+		if !torrentDeleted(err) {
+			break
+		}
+	}
+	if err == sql.ErrNoRows {
+		return storage.ErrPeerOwned
+	} else if torrentDeleted(err) {
+		config.Logger.Error("Failed to save peer to postgres, its torrent was deleted by every attempt", zap.Int("attempts", saveAttempts), zap.Error(err))
+		return nil
+	} else if err != nil {
+		config.Logger.Error("Failed to save peer to postgres", zap.Error(err))
+		return nil
+	}
+
+	stats.AddTransfer(uint64(uploaded), uint64(downloaded))
+
+	if newTorrent {
+		db.hashes.Add(1)
+	}
+
+	// update metrics
+	if old.Valid {
+		if !old.Bool && complete {
+			stats.Leeches.Add(-1)
+			stats.Seeds.Add(1)
+		} else if old.Bool && !complete {
+			stats.Seeds.Add(-1)
+			stats.Leeches.Add(1)
+		}
+	} else if complete {
+		stats.Seeds.Add(1)
+	} else {
+		stats.Leeches.Add(1)
+	}
+
+	// new peers of a full swarm evict the least recently seen
+	if limit := config.Config.DB.Limits.Peers; !old.Valid && limit > 0 {
+		db.evict(hash, id, limit)
+	}
+
+	return nil
+}
+
+func (db *Postgres) evict(hash storage.Hash, id storage.PeerID, limit uint32) {
+	var seeds, leeches int64
+	if err := db.pg.QueryRow(evictQuery, hash[:], id[:], int64(limit)).Scan(&seeds, &leeches); err != nil {
+		config.Logger.Error("Failed to evict peers from postgres", zap.Error(err))
+		return
+	}
+
+	stats.Seeds.Add(-seeds)
+	stats.Leeches.Add(-leeches)
+	stats.Evictions.Add(seeds + leeches)
+}
+
+// Drop deletes the peer unless it's owned by another client
+func (db *Postgres) Drop(hash storage.Hash, id storage.PeerID, ip netip.Addr, key uint32) error {
+	var owned, complete sql.NullBool
+
+	err := db.pg.QueryRow(dropQuery, hash[:], id[:], ip.Unmap().String(), int64(key)).Scan(&owned, &complete)
+	if err != nil {
+		config.Logger.Error("Failed to drop peer from postgres", zap.Error(err))
+		return nil
+	}
+	if owned.Valid && !owned.Bool {
+		return storage.ErrPeerOwned
+	} else if !complete.Valid {
+		// the peer didn't exist
+		return nil
+	}
+
+	if complete.Bool {
+		stats.Seeds.Add(-1)
+	} else {
+		stats.Leeches.Add(-1)
+	}
+
+	return nil
+}
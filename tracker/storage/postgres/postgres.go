@@ -0,0 +1,207 @@
+/*
+	Postgres implements a trakx database on a postgresql server with normalized tables so live swarm state can be queried with SQL.
+
+	Schema:
+		torrents (hash BYTEA PRIMARY KEY, created TIMESTAMPTZ, downloaded BIGINT, uploaded_bytes BIGINT, downloaded_bytes BIGINT)
+		peers    (hash BYTEA REFERENCES torrents, peer_id BYTEA, ip INET, port INTEGER, complete BOOLEAN, last_seen TIMESTAMPTZ,
+		          first_seen TIMESTAMPTZ, announces BIGINT, uploaded BIGINT, downloaded BIGINT, remaining BIGINT, announce_key BIGINT, sample DOUBLE PRECISION)
+	peers is keyed by (hash, peer_id) and indexed by (hash, complete, sample) for swarm counts and peer lists and by last_seen for trimming.
+	sample is a random number drawn on every announce, peer lists read the peers following a random sample so swarms aren't sorted.
+	Announces upsert into both tables and trims delete expired peers followed by torrents without peers.
+	`db.limits.address` isn't supported and is rejected when loading the config, only the gomap driver indexes peers by address.
+*/
+
+package postgres
+
+import (
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/crimist/trakx/tracker/utils"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS torrents (
+	hash BYTEA PRIMARY KEY,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	downloaded BIGINT NOT NULL DEFAULT 0,
+	uploaded_bytes BIGINT NOT NULL DEFAULT 0,
+	downloaded_bytes BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS peers (
+	hash BYTEA NOT NULL REFERENCES torrents (hash) ON DELETE CASCADE,
+	peer_id BYTEA NOT NULL,
+	ip INET NOT NULL,
+	port INTEGER NOT NULL,
+	complete BOOLEAN NOT NULL,
+	last_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+	first_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+	announces BIGINT NOT NULL DEFAULT 1,
+	uploaded BIGINT NOT NULL DEFAULT 0,
+	downloaded BIGINT NOT NULL DEFAULT 0,
+	remaining BIGINT NOT NULL DEFAULT 0,
+	announce_key BIGINT NOT NULL DEFAULT 0,
+	sample DOUBLE PRECISION NOT NULL DEFAULT random(),
+	PRIMARY KEY (hash, peer_id)
+);
+CREATE INDEX IF NOT EXISTS peers_sample ON peers (hash, complete, sample);
+CREATE INDEX IF NOT EXISTS peers_last_seen ON peers (last_seen);
+`
+
+type Postgres struct {
+	pg     *sql.DB
+	hashes atomic.Int64
+	backup storage.Backup
+}
+
+func (db *Postgres) Init(backup storage.Backup) error {
+	*db = Postgres{
+		backup: backup,
+	}
+
+	var err error
+	if db.pg, err = sql.Open("postgres", config.Config.DB.Postgres.Address); err != nil {
+		return errors.Wrap(err, "failed to open pg connection")
+	}
+	if config.Config.DB.Postgres.Connections > 0 {
+		db.pg.SetMaxOpenConns(config.Config.DB.Postgres.Connections)
+		db.pg.SetMaxIdleConns(config.Config.DB.Postgres.Connections)
+	}
+
+	if err := db.pg.Ping(); err != nil {
+		return errors.Wrap(err, "failed to ping postgres")
+	}
+	if _, err := db.pg.Exec(schema); err != nil {
+		return errors.Wrap(err, "failed to create schema")
+	}
+
+	if err := db.backup.Init(db); err != nil {
+		return errors.Wrap(err, "failed to initialize backup")
+	}
+	if err := db.backup.Load(); err != nil {
+		return errors.Wrap(err, "failed to load backup")
+	}
+
+	if config.Config.DB.Trim > 0 {
+		go utils.RunOn(config.Config.DB.Trim, db.Trim)
+	}
+
+	return nil
+}
+
+func (db *Postgres) Backup() storage.Backup {
+	return db.backup
+}
+
+func (db *Postgres) Check() bool {
+	return db.pg != nil
+}
+
+// Close closes the connections to the server.
+func (db *Postgres) Close() error {
+	return errors.Wrap(db.pg.Close(), "failed to close pg connection")
+}
+
+// Hashes gets the number of hashes as of the last trim or expvar sync
+func (db *Postgres) Hashes() int {
+	return int(db.hashes.Load())
+}
+
+func (db *Postgres) Trim() {
+	start := time.Now()
+	config.Logger.Info("Trimming database")
+	peers, hashes, err := db.trim()
+	if err != nil {
+		config.Logger.Error("Failed to trim database", zap.Error(err))
+	}
+	config.Logger.Info("Trimmed database", zap.Int64("peers", peers), zap.Int64("hashes", hashes), zap.Duration("duration", time.Since(start)))
+}
+
+// trim removes expired peers and torrents left without peers.
+func (db *Postgres) trim() (peers, hashes int64, err error) {
+	result, err := db.pg.Exec("DELETE FROM peers WHERE last_seen < now() - make_interval(secs => $1)", config.Config.DB.Expiry.Seconds())
+	if err != nil {
+		err = errors.Wrap(err, "failed to delete expired peers")
+		return
+	}
+	if peers, err = result.RowsAffected(); err != nil {
+		return
+	}
+
+	if hashes, err = db.removeEmpty(); err != nil {
+		return
+	}
+
+	err = db.SyncExpvars()
+	return
+}
+
+// removeEmpty deletes torrents without peers.
+// The torrents are locked before they're checked again in a new statement so a peer saved while the first statement ran isn't cascade deleted with its torrent, torrents locked by a save are left for the next trim.
+func (db *Postgres) removeEmpty() (int64, error) {
+	tx, err := db.pg.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT hash FROM torrents WHERE NOT EXISTS (SELECT 1 FROM peers WHERE peers.hash = torrents.hash) FOR UPDATE SKIP LOCKED")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to lock empty torrents")
+	}
+	var empty [][]byte
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "failed to scan empty torrent")
+		}
+		empty = append(empty, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to lock empty torrents")
+	}
+	if len(empty) == 0 {
+		return 0, nil
+	}
+
+	result, err := tx.Exec("DELETE FROM torrents WHERE hash = ANY($1) AND NOT EXISTS (SELECT 1 FROM peers WHERE peers.hash = torrents.hash)", pq.ByteaArray(empty))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete empty torrents")
+	}
+	hashes, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return hashes, errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// SyncExpvars recounts seeds, leeches and hashes.
+func (db *Postgres) SyncExpvars() error {
+	if ok := db.Check(); !ok {
+		return errors.New("driver not initiated before SyncExpvars")
+	}
+
+	var seeds, leeches, hashes int64
+	err := db.pg.QueryRow("SELECT count(*) FILTER (WHERE complete), count(*) FILTER (WHERE NOT complete) FROM peers").Scan(&seeds, &leeches)
+	if err != nil {
+		return errors.Wrap(err, "failed to count peers")
+	}
+	if err := db.pg.QueryRow("SELECT count(*) FROM torrents").Scan(&hashes); err != nil {
+		return errors.Wrap(err, "failed to count torrents")
+	}
+
+	stats.Seeds.Store(seeds)
+	stats.Leeches.Store(leeches)
+	db.hashes.Store(hashes)
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package postgres
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+// testDSNEnv names the environment variable holding the connection string of a postgres database the tests may write to, the tests are skipped if it's unset.
+const testDSNEnv = "TRAKX_TEST_POSTGRES"
+
+var (
+	testHash = storage.Hash{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	testId   = storage.PeerID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	testId2  = storage.PeerID{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+
+	// requesters are always sent with their address
+	testAddr = netip.MustParseAddrPort("9.9.9.9:9999")
+)
+
+func openTestDatabase(t *testing.T) *Postgres {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set", testDSNEnv)
+	}
+
+	config.Config.DB.Postgres.Address = dsn
+	config.Config.DB.Postgres.Connections = 4
+	config.Config.DB.Trim = 0
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	var db Postgres
+	if err := db.Init(&NoneBackup{}); err != nil {
+		t.Fatal("failed to init postgres database:", err)
+	}
+
+	// start from an empty swarm and leave nothing behind
+	reset := func() {
+		if _, err := db.pg.Exec("DELETE FROM torrents WHERE hash = $1", testHash[:]); err != nil {
+			t.Fatal("failed to delete test torrent:", err)
+		}
+	}
+	reset()
+	t.Cleanup(func() {
+		reset()
+		db.pg.Close()
+	})
+	return &db
+}
+
+// age sets the last seen time of the peer to seconds ago.
+func age(t *testing.T, db *Postgres, id storage.PeerID, seconds int) {
+	_, err := db.pg.Exec("UPDATE peers SET last_seen = now() - make_interval(secs => $3) WHERE hash = $1 AND peer_id = $2", testHash[:], id[:], seconds)
+	if err != nil {
+		t.Fatal("failed to age peer:", err)
+	}
+}
+
+func TestSaveDrop(t *testing.T) {
+	db := openTestDatabase(t)
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 4321, false, testHash, testId, false, storage.Transfer{}, 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 1 {
+		t.Errorf("HashStats() = %v, %v; want 0, 1", complete, incomplete)
+	}
+
+	// completing moves the peer to the seeds and counts the download once
+	db.Save(netip.MustParseAddr("1.2.3.4"), 4321, true, testHash, testId, true, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 4321, true, testHash, testId, true, storage.Transfer{}, 0)
+	if complete, incomplete, downloaded := db.HashStats(testHash); complete != 1 || incomplete != 0 || downloaded != 1 {
+		t.Errorf("HashStats() after complete = %v, %v, %v; want 1, 0, 1", complete, incomplete, downloaded)
+	}
+
+	if err := db.Drop(testHash, testId, netip.MustParseAddr("1.2.3.5"), 0); err != storage.ErrPeerOwned {
+		t.Errorf("Drop() from another address = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Drop(testHash, testId, netip.MustParseAddr("1.2.3.4"), 0); err != nil {
+		t.Error("Drop() from the address was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after drop = %v, %v; want 0, 0", complete, incomplete)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	db := openTestDatabase(t)
+	ip, other := netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("4.3.2.1")
+
+	if err := db.Save(ip, 1000, false, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Fatal("Save() =", err)
+	}
+	if err := db.Save(other, 1000, true, testHash, testId, false, storage.Transfer{}, 0x1234); err != storage.ErrPeerOwned {
+		t.Errorf("Save() with the wrong key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Save(other, 1000, true, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Error("Save() with the key from another address was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() = %v, %v; want 1, 0", complete, incomplete)
+	}
+}
+
+func TestPeerListBytes(t *testing.T) {
+	db := openTestDatabase(t)
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 0x1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("::1"), 0x4321, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	peers4, peers6 := db.PeerListBytes(testHash, 10, storage.Requester{Addr: testAddr})
+	if !bytes.Equal(peers4, []byte{1, 2, 3, 4, 0x12, 0x34}) {
+		t.Errorf("peers4 = %v; want [1 2 3 4 18 52]", peers4)
+	}
+	if !bytes.Equal(peers6, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x43, 0x21}) {
+		t.Errorf("peers6 = %v; want ::1 port 0x4321", peers6)
+	}
+
+	// each family is capped at numWant
+	peers4, peers6 = db.PeerListBytes(testHash, 1, storage.Requester{Addr: testAddr})
+	if len(peers4)/6 != 1 || len(peers6)/18 != 1 {
+		t.Errorf("PeerListBytes(1) returned %v ipv4 and %v ipv6 peers; want 1 and 1", len(peers4)/6, len(peers6)/18)
+	}
+
+	// seeds only get leeches and the requester is left out
+	if peers4, peers6 := db.PeerListBytes(testHash, 10, storage.Requester{Addr: testAddr, Complete: true}); len(peers4) != 6 || len(peers6) != 0 {
+		t.Errorf("PeerListBytes() for a seed = %v, %v; want the ipv4 leech", peers4, peers6)
+	}
+	if peers4, _ := db.PeerListBytes(testHash, 10, storage.Requester{ID: testId, Addr: testAddr}); len(peers4) != 0 {
+		t.Errorf("PeerListBytes() for the ipv4 peer = %v; want no ipv4 peers", peers4)
+	}
+}
+
+func TestPeerList(t *testing.T) {
+	db := openTestDatabase(t)
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 0x1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("::1"), 0x4321, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	if peers := db.PeerList(testHash, 10, storage.Requester{Addr: testAddr}, false); len(peers) != 2 {
+		t.Errorf("PeerList() returned %v peers; want 2", len(peers))
+	}
+	// the dictionary peer list is capped at numWant across both families
+	if peers := db.PeerList(testHash, 1, storage.Requester{Addr: testAddr}, true); len(peers) != 1 {
+		t.Errorf("PeerList(1) returned %v peers; want 1", len(peers))
+	}
+}
+
+func TestPeerLimit(t *testing.T) {
+	db := openTestDatabase(t)
+	config.Config.DB.Limits.Peers = 3
+	defer func() { config.Config.DB.Limits.Peers = 0 }()
+
+	// peer i was last seen i seconds ago
+	for i := byte(0); i < 3; i++ {
+		db.Save(netip.MustParseAddr("1.2.3.4"), 1000+uint16(i), i == 0, testHash, storage.PeerID{i}, false, storage.Transfer{}, 0)
+		age(t, db, storage.PeerID{i}, int(i))
+	}
+
+	evictions := stats.Evictions.Load()
+	db.Save(netip.MustParseAddr("1.2.3.4"), 2000, false, testHash, storage.PeerID{3}, false, storage.Transfer{}, 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 2 {
+		t.Errorf("HashStats() = %v, %v; want 1, 2", complete, incomplete)
+	}
+	var exists bool
+	oldest := storage.PeerID{2}
+	if err := db.pg.QueryRow("SELECT EXISTS (SELECT 1 FROM peers WHERE hash = $1 AND peer_id = $2)", testHash[:], oldest[:]).Scan(&exists); err != nil || exists {
+		t.Errorf("oldest peer exists = %v, %v; want false", exists, err)
+	}
+	if evicted := stats.Evictions.Load() - evictions; evicted != 1 {
+		t.Errorf("evictions = %v; want 1", evicted)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	db := openTestDatabase(t)
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1000, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1001, true, testHash, testId2, false, storage.Transfer{}, 0)
+	age(t, db, testId, int(2*config.Config.DB.Expiry.Seconds()))
+
+	if peers, _, err := db.trim(); err != nil || peers < 1 {
+		t.Errorf("trim() = %v, %v; want at least 1, nil", peers, err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() after trim = %v, %v; want 1, 0", complete, incomplete)
+	}
+
+	age(t, db, testId2, int(2*config.Config.DB.Expiry.Seconds()))
+	if _, hashes, err := db.trim(); err != nil || hashes < 1 {
+		t.Errorf("trim() = %v, %v; want at least 1 hash, nil", hashes, err)
+	}
+	var exists bool
+	if err := db.pg.QueryRow("SELECT EXISTS (SELECT 1 FROM torrents WHERE hash = $1)", testHash[:]).Scan(&exists); err != nil || exists {
+		t.Errorf("empty torrent exists = %v, %v; want false", exists, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := openTestDatabase(t)
+
+	if err := db.SyncExpvars(); err != nil {
+		t.Fatal("SyncExpvars() =", err)
+	}
+	seeds, leeches, hashes := stats.Seeds.Load(), stats.Leeches.Load(), db.Hashes()
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1000, true, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1001, false, testHash, testId2, false, storage.Transfer{}, 0)
+	if err := db.SyncExpvars(); err != nil {
+		t.Fatal("SyncExpvars() =", err)
+	}
+	if stats.Seeds.Load()-seeds != 1 || stats.Leeches.Load()-leeches != 1 || db.Hashes()-hashes != 1 {
+		t.Errorf("SyncExpvars() counted %v seeds, %v leeches and %v hashes more; want 1, 1, 1", stats.Seeds.Load()-seeds, stats.Leeches.Load()-leeches, db.Hashes()-hashes)
+	}
+
+	// transferred bytes are counted from the second announce of a peer
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1001, false, testHash, testId2, false, storage.Transfer{Uploaded: 100, Downloaded: 50}, 0)
+	var uploaded, downloaded int64
+	if err := db.pg.QueryRow("SELECT uploaded_bytes, downloaded_bytes FROM torrents WHERE hash = $1", testHash[:]).Scan(&uploaded, &downloaded); err != nil {
+		t.Fatal("failed to get transfer:", err)
+	}
+	if uploaded != 100 || downloaded != 50 {
+		t.Errorf("transfer = %v, %v; want 100, 50", uploaded, downloaded)
+	}
+}
@@ -0,0 +1,18 @@
+package postgres
+
+import (
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+func init() {
+	storage.Register(storage.DatabaseInfo{
+		Name: "postgres",
+		DB:   &Postgres{},
+		Backups: []storage.BackupInfo{
+			{
+				Name: "none",
+				Back: &NoneBackup{},
+			},
+		},
+	})
+}
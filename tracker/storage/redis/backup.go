@@ -0,0 +1,12 @@
+package redis
+
+import (
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+// NoneBackup is an empty backup driver, redis persists the data itself.
+type NoneBackup struct{}
+
+func (bck *NoneBackup) Init(db storage.Database) error { return nil }
+func (bck NoneBackup) Save() error                     { return nil }
+func (bck NoneBackup) Load() error                     { return nil }
@@ -0,0 +1,188 @@
+package redis
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/storage"
+	"go.uber.org/zap"
+)
+
+// clampUint32 saturates n so large counts don't wrap around.
+func clampUint32(n int64) uint32 {
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// HashStats returns number of complete and incomplete peers associated with the hash and its completed downloads
+func (db *Redis) HashStats(hash storage.Hash) (complete, incomplete, downloaded uint32) {
+	counts, err := db.pool.do(append(countPeers(hash), command{"HGET", downloadedKey, hash[:]})...)
+	if err != nil {
+		config.Logger.Error("Failed to get hash stats from redis", zap.Error(err))
+		return
+	}
+
+	last := len(counts) - 1
+	if !counts[last].null {
+		count, _ := strconv.ParseUint(string(counts[last].str), 10, 32)
+		downloaded = uint32(count)
+	}
+
+	seeds, leeches := sumPeers(counts[:last])
+	return clampUint32(seeds), clampUint32(leeches), downloaded
+}
+
+// roleSample holds random peers of one role per family, ipv4 first, as alternating peer id and compact peer replies along with the number of peers of the role in each family.
+type roleSample struct {
+	fields [2][]reply
+	peers  [2]int64
+}
+
+// randomPeers samples up to numWant+1 seeds and leeches of each family from the swarm other than the requester.
+// Seeds only get leeches so no seeds are sampled for a seed, the caller mixes the roles (see mixPeers).
+func (db *Redis) randomPeers(hash storage.Hash, numWant uint, requester storage.Requester) (seeds, leeches roleSample) {
+	// one extra peer is sampled from each role in case the requester is among them
+	count := int(numWant) + 1
+
+	var cmds []command
+	var samples []*roleSample
+	var families []int
+	for family, v6 := range []bool{false, true} {
+		if !requester.Complete {
+			cmds = append(cmds, command{"HRANDFIELD", seedsKey(hash, v6), count, "WITHVALUES"}, command{"HLEN", seedsKey(hash, v6)})
+			samples, families = append(samples, &seeds), append(families, family)
+		}
+		cmds = append(cmds, command{"HRANDFIELD", leechesKey(hash, v6), count, "WITHVALUES"}, command{"HLEN", leechesKey(hash, v6)})
+		samples, families = append(samples, &leeches), append(families, family)
+	}
+
+	replies, err := db.pool.do(cmds...)
+	if err != nil {
+		config.Logger.Error("Failed to get peer list from redis", zap.Error(err))
+		return
+	}
+	for i, sample := range samples {
+		sample.fields[families[i]] = withoutRequester(replies[2*i].array, requester)
+		sample.peers[families[i]] = replies[2*i+1].integer
+	}
+	return
+}
+
+// merged returns the sampled peers of both families as one random sample, the families are drawn from in proportion to their peers.
+func (sample *roleSample) merged() []reply {
+	fields := sample.fields
+	var remaining [2]int64
+	for family := range fields {
+		// the requester may have been left out of the sample after the peers were counted
+		remaining[family] = sample.peers[family]
+		if sampled := int64(len(fields[family]) / 2); remaining[family] < sampled {
+			remaining[family] = sampled
+		}
+	}
+
+	merged := make([]reply, 0, len(fields[0])+len(fields[1]))
+	for len(fields[0]) > 0 || len(fields[1]) > 0 {
+		family := 0
+		if len(fields[0]) == 0 || (len(fields[1]) > 0 && rand.Int63n(remaining[0]+remaining[1]) >= remaining[0]) {
+			family = 1
+		}
+		merged = append(merged, fields[family][:2]...)
+		fields[family] = fields[family][2:]
+		remaining[family]--
+	}
+	return merged
+}
+
+// mixPeers returns up to numWant of the sampled seeds and leeches mixed by the role of the requester (see storage.PeerMix).
+// HRANDFIELD returns the fields in random order so any prefix is a random sample.
+func mixPeers(numWant uint, seeds, leeches []reply, complete bool) []reply {
+	wantSeeds, wantLeeches := storage.PeerMix(numWant, uint(len(seeds)/2), uint(len(leeches)/2), complete)
+	mixed := make([]reply, 0, 2*(wantSeeds+wantLeeches))
+	mixed = append(mixed, seeds[:2*wantSeeds]...)
+	return append(mixed, leeches[:2*wantLeeches]...)
+}
+
+// withoutRequester removes the requester from alternating peer id and compact peer replies.
+func withoutRequester(fields []reply, requester storage.Requester) []reply {
+	kept := fields[:0]
+	for i := 0; i+1 < len(fields); i += 2 {
+		var id storage.PeerID
+		copy(id[:], fields[i].str)
+		ip, port, _, _ := decodePeer(fields[i+1].str)
+		if !requester.Is(id, ip, port) {
+			kept = append(kept, fields[i], fields[i+1])
+		}
+	}
+	return kept
+}
+
+// PeerList returns a peer list for the given hash capped at max
+func (db *Redis) PeerList(hash storage.Hash, numWant uint, requester storage.Requester, removePeerId bool) (peers [][]byte) {
+	seeds, leeches := db.randomPeers(hash, numWant, requester)
+	fields := mixPeers(numWant, seeds.merged(), leeches.merged(), requester.Complete)
+	if len(fields) == 0 {
+		return
+	}
+
+	dictionary := pools.Dictionaries.Get()
+
+	for i := 0; i+1 < len(fields) && uint(len(peers)) < numWant; i += 2 {
+		ip, port, _, ok := decodePeer(fields[i+1].str)
+		if !ok {
+			continue
+		}
+
+		if !removePeerId {
+			dictionary.String("peer id", string(fields[i].str))
+		}
+		dictionary.String("ip", ip.String())
+		dictionary.Int64("port", int64(port))
+
+		dictBytes := dictionary.GetBytes()
+		peer := make([]byte, len(dictBytes))
+		copy(peer, dictBytes)
+		peers = append(peers, peer)
+
+		dictionary.Reset()
+	}
+
+	pools.Dictionaries.Put(dictionary)
+
+	return
+}
+
+// PeerListBytes returns byte encoded random samples of up to numWant ipv4 and up to numWant ipv6 peers for the given hash other than the requester, mixed by its role (see storage.PeerMix)
+func (db *Redis) PeerListBytes(hash storage.Hash, numWant uint, requester storage.Requester) (peers4 []byte, peers6 []byte) {
+	peers4 = pools.Peerlists4.Get()
+	peers6 = pools.Peerlists6.Get()
+
+	seeds, leeches := db.randomPeers(hash, numWant, requester)
+
+	// only the compact ip and port are copied, the key stored after them is left out
+	var pos4, pos6 int
+	fields := mixPeers(numWant, seeds.fields[0], leeches.fields[0], requester.Complete)
+	for i := 1; i < len(fields) && pos4+6 <= cap(peers4); i += 2 {
+		copy(peers4[pos4:pos4+6], fields[i].str)
+		pos4 += 6
+	}
+	fields = mixPeers(numWant, seeds.fields[1], leeches.fields[1], requester.Complete)
+	for i := 1; i < len(fields) && pos6+18 <= cap(peers6); i += 2 {
+		copy(peers6[pos6:pos6+18], fields[i].str)
+		pos6 += 18
+	}
+
+	peers4 = peers4[:pos4]
+	peers6 = peers6[:pos6]
+
+	return
+}
+
+// Announce saves the peer and answers it through separate calls (see storage.AnnounceSeparately)
+func (db *Redis) Announce(announce *storage.Announce) (storage.AnnounceResponse, error) {
+	return storage.AnnounceSeparately(db, announce)
+}
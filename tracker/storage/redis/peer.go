@@ -0,0 +1,185 @@
+package redis
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"go.uber.org/zap"
+)
+
+// encodePeer encodes the ip and port in the compact BitTorrent format followed by the announce key.
+func encodePeer(ip netip.Addr, port uint16, key uint32) []byte {
+	addr := ip.AsSlice()
+	data := make([]byte, len(addr)+2+4)
+	copy(data, addr)
+	binary.BigEndian.PutUint16(data[len(addr):], port)
+	binary.BigEndian.PutUint32(data[len(addr)+2:], key)
+	return data
+}
+
+// decodePeer decodes a peer, ok is false if the encoding is invalid.
+func decodePeer(data []byte) (ip netip.Addr, port uint16, key uint32, ok bool) {
+	if len(data) != 6+4 && len(data) != 18+4 {
+		return
+	}
+	key = binary.BigEndian.Uint32(data[len(data)-4:])
+	data = data[:len(data)-4]
+	ip, ok = netip.AddrFromSlice(data[:len(data)-2])
+	port = binary.BigEndian.Uint16(data[len(data)-2:])
+	return
+}
+
+// owner reads the stored peer on c, exists is false if the hash has no peer with the id.
+func owner(c *conn, hash storage.Hash, id storage.PeerID) (peer storage.Peer, exists bool, err error) {
+	var cmds []command
+	for _, key := range peerKeys(hash) {
+		cmds = append(cmds, command{"HGET", key, id[:]})
+	}
+	replies, err := c.do(cmds...)
+	if err != nil {
+		return
+	}
+
+	for i, reply := range replies {
+		if reply.null {
+			continue
+		}
+		peer.IP, peer.Port, peer.Key, exists = decodePeer(reply.str)
+		// peerKeys alternates seeds and leeches
+		peer.Complete = i%2 == 0
+		return
+	}
+	return
+}
+
+func (db *Redis) Save(ip netip.Addr, port uint16, complete bool, hash storage.Hash, id storage.PeerID, completed bool, transfer storage.Transfer, key uint32) error {
+	setKey := leechesKey(hash, ip.Is6())
+	if complete {
+		setKey = seedsKey(hash, ip.Is6())
+	}
+
+	// the peer is only written if it wasn't changed since the ownership check so an announce racing the owner's can't take the peer id
+	var evicting, wasSeed bool
+	replies, err := db.pool.transaction(append(peerKeys(hash), seenKey(hash)), func(c *conn) ([]command, error) {
+		old, exists, err := owner(c, hash, id)
+		if err != nil {
+			return nil, err
+		}
+		if exists && !old.Owns(key, ip) {
+			return nil, storage.ErrPeerOwned
+		}
+		peerKey := key
+		if peerKey == 0 && exists {
+			peerKey = old.Key
+		}
+		wasSeed = exists && old.Complete
+
+		// the peer is removed from the hash of its previous role and family
+		var cmds []command
+		for _, key := range peerKeys(hash) {
+			if key != setKey {
+				cmds = append(cmds, command{"HDEL", key, id[:]})
+			}
+		}
+		now := time.Now().Unix()
+		expiry := int64(config.Config.DB.Expiry.Seconds())
+		cmds = append(cmds,
+			command{"HSET", setKey, id[:], encodePeer(ip, port, peerKey)},
+			command{"ZADD", seenKey(hash), now, id[:]},
+			command{"ZADD", hashesKey, now, hash[:]},
+			command{"EXPIRE", setKey, expiry},
+			command{"EXPIRE", seenKey(hash), expiry},
+		)
+
+		evicting = false
+		if limit := config.Config.DB.Limits.Peers; !exists && limit > 0 {
+			evict, err := evictions(c, hash, limit)
+			if err != nil {
+				return nil, err
+			}
+			if evict != nil {
+				evicting = true
+				cmds = append(cmds, evict...)
+			}
+		}
+		return cmds, nil
+	})
+	if err == storage.ErrPeerOwned {
+		return err
+	}
+	if err != nil {
+		config.Logger.Error("Failed to save peer to redis", zap.Error(err))
+		return nil
+	}
+
+	// the evicted peers are counted by the HDEL of every peer key queued last
+	if evicting {
+		seeds, leeches := sumPeers(replies[len(replies)-len(peerKeys(hash)):])
+		stats.Evictions.Add(seeds + leeches)
+	}
+
+	// count completed downloads once per peer
+	if completed && complete && !wasSeed {
+		if _, err := db.pool.do(command{"HINCRBY", downloadedKey, hash[:], 1}); err != nil {
+			config.Logger.Error("Failed to count download in redis", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// evictions returns the commands that delete the least recently seen peers of a full swarm to make room for a new peer, the swarm is read on the watching connection c.
+// The commands are queued with the save so the peers are evicted only if the save is applied, the last are the HDEL of every key of peerKeys.
+func evictions(c *conn, hash storage.Hash, limit uint32) ([]command, error) {
+	replies, err := c.do(countPeers(hash)...)
+	if err != nil {
+		return nil, err
+	}
+	seeds, leeches := sumPeers(replies)
+	peers := seeds + leeches
+	if peers < int64(limit) {
+		return nil, nil
+	}
+
+	replies, err = c.do(command{"ZRANGE", seenKey(hash), 0, peers - int64(limit)})
+	if err != nil {
+		return nil, err
+	}
+	if len(replies[0].array) == 0 {
+		return nil, nil
+	}
+
+	ids := make([][]byte, 0, len(replies[0].array))
+	seenDel := command{"ZREM", seenKey(hash)}
+	for _, id := range replies[0].array {
+		ids = append(ids, id.str)
+		seenDel = append(seenDel, id.str)
+	}
+	return append([]command{seenDel}, deletePeers(hash, ids...)...), nil
+}
+
+// Drop deletes the peer unless it's owned by another client
+func (db *Redis) Drop(hash storage.Hash, id storage.PeerID, ip netip.Addr, key uint32) error {
+	_, err := db.pool.transaction(peerKeys(hash), func(c *conn) ([]command, error) {
+		old, exists, err := owner(c, hash, id)
+		if err != nil || !exists {
+			return nil, err
+		}
+		if !old.Owns(key, ip) {
+			return nil, storage.ErrPeerOwned
+		}
+		return append(deletePeers(hash, id[:]), command{"ZREM", seenKey(hash), id[:]}), nil
+	})
+	if err == storage.ErrPeerOwned {
+		return err
+	}
+	if err != nil {
+		config.Logger.Error("Failed to drop peer from redis", zap.Error(err))
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+/*
+	Redis implements a trakx database on a redis server using the RESP protocol. Multiple trackers can share the same redis server to serve one set of swarms.
+
+	Every swarm is stored in five keys:
+		<prefix>seeds:<hash>    hash of peer id to compact ip and port and announce key for ipv4 seeds
+		<prefix>leeches:<hash>  hash of peer id to compact ip and port and announce key for ipv4 leeches
+		<prefix>seeds6:<hash>   hash of peer id to compact ip and port and announce key for ipv6 seeds
+		<prefix>leeches6:<hash> hash of peer id to compact ip and port and announce key for ipv6 leeches
+		<prefix>seen:<hash>     sorted set of peer id scored by last announce
+	and <prefix>hashes is a sorted set of all infohashes scored by last announce.
+	<prefix>downloaded is a hash of infohash to completed downloads, entries are removed with their swarm.
+	Seed and leech counts are the lengths of the seeds and leeches hashes of both families, the families are kept apart so peer lists sample each one directly.
+	Peers are stored in the compact format with their key only so transfer counters reported in announces aren't tracked.
+	`db.limits.address` isn't supported and is rejected when loading the config, only the gomap driver indexes peers by address.
+
+	Saves, drops and trims read the swarm and write it in a WATCH and MULTI transaction that is retried if another tracker changed it in between.
+
+	Peer lists are sampled with HRANDFIELD which requires redis 6.2 or newer.
+*/
+
+package redis
+
+import (
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/crimist/trakx/tracker/utils"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	keyPrefix = "trakx:"
+
+	// number of hashes requested per ZSCAN while trimming
+	trimScanCount = 1000
+)
+
+type Redis struct {
+	pool   *pool
+	backup storage.Backup
+}
+
+func (db *Redis) Init(backup storage.Backup) error {
+	*db = Redis{
+		pool:   newPool(config.Config.DB.Redis.Address, config.Config.DB.Redis.Password, config.Config.DB.Redis.Connections),
+		backup: backup,
+	}
+
+	if _, err := db.pool.do(command{"PING"}); err != nil {
+		return errors.Wrap(err, "failed to ping redis")
+	}
+
+	if err := db.backup.Init(db); err != nil {
+		return errors.Wrap(err, "failed to initialize backup")
+	}
+	if err := db.backup.Load(); err != nil {
+		return errors.Wrap(err, "failed to load backup")
+	}
+
+	if config.Config.DB.Trim > 0 {
+		go utils.RunOn(config.Config.DB.Trim, db.Trim)
+	}
+
+	return nil
+}
+
+func (db *Redis) Backup() storage.Backup {
+	return db.backup
+}
+
+func (db *Redis) Check() bool {
+	return db.pool != nil
+}
+
+// Close closes the idle connections to the server.
+func (db *Redis) Close() error {
+	db.pool.close()
+	return nil
+}
+
+func seedsKey(hash storage.Hash, v6 bool) string {
+	if v6 {
+		return keyPrefix + "seeds6:" + hex.EncodeToString(hash[:])
+	}
+	return keyPrefix + "seeds:" + hex.EncodeToString(hash[:])
+}
+
+func leechesKey(hash storage.Hash, v6 bool) string {
+	if v6 {
+		return keyPrefix + "leeches6:" + hex.EncodeToString(hash[:])
+	}
+	return keyPrefix + "leeches:" + hex.EncodeToString(hash[:])
+}
+
+// peerKeys returns the keys of the peers of the swarm, the ipv4 seeds and leeches followed by the ipv6 seeds and leeches.
+func peerKeys(hash storage.Hash) []string {
+	return []string{seedsKey(hash, false), leechesKey(hash, false), seedsKey(hash, true), leechesKey(hash, true)}
+}
+
+// countPeers returns an HLEN of every key of peerKeys.
+func countPeers(hash storage.Hash) []command {
+	var cmds []command
+	for _, key := range peerKeys(hash) {
+		cmds = append(cmds, command{"HLEN", key})
+	}
+	return cmds
+}
+
+// deletePeers returns an HDEL of the ids from every key of peerKeys.
+func deletePeers(hash storage.Hash, ids ...[]byte) []command {
+	var cmds []command
+	for _, key := range peerKeys(hash) {
+		del := command{"HDEL", key}
+		for _, id := range ids {
+			del = append(del, id)
+		}
+		cmds = append(cmds, del)
+	}
+	return cmds
+}
+
+// sumPeers adds up the replies to commands on every key of peerKeys into seeds and leeches.
+func sumPeers(replies []reply) (seeds, leeches int64) {
+	for i, reply := range replies {
+		if i%2 == 0 {
+			seeds += reply.integer
+		} else {
+			leeches += reply.integer
+		}
+	}
+	return
+}
+
+func seenKey(hash storage.Hash) string {
+	return keyPrefix + "seen:" + hex.EncodeToString(hash[:])
+}
+
+const (
+	hashesKey     = keyPrefix + "hashes"
+	downloadedKey = keyPrefix + "downloaded"
+)
+
+// Hashes gets the number of hashes
+func (db *Redis) Hashes() int {
+	replies, err := db.pool.do(command{"ZCARD", hashesKey})
+	if err != nil {
+		config.Logger.Error("Failed to count redis hashes", zap.Error(err))
+		return -1
+	}
+	return int(replies[0].integer)
+}
+
+func (db *Redis) Trim() {
+	start := time.Now()
+	config.Logger.Info("Trimming database")
+	peers, hashes, err := db.trim()
+	if err != nil {
+		config.Logger.Error("Failed to trim database", zap.Error(err))
+	}
+	config.Logger.Info("Trimmed database", zap.Int("peers", peers), zap.Int("hashes", hashes), zap.Duration("duration", time.Since(start)))
+}
+
+// trim removes expired peers and empty hashes and updates the seed and leech stats.
+func (db *Redis) trim() (peers, hashes int, err error) {
+	cutoff := strconv.FormatInt(time.Now().Unix()-int64(config.Config.DB.Expiry.Seconds()), 10)
+	var seeds, leeches int64
+
+	err = db.scanHashes(func(hash storage.Hash) error {
+		expired, swarmSeeds, swarmLeeches, err := db.trimPeers(hash, cutoff)
+		if err != nil {
+			return err
+		}
+		peers += expired
+
+		if swarmSeeds == 0 && swarmLeeches == 0 {
+			removed, err := db.removeEmpty(hash)
+			if err != nil {
+				return err
+			}
+			if removed {
+				hashes++
+			}
+		}
+
+		seeds += swarmSeeds
+		leeches += swarmLeeches
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// redis is shared so local counters can't be kept in sync, recount instead
+	stats.Seeds.Store(seeds)
+	stats.Leeches.Store(leeches)
+
+	return
+}
+
+// trimPeers removes the peers of the swarm last seen before cutoff and returns how many were expired and the seeds and leeches left.
+// A peer that announces while it's trimmed aborts the transaction so it isn't removed.
+func (db *Redis) trimPeers(hash storage.Hash, cutoff string) (expired int, seeds, leeches int64, err error) {
+	replies, err := db.pool.transaction([]string{seenKey(hash)}, func(c *conn) ([]command, error) {
+		replies, err := c.do(command{"ZRANGEBYSCORE", seenKey(hash), "-inf", "(" + cutoff})
+		if err != nil {
+			return nil, err
+		}
+		expired = len(replies[0].array)
+
+		var cmds []command
+		if expired > 0 {
+			ids := make([][]byte, 0, expired)
+			seenDel := command{"ZREM", seenKey(hash)}
+			for _, id := range replies[0].array {
+				ids = append(ids, id.str)
+				seenDel = append(seenDel, id.str)
+			}
+			cmds = append(deletePeers(hash, ids...), seenDel)
+		}
+		return append(cmds, countPeers(hash)...), nil
+	})
+	if err != nil {
+		return
+	}
+
+	seeds, leeches = sumPeers(replies[len(replies)-len(peerKeys(hash)):])
+	return
+}
+
+// removeEmpty deletes the keys of the swarm unless a peer was saved to it since it was trimmed.
+func (db *Redis) removeEmpty(hash storage.Hash) (removed bool, err error) {
+	_, err = db.pool.transaction(peerKeys(hash), func(c *conn) ([]command, error) {
+		counts, err := c.do(countPeers(hash)...)
+		if err != nil {
+			return nil, err
+		}
+		seeds, leeches := sumPeers(counts)
+		removed = seeds == 0 && leeches == 0
+		if !removed {
+			return nil, nil
+		}
+		del := command{"DEL", seenKey(hash)}
+		for _, key := range peerKeys(hash) {
+			del = append(del, key)
+		}
+		return []command{
+			{"ZREM", hashesKey, hash[:]},
+			{"HDEL", downloadedKey, hash[:]},
+			del,
+		}, nil
+	})
+	return
+}
+
+// scanHashes calls fn on every infohash in the database.
+func (db *Redis) scanHashes(fn func(storage.Hash) error) error {
+	cursor := "0"
+	for {
+		replies, err := db.pool.do(command{"ZSCAN", hashesKey, cursor, "COUNT", trimScanCount})
+		if err != nil {
+			return errors.Wrap(err, "failed to scan hashes")
+		}
+		if len(replies[0].array) != 2 {
+			return errors.New("malformed ZSCAN reply")
+		}
+
+		// members are followed by their scores
+		members := replies[0].array[1].array
+		for i := 0; i < len(members); i += 2 {
+			var hash storage.Hash
+			if len(members[i].str) != len(hash) {
+				continue
+			}
+			copy(hash[:], members[i].str)
+
+			if err := fn(hash); err != nil {
+				return err
+			}
+		}
+
+		cursor = string(replies[0].array[0].str)
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (db *Redis) SyncExpvars() error {
+	if ok := db.Check(); !ok {
+		return errors.New("driver not initiated before SyncExpvars")
+	}
+
+	var seeds, leeches int64
+	err := db.scanHashes(func(hash storage.Hash) error {
+		counts, err := db.pool.do(countPeers(hash)...)
+		if err != nil {
+			return err
+		}
+		swarmSeeds, swarmLeeches := sumPeers(counts)
+		seeds += swarmSeeds
+		leeches += swarmLeeches
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stats.Seeds.Store(seeds)
+	stats.Leeches.Store(leeches)
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package redis
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+var (
+	testHash = storage.Hash{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	testId   = storage.PeerID{9, 8, 7, 6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	testId2  = storage.PeerID{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+)
+
+func openTestDatabase(t *testing.T, server *fakeServer) *Redis {
+	config.Config.DB.Redis.Address = server.address()
+	config.Config.DB.Redis.Connections = 4
+	config.Config.DB.Trim = 0
+	config.Config.DB.Expiry = time.Hour
+	pools.Initialize(10)
+
+	var db Redis
+	if err := db.Init(&NoneBackup{}); err != nil {
+		t.Fatal("failed to init redis database:", err)
+	}
+	return &db
+}
+
+func TestSaveDrop(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 4321, false, testHash, testId, false, storage.Transfer{}, 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 1 {
+		t.Errorf("HashStats() = %v, %v; want 0, 1", complete, incomplete)
+	}
+
+	// completing moves the peer to the seeds
+	db.Save(netip.MustParseAddr("1.2.3.4"), 4321, true, testHash, testId, false, storage.Transfer{}, 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() after complete = %v, %v; want 1, 0", complete, incomplete)
+	}
+	if hashes := db.Hashes(); hashes != 1 {
+		t.Errorf("Hashes() = %v; want 1", hashes)
+	}
+
+	db.Drop(testHash, testId, netip.MustParseAddr("1.2.3.4"), 0)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after drop = %v, %v; want 0, 0", complete, incomplete)
+	}
+}
+
+func TestPeerListBytes(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 0x1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("::1"), 0x4321, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	peers4, peers6 := db.PeerListBytes(testHash, 10, storage.Requester{Complete: false})
+	if !bytes.Equal(peers4, []byte{1, 2, 3, 4, 0x12, 0x34}) {
+		t.Errorf("peers4 = %v; want [1 2 3 4 18 52]", peers4)
+	}
+	if !bytes.Equal(peers6, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x43, 0x21}) {
+		t.Errorf("peers6 = %v; want ::1 port 0x4321", peers6)
+	}
+
+	peers4, peers6 = db.PeerListBytes(testHash, 1, storage.Requester{Complete: false})
+	// each family is capped at numWant
+	if len(peers4)/6 != 1 || len(peers6)/18 != 1 {
+		t.Errorf("PeerListBytes(1) returned %v ipv4 and %v ipv6 peers; want 1 and 1", len(peers4)/6, len(peers6)/18)
+	}
+}
+
+func TestSaveFamilyChange(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	// a peer announcing from the other family with its key moves between the family hashes
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0xabcd)
+	db.Save(netip.MustParseAddr("::1"), 1234, false, testHash, testId, false, storage.Transfer{}, 0xabcd)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 1 {
+		t.Errorf("HashStats() = %v, %v; want 0, 1", complete, incomplete)
+	}
+	if peers4, peers6 := db.PeerListBytes(testHash, 10, storage.Requester{}); len(peers4) != 0 || len(peers6) != 18 {
+		t.Errorf("PeerListBytes() returned %v ipv4 and %v ipv6 bytes; want 0 and 18", len(peers4), len(peers6))
+	}
+
+	db.Drop(testHash, testId, netip.MustParseAddr("::1"), 0xabcd)
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after drop = %v, %v; want 0, 0", complete, incomplete)
+	}
+}
+
+func TestPeerListBytesFamilies(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	// a few ipv6 peers among many ipv4 peers are still sampled up to numWant
+	for i := byte(0); i < 40; i++ {
+		db.Save(netip.AddrFrom4([4]byte{10, 0, 0, i}), 1234, false, testHash, storage.PeerID{4, i}, false, storage.Transfer{}, 0)
+	}
+	for i := byte(0); i < 2; i++ {
+		db.Save(netip.AddrFrom16([16]byte{0x20, 0x01, 15: i}), 1234, false, testHash, storage.PeerID{6, i}, false, storage.Transfer{}, 0)
+	}
+
+	for i := 0; i < 10; i++ {
+		peers4, peers6 := db.PeerListBytes(testHash, 2, storage.Requester{Complete: false})
+		if len(peers4)/6 != 2 || len(peers6)/18 != 2 {
+			t.Fatalf("PeerListBytes(2) returned %v ipv4 and %v ipv6 peers; want 2 and 2", len(peers4)/6, len(peers6)/18)
+		}
+	}
+	if peers := db.PeerList(testHash, 50, storage.Requester{Complete: false}, true); len(peers) != 42 {
+		t.Errorf("PeerList(50) returned %v peers; want all 42", len(peers))
+	}
+}
+
+func TestPeerList(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+
+	peers := db.PeerList(testHash, 10, storage.Requester{Complete: false}, false)
+	expected := "d7:peer id20:" + string(testId[:]) + "2:ip7:1.2.3.44:porti1234ee"
+	if len(peers) != 1 || string(peers[0]) != expected {
+		t.Errorf("PeerList() = %q; want [%q]", peers, expected)
+	}
+
+	peers = db.PeerList(testHash, 10, storage.Requester{Complete: false}, true)
+	expected = "d2:ip7:1.2.3.44:porti1234ee"
+	if len(peers) != 1 || string(peers[0]) != expected {
+		t.Errorf("PeerList() without peer id = %q; want [%q]", peers, expected)
+	}
+}
+
+func TestShared(t *testing.T) {
+	server := newFakeServer(t)
+	db1 := openTestDatabase(t, server)
+	db2 := openTestDatabase(t, server)
+
+	db1.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db2.Save(netip.MustParseAddr("4.3.2.1"), 4321, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	for _, db := range []*Redis{db1, db2} {
+		if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 1 {
+			t.Errorf("HashStats() = %v, %v; want 1, 1", complete, incomplete)
+		}
+		if peers4, _ := db.PeerListBytes(testHash, 10, storage.Requester{Complete: false}); len(peers4) != 12 {
+			t.Errorf("PeerListBytes() returned %v bytes; want 12", len(peers4))
+		}
+	}
+}
+
+func TestTrim(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId2, false, storage.Transfer{}, 0)
+
+	config.Config.DB.Expiry = time.Hour
+	if peers, hashes, err := db.trim(); err != nil || peers != 0 || hashes != 0 {
+		t.Errorf("trim() = %v, %v, %v; want 0, 0, nil", peers, hashes, err)
+	}
+
+	config.Config.DB.Expiry = -1 * time.Second
+	if peers, hashes, err := db.trim(); err != nil || peers != 2 || hashes != 1 {
+		t.Errorf("trim() = %v, %v, %v; want 2, 1, nil", peers, hashes, err)
+	}
+	if hashes := db.Hashes(); hashes != 0 {
+		t.Errorf("Hashes() after trim = %v; want 0", hashes)
+	}
+}
+
+func TestTrimAnnounce(t *testing.T) {
+	server := newFakeServer(t)
+	db := openTestDatabase(t, server)
+	ip := netip.MustParseAddr("1.2.3.4")
+
+	db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	server.mutex.Lock()
+	server.zsets[seenKey(testHash)][string(testId[:])] -= 2 * time.Hour.Seconds()
+	// the peer announces again after the trim found it expired
+	var announced atomic.Bool
+	server.before = func(args []string) {
+		if strings.ToUpper(args[0]) == "MULTI" && announced.CompareAndSwap(false, true) {
+			db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+		}
+	}
+	server.mutex.Unlock()
+
+	if peers, hashes, err := db.trim(); err != nil || peers != 0 || hashes != 0 {
+		t.Errorf("trim() = %v, %v, %v; want 0, 0, nil", peers, hashes, err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 1 {
+		t.Errorf("HashStats() after trim = %v, %v; want 0, 1", complete, incomplete)
+	}
+}
+
+func TestDownloaded(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId, true, storage.Transfer{}, 0)
+	// repeated completed announces count once
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId, true, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("4.3.2.1"), 4321, true, testHash, testId2, true, storage.Transfer{}, 0)
+
+	if complete, incomplete, downloaded := db.HashStats(testHash); complete != 2 || incomplete != 0 || downloaded != 2 {
+		t.Errorf("HashStats() = %v, %v, %v; want 2, 0, 2", complete, incomplete, downloaded)
+	}
+}
+
+func TestPeerListRoles(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+	config.Config.Numwant.SeedRatio = 0.5
+
+	db.Save(netip.MustParseAddr("1.2.3.4"), 1234, true, testHash, testId, false, storage.Transfer{}, 0)
+	db.Save(netip.MustParseAddr("4.3.2.1"), 4321, false, testHash, testId2, false, storage.Transfer{}, 0)
+
+	// seeds only get leeches
+	if peers4, _ := db.PeerListBytes(testHash, 10, storage.Requester{Complete: true}); !bytes.Equal(peers4, []byte{4, 3, 2, 1, 0x10, 0xe1}) {
+		t.Errorf("PeerListBytes() for seed = %v; want only the leech", peers4)
+	}
+	if peers4, _ := db.PeerListBytes(testHash, 10, storage.Requester{Complete: false}); len(peers4) != 12 {
+		t.Errorf("PeerListBytes() for leech returned %v bytes; want 12", len(peers4))
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	ip, other := netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("4.3.2.1")
+
+	// without a key the peer id is owned by its ip
+	if err := db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0); err != nil {
+		t.Fatal("Save() of a new peer was rejected:", err)
+	}
+	if err := db.Save(other, 1234, false, testHash, testId, false, storage.Transfer{}, 0); err != storage.ErrPeerOwned {
+		t.Errorf("Save() from another ip without a key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Drop(testHash, testId, other, 0); err != storage.ErrPeerOwned {
+		t.Errorf("Drop() from another ip without a key = %v; want storage.ErrPeerOwned", err)
+	}
+
+	// a key sent from the owning ip is stored, after that the key owns the peer id from any ip
+	if err := db.Save(ip, 1234, false, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Error("Save() with a key from the owning ip was rejected:", err)
+	}
+	if err := db.Save(other, 1234, false, testHash, testId, false, storage.Transfer{}, 0x1234); err != storage.ErrPeerOwned {
+		t.Errorf("Save() with the wrong key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Save(other, 1234, true, testHash, testId, false, storage.Transfer{}, 0xabcd); err != nil {
+		t.Error("Save() with the key from another ip was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 0 {
+		t.Errorf("HashStats() = %v, %v; want 1, 0", complete, incomplete)
+	}
+
+	if err := db.Drop(testHash, testId, other, 0x1234); err != storage.ErrPeerOwned {
+		t.Errorf("Drop() with the wrong key = %v; want storage.ErrPeerOwned", err)
+	}
+	if err := db.Drop(testHash, testId, ip, 0xabcd); err != nil {
+		t.Error("Drop() with the key was rejected:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 0 || incomplete != 0 {
+		t.Errorf("HashStats() after drop = %v, %v; want 0, 0", complete, incomplete)
+	}
+}
+
+func TestOwnershipConcurrent(t *testing.T) {
+	db := openTestDatabase(t, newFakeServer(t))
+
+	// clients racing to announce a new peer id, only the first owns it
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Save(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 1234, false, testHash, testId, false, storage.Transfer{}, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	owners := 0
+	for _, err := range errs {
+		if err == nil {
+			owners++
+		} else if err != storage.ErrPeerOwned {
+			t.Errorf("Save() = %v; want nil or storage.ErrPeerOwned", err)
+		}
+	}
+	if owners != 1 {
+		t.Errorf("%v racing Save() calls took the peer id; want 1", owners)
+	}
+}
+
+func TestPeerLimit(t *testing.T) {
+	server := newFakeServer(t)
+	db := openTestDatabase(t, server)
+	config.Config.DB.Limits.Peers = 3
+	defer func() { config.Config.DB.Limits.Peers = 0 }()
+
+	// peer i was last seen i seconds ago
+	now := float64(time.Now().Unix())
+	for i := byte(0); i < 3; i++ {
+		id := storage.PeerID{i}
+		db.Save(netip.MustParseAddr("1.2.3.4"), 1000+uint16(i), i == 0, testHash, id, false, storage.Transfer{}, 0)
+		server.mutex.Lock()
+		server.zsets[seenKey(testHash)][string(id[:])] = now - float64(i)
+		server.mutex.Unlock()
+	}
+
+	evictions := stats.Evictions.Load()
+	newest := storage.PeerID{3}
+	if err := db.Save(netip.MustParseAddr("1.2.3.4"), 2000, false, testHash, newest, false, storage.Transfer{}, 0); err != nil {
+		t.Fatal("Save() into a full swarm failed:", err)
+	}
+	if complete, incomplete, _ := db.HashStats(testHash); complete != 1 || incomplete != 2 {
+		t.Errorf("HashStats() = %v, %v; want 1, 2", complete, incomplete)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	oldest := storage.PeerID{2}
+	if _, ok := server.hashes[leechesKey(testHash, false)][string(oldest[:])]; ok {
+		t.Error("oldest peer exists after eviction")
+	}
+	if _, ok := server.zsets[seenKey(testHash)][string(oldest[:])]; ok {
+		t.Error("oldest peer is still in the seen set after eviction")
+	}
+	if _, ok := server.hashes[leechesKey(testHash, false)][string(newest[:])]; !ok {
+		t.Error("saved peer doesn't exist after eviction")
+	}
+	// the eviction is applied in the transaction of the save instead of aborting it
+	if server.aborted != 0 {
+		t.Errorf("%v transactions were aborted; want 0", server.aborted)
+	}
+	if evicted := stats.Evictions.Load() - evictions; evicted != 1 {
+		t.Errorf("evictions = %v; want 1", evicted)
+	}
+}
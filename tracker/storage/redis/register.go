@@ -0,0 +1,18 @@
+package redis
+
+import (
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+func init() {
+	storage.Register(storage.DatabaseInfo{
+		Name: "redis",
+		DB:   &Redis{},
+		Backups: []storage.BackupInfo{
+			{
+				Name: "none",
+				Back: &NoneBackup{},
+			},
+		},
+	})
+}
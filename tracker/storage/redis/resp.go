@@ -0,0 +1,312 @@
+package redis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	ioTimeout   = 5 * time.Second
+
+	// number of times a transaction is retried after a watched key changed
+	transactionAttempts = 8
+)
+
+// errConflict is returned when a watched key changed on every attempt of a transaction.
+var errConflict = errors.New("watched keys kept changing")
+
+// command holds the arguments of a single redis command, arguments must be string, []byte, int or int64.
+type command []interface{}
+
+// reply holds a decoded RESP reply.
+type reply struct {
+	kind    byte // one of '+', '-', ':', '$', '*'
+	null    bool
+	str     []byte
+	integer int64
+	array   []reply
+}
+
+// conn is a single RESP connection.
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	broken  bool
+}
+
+func dial(address string) (*conn, error) {
+	netConn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+	}, nil
+}
+
+func (c *conn) writeBulk(data []byte) {
+	c.writer.WriteByte('$')
+	c.writer.WriteString(strconv.Itoa(len(data)))
+	c.writer.WriteString("\r\n")
+	c.writer.Write(data)
+	c.writer.WriteString("\r\n")
+}
+
+// send buffers the command, it isn't written until flush.
+func (c *conn) send(cmd command) {
+	c.writer.WriteByte('*')
+	c.writer.WriteString(strconv.Itoa(len(cmd)))
+	c.writer.WriteString("\r\n")
+
+	for _, arg := range cmd {
+		switch arg := arg.(type) {
+		case string:
+			c.writeBulk([]byte(arg))
+		case []byte:
+			c.writeBulk(arg)
+		case int:
+			c.writeBulk([]byte(strconv.Itoa(arg)))
+		case int64:
+			c.writeBulk([]byte(strconv.FormatInt(arg, 10)))
+		default:
+			panic("unsupported redis argument type")
+		}
+	}
+}
+
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed RESP line")
+	}
+	return line[:len(line)-2], nil
+}
+
+// receive reads and decodes a single reply.
+func (c *conn) receive() (r reply, err error) {
+	line, err := c.readLine()
+	if err != nil {
+		return
+	}
+
+	r.kind = line[0]
+	switch r.kind {
+	case '+', '-':
+		r.str = append([]byte(nil), line[1:]...)
+	case ':':
+		r.integer, err = strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		var size int
+		if size, err = strconv.Atoi(string(line[1:])); err != nil {
+			return
+		}
+		if size < 0 {
+			r.null = true
+			return
+		}
+		r.str = make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, r.str); err != nil {
+			return
+		}
+		r.str = r.str[:size]
+	case '*':
+		var size int
+		if size, err = strconv.Atoi(string(line[1:])); err != nil {
+			return
+		}
+		if size < 0 {
+			r.null = true
+			return
+		}
+		r.array = make([]reply, size)
+		for i := range r.array {
+			if r.array[i], err = c.receive(); err != nil {
+				return
+			}
+		}
+	default:
+		err = errors.New("unknown RESP reply type '" + string(r.kind) + "'")
+	}
+
+	return
+}
+
+// do writes the commands in a single pipeline and reads their replies.
+func (c *conn) do(cmds ...command) ([]reply, error) {
+	c.netConn.SetDeadline(time.Now().Add(ioTimeout))
+
+	for _, cmd := range cmds {
+		c.send(cmd)
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.broken = true
+		return nil, errors.Wrap(err, "failed to write commands")
+	}
+
+	replies := make([]reply, len(cmds))
+	for i := range replies {
+		var err error
+		if replies[i], err = c.receive(); err != nil {
+			c.broken = true
+			return nil, errors.Wrap(err, "failed to read reply")
+		}
+	}
+
+	// surface the first error reply
+	for i, r := range replies {
+		if r.kind == '-' {
+			return replies, errors.Errorf("redis error on %v: %s", cmds[i][0], r.str)
+		}
+	}
+
+	return replies, nil
+}
+
+func (c *conn) close() error {
+	return c.netConn.Close()
+}
+
+// pool holds idle connections to the redis server.
+type pool struct {
+	address  string
+	password string
+	idle     chan *conn
+}
+
+func newPool(address, password string, size int) *pool {
+	if size < 1 {
+		size = 1
+	}
+
+	return &pool{
+		address:  address,
+		password: password,
+		idle:     make(chan *conn, size),
+	}
+}
+
+func (p *pool) get() (*conn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	c, err := dial(p.address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial redis")
+	}
+
+	if p.password != "" {
+		if _, err := c.do(command{"AUTH", p.password}); err != nil {
+			c.close()
+			return nil, errors.Wrap(err, "failed to authenticate with redis")
+		}
+	}
+
+	return c, nil
+}
+
+func (p *pool) put(c *conn) {
+	if c.broken {
+		c.close()
+		return
+	}
+
+	select {
+	case p.idle <- c:
+	default:
+		c.close()
+	}
+}
+
+// close closes the idle connections.
+func (p *pool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.close()
+		default:
+			return
+		}
+	}
+}
+
+// do executes the commands as a pipeline on a pooled connection.
+func (p *pool) do(cmds ...command) ([]reply, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := c.do(cmds...)
+	p.put(c)
+
+	return replies, err
+}
+
+// transaction watches the keys and queues the commands fn returns in MULTI, EXEC only applies them if none of the keys changed since they were watched.
+// fn reads the keys on the watching connection and is called again if the transaction is aborted. If fn returns no commands nothing is applied.
+// It returns the replies of the queued commands.
+func (p *pool) transaction(keys []string, fn func(c *conn) ([]command, error)) ([]reply, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(c)
+
+	watch := command{"WATCH"}
+	for _, key := range keys {
+		watch = append(watch, key)
+	}
+
+	for attempt := 0; attempt < transactionAttempts; attempt++ {
+		if _, err := c.do(watch); err != nil {
+			return nil, err
+		}
+
+		cmds, err := fn(c)
+		if err != nil || len(cmds) == 0 {
+			if _, unwatchErr := c.do(command{"UNWATCH"}); unwatchErr != nil && err == nil {
+				err = unwatchErr
+			}
+			return nil, err
+		}
+
+		pipeline := make([]command, 0, len(cmds)+2)
+		pipeline = append(pipeline, command{"MULTI"})
+		pipeline = append(pipeline, cmds...)
+		pipeline = append(pipeline, command{"EXEC"})
+		replies, err := c.do(pipeline...)
+		if err != nil {
+			return nil, err
+		}
+
+		exec := replies[len(replies)-1]
+		if exec.null {
+			// a watched key changed
+			continue
+		}
+		for i, r := range exec.array {
+			if r.kind == '-' {
+				return exec.array, errors.Errorf("redis error on %v: %s", cmds[i][0], r.str)
+			}
+		}
+		return exec.array, nil
+	}
+
+	return nil, errConflict
+}
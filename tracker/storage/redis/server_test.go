@@ -0,0 +1,396 @@
+package redis
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer is an in-process stand-in for redis that implements the subset of RESP commands used by the driver.
+type fakeServer struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	hashes   map[string]map[string][]byte
+	zsets    map[string]map[string]float64
+	versions map[string]int // number of writes to every key, checked by EXEC against the versions watched
+	aborted  int            // number of transactions EXEC aborted
+
+	// before is called with the arguments of every command before it's executed if set, it's called without the server locked
+	before func(args []string)
+}
+
+// session is the transaction state of a connection.
+type session struct {
+	watched map[string]int
+	queued  [][]string
+	multi   bool
+}
+
+func newFakeServer(t testing.TB) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+
+	server := &fakeServer{
+		listener: listener,
+		hashes:   make(map[string]map[string][]byte),
+		zsets:    make(map[string]map[string]float64),
+		versions: make(map[string]int),
+	}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return server
+}
+
+func (s *fakeServer) address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(netConn)
+	}
+}
+
+func (s *fakeServer) handle(netConn net.Conn) {
+	defer netConn.Close()
+	reader := bufio.NewReader(netConn)
+	writer := bufio.NewWriter(netConn)
+	var sess session
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		before := s.before
+		s.mutex.Unlock()
+		if before != nil {
+			before(args)
+		}
+
+		s.mutex.Lock()
+		s.transact(writer, &sess, args)
+		s.mutex.Unlock()
+
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+
+	return args, nil
+}
+
+func writeInt(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, data string) {
+	w.WriteString("$" + strconv.Itoa(len(data)) + "\r\n" + data + "\r\n")
+}
+
+func writeArray(w *bufio.Writer, items []string) {
+	w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		writeBulk(w, item)
+	}
+}
+
+func parseScore(arg string) (score float64, exclusive bool) {
+	if strings.HasPrefix(arg, "(") {
+		exclusive = true
+		arg = arg[1:]
+	}
+	switch arg {
+	case "-inf":
+		return math.Inf(-1), exclusive
+	case "+inf":
+		return math.Inf(1), exclusive
+	}
+	score, _ = strconv.ParseFloat(arg, 64)
+	return
+}
+
+func inRange(score float64, minArg, maxArg string) bool {
+	min, minExclusive := parseScore(minArg)
+	max, maxExclusive := parseScore(maxArg)
+	if score < min || (minExclusive && score == min) {
+		return false
+	}
+	if score > max || (maxExclusive && score == max) {
+		return false
+	}
+	return true
+}
+
+// transact handles the transaction commands and queues commands sent after MULTI, the server must be locked.
+func (s *fakeServer) transact(w *bufio.Writer, sess *session, args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "WATCH":
+		if sess.watched == nil {
+			sess.watched = make(map[string]int)
+		}
+		for _, key := range args[1:] {
+			sess.watched[key] = s.versions[key]
+		}
+		w.WriteString("+OK\r\n")
+	case "UNWATCH":
+		sess.watched = nil
+		w.WriteString("+OK\r\n")
+	case "MULTI":
+		sess.multi = true
+		w.WriteString("+OK\r\n")
+	case "DISCARD":
+		*sess = session{}
+		w.WriteString("+OK\r\n")
+	case "EXEC":
+		queued, watched := sess.queued, sess.watched
+		*sess = session{}
+		for key, version := range watched {
+			if s.versions[key] != version {
+				s.aborted++
+				w.WriteString("*-1\r\n")
+				return
+			}
+		}
+		w.WriteString("*" + strconv.Itoa(len(queued)) + "\r\n")
+		for _, args := range queued {
+			s.exec(w, args)
+		}
+	default:
+		if sess.multi {
+			sess.queued = append(sess.queued, args)
+			w.WriteString("+QUEUED\r\n")
+			return
+		}
+		s.exec(w, args)
+	}
+}
+
+// touch counts a write to the keys written by the command.
+func (s *fakeServer) touch(args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "DEL":
+		for _, key := range args[1:] {
+			s.versions[key]++
+		}
+	case "EXPIRE", "HSET", "HDEL", "HINCRBY", "ZADD", "ZREM", "ZPOPMIN", "ZREMRANGEBYSCORE":
+		s.versions[args[1]]++
+	}
+}
+
+func (s *fakeServer) exec(w *bufio.Writer, args []string) {
+	s.touch(args)
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		w.WriteString("+PONG\r\n")
+	case "AUTH", "EXPIRE":
+		w.WriteString("+OK\r\n")
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.hashes[key]; ok {
+				deleted++
+			}
+			if _, ok := s.zsets[key]; ok {
+				deleted++
+			}
+			delete(s.hashes, key)
+			delete(s.zsets, key)
+		}
+		writeInt(w, deleted)
+	case "HSET":
+		hash, ok := s.hashes[args[1]]
+		if !ok {
+			hash = make(map[string][]byte)
+			s.hashes[args[1]] = hash
+		}
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				added++
+			}
+			hash[args[i]] = []byte(args[i+1])
+		}
+		writeInt(w, added)
+	case "HDEL":
+		removed := 0
+		for _, field := range args[2:] {
+			if _, ok := s.hashes[args[1]][field]; ok {
+				delete(s.hashes[args[1]], field)
+				removed++
+			}
+		}
+		if len(s.hashes[args[1]]) == 0 {
+			delete(s.hashes, args[1])
+		}
+		writeInt(w, removed)
+	case "HINCRBY":
+		hash, ok := s.hashes[args[1]]
+		if !ok {
+			hash = make(map[string][]byte)
+			s.hashes[args[1]] = hash
+		}
+		value, _ := strconv.Atoi(string(hash[args[2]]))
+		increment, _ := strconv.Atoi(args[3])
+		value += increment
+		hash[args[2]] = []byte(strconv.Itoa(value))
+		writeInt(w, value)
+	case "HGET":
+		value, ok := s.hashes[args[1]][args[2]]
+		if !ok {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		writeBulk(w, string(value))
+	case "HLEN":
+		writeInt(w, len(s.hashes[args[1]]))
+	case "HRANDFIELD":
+		count, _ := strconv.Atoi(args[2])
+		fields := make([]string, 0, len(s.hashes[args[1]]))
+		for field := range s.hashes[args[1]] {
+			fields = append(fields, field)
+		}
+		rand.Shuffle(len(fields), func(i, j int) { fields[i], fields[j] = fields[j], fields[i] })
+		if count < len(fields) {
+			fields = fields[:count]
+		}
+		var items []string
+		for _, field := range fields {
+			items = append(items, field, string(s.hashes[args[1]][field]))
+		}
+		writeArray(w, items)
+	case "ZADD":
+		zset, ok := s.zsets[args[1]]
+		if !ok {
+			zset = make(map[string]float64)
+			s.zsets[args[1]] = zset
+		}
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := zset[args[i+1]]; !ok {
+				added++
+			}
+			zset[args[i+1]] = score
+		}
+		writeInt(w, added)
+	case "ZREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if _, ok := s.zsets[args[1]][member]; ok {
+				delete(s.zsets[args[1]], member)
+				removed++
+			}
+		}
+		writeInt(w, removed)
+	case "ZCARD":
+		writeInt(w, len(s.zsets[args[1]]))
+	case "ZSCAN":
+		// return everything in a single iteration
+		var items []string
+		for member, score := range s.zsets[args[1]] {
+			items = append(items, member, strconv.FormatFloat(score, 'f', -1, 64))
+		}
+		w.WriteString("*2\r\n")
+		writeBulk(w, "0")
+		writeArray(w, items)
+	case "ZPOPMIN":
+		count, _ := strconv.Atoi(args[2])
+		members := make([]string, 0, len(s.zsets[args[1]]))
+		for member := range s.zsets[args[1]] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool { return s.zsets[args[1]][members[i]] < s.zsets[args[1]][members[j]] })
+		if count < len(members) {
+			members = members[:count]
+		}
+		var items []string
+		for _, member := range members {
+			items = append(items, member, strconv.FormatFloat(s.zsets[args[1]][member], 'f', -1, 64))
+			delete(s.zsets[args[1]], member)
+		}
+		writeArray(w, items)
+	case "ZRANGE":
+		start, _ := strconv.Atoi(args[2])
+		stop, _ := strconv.Atoi(args[3])
+		members := make([]string, 0, len(s.zsets[args[1]]))
+		for member := range s.zsets[args[1]] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool { return s.zsets[args[1]][members[i]] < s.zsets[args[1]][members[j]] })
+		if stop >= len(members) {
+			stop = len(members) - 1
+		}
+		if start > stop {
+			writeArray(w, nil)
+			return
+		}
+		writeArray(w, members[start:stop+1])
+	case "ZRANGEBYSCORE":
+		var members []string
+		for member, score := range s.zsets[args[1]] {
+			if inRange(score, args[2], args[3]) {
+				members = append(members, member)
+			}
+		}
+		sort.Strings(members)
+		writeArray(w, members)
+	case "ZREMRANGEBYSCORE":
+		removed := 0
+		for member, score := range s.zsets[args[1]] {
+			if inRange(score, args[2], args[3]) {
+				delete(s.zsets[args[1]], member)
+				removed++
+			}
+		}
+		writeInt(w, removed)
+	default:
+		w.WriteString("-ERR unknown command '" + args[0] + "'\r\n")
+	}
+}
@@ -1,6 +1,9 @@
 package storage
 
-import "net/netip"
+import (
+	"net/netip"
+	"strconv"
+)
 
 type (
 	// Hash stores a BitTorrent infohash.
@@ -14,5 +17,121 @@ type (
 		IP       netip.Addr
 		Port     uint16
 		LastSeen int64
+
+		FirstSeen  int64  // unix time of the first announce
+		Announces  uint32 // announces since first seen
+		Uploaded   uint64 // bytes uploaded as of the last announce
+		Downloaded uint64 // bytes downloaded as of the last announce
+		Left       uint64 // bytes left as of the last announce
+
+		Key uint32 // key the client announces with, 0 if it never sent one
+	}
+
+	// Requester is the peer a peer list is for, it's left out of its own list.
+	Requester struct {
+		ID       PeerID
+		Addr     netip.AddrPort // announced ip and port
+		Complete bool
+	}
+
+	// Transfer contains the byte counters a peer reports in an announce.
+	Transfer struct {
+		Uploaded   uint64
+		Downloaded uint64
+		Left       uint64
+	}
+
+	// Announce is an announce to save and answer with Database.Announce.
+	Announce struct {
+		Hash      Hash
+		ID        PeerID
+		Addr      netip.AddrPort // announced ip and port
+		Complete  bool           // the peer has the whole torrent
+		Completed bool           // the peer announced it completed the download
+		Transfer  Transfer
+		Key       uint32
+		NumWant   uint
+		Compact   bool // answer with byte encoded peer lists
+		NoPeerID  bool // leave the peer ids out of a peer list that isn't compact
+	}
+
+	// AnnounceResponse is the swarm as seen by an announce.
+	// Compact announces get Peers4 and Peers6 from pools.Peerlists4 and pools.Peerlists6 which the caller puts back, others get Peers.
+	AnnounceResponse struct {
+		Complete   uint32
+		Incomplete uint32
+		Downloaded uint32
+
+		Peers  [][]byte
+		Peers4 []byte
+		Peers6 []byte
 	}
 )
+
+// Requester returns the peer the announce is from.
+func (announce *Announce) Requester() Requester {
+	return Requester{
+		ID:       announce.ID,
+		Addr:     announce.Addr,
+		Complete: announce.Complete,
+	}
+}
+
+// Is returns true if the peer is the requester, either by peer id or by address.
+func (requester *Requester) Is(id PeerID, ip netip.Addr, port uint16) bool {
+	return id == requester.ID || (ip == requester.Addr.Addr() && port == requester.Addr.Port())
+}
+
+// Owns returns true if an announce with key from ip is from the client that saved the peer.
+// Keys are compared when both the announce and the peer have one, otherwise the ips are so a peer id can't be taken over by anyone who learns it.
+func (peer *Peer) Owns(key uint32, ip netip.Addr) bool {
+	if key != 0 && peer.Key != 0 {
+		return key == peer.Key
+	}
+	return ip == peer.IP
+}
+
+// Account applies the counters of an announce to the peer at time now and returns the bytes transferred since its previous announce.
+// The first announce of a peer only sets the baseline. Counters lower than the previous announce mean the client restarted its session so they're counted from zero.
+func (peer *Peer) Account(transfer Transfer, now int64, exists bool) (uploaded, downloaded uint64) {
+	if exists {
+		uploaded = counterDelta(peer.Uploaded, transfer.Uploaded)
+		downloaded = counterDelta(peer.Downloaded, transfer.Downloaded)
+	} else {
+		peer.FirstSeen = now
+		peer.Announces = 0
+	}
+
+	peer.Uploaded = transfer.Uploaded
+	peer.Downloaded = transfer.Downloaded
+	peer.Left = transfer.Left
+	peer.Announces++
+	return
+}
+
+// ParseKey converts the key param of an HTTP announce or BEP 41 url data to the 32 bit key of UDP announces, clients send it in hex so it's the same over both.
+// Keys that aren't hex are hashed with FNV-1a, an empty key is 0.
+func ParseKey(value string) uint32 {
+	if value == "" {
+		return 0
+	}
+	if len(value) <= 8 {
+		if key, err := strconv.ParseUint(value, 16, 32); err == nil {
+			return uint32(key)
+		}
+	}
+
+	key := uint32(2166136261)
+	for i := 0; i < len(value); i++ {
+		key ^= uint32(value[i])
+		key *= 16777619
+	}
+	return key
+}
+
+func counterDelta(old, new uint64) uint64 {
+	if new < old {
+		return new
+	}
+	return new - old
+}
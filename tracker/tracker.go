@@ -17,7 +17,10 @@ import (
 	"go.uber.org/zap"
 
 	// import database types so init is called
+	_ "github.com/crimist/trakx/tracker/storage/disk"
 	_ "github.com/crimist/trakx/tracker/storage/map"
+	_ "github.com/crimist/trakx/tracker/storage/postgres"
+	_ "github.com/crimist/trakx/tracker/storage/redis"
 )
 
 // Run initializes and runs the tracker with the requested configuration settings.
@@ -29,6 +29,9 @@ func TestMain(m *testing.M) {
 	config.Config.UDP.Enabled = true
 	config.Config.UDP.Port = 1337
 	config.Config.UDP.Threads = 1
+	config.Config.UDP.Batch = 8
+	config.Config.UDP.Sockets = 2
+	config.Config.HTTP.Sockets = 2
 	config.Config.Numwant.Default = 100
 	config.Config.Numwant.Limit = 100
 
@@ -1,23 +1,38 @@
 package udp
 
 import (
+	"math"
 	"math/rand"
-	"net"
 	"net/netip"
 
 	"github.com/crimist/trakx/config"
 	"github.com/crimist/trakx/pools"
 	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
 	"github.com/crimist/trakx/tracker/udp/protocol"
 )
 
-func (u *UDPTracker) announce(announce *protocol.Announce, remote *net.UDPAddr, addrPort netip.AddrPort) {
+const (
+	announceRespHeaderSize = 20
+	peerSize4              = 6  // ipv4 address and port
+	peerSize6              = 18 // ipv6 address and port
+)
+
+func (u *UDPTracker) announce(announce *protocol.Announce, addrPort netip.AddrPort) []byte {
 	stats.Announces.Add(1)
 
+	// url data is handled like the path and query of an HTTP announce
+	urlData := parseURLData(announce.URLData)
+	if !urlData.served("/announce") {
+		return u.newClientError("unknown path", announce.TransactionID, cerrFields{"addrPort": addrPort, "path": urlData.path})
+	}
+	key := announce.Key
+	if urlData.query.Has("key") {
+		key = storage.ParseKey(urlData.query.Get("key"))
+	}
+
 	if announce.Port == 0 {
-		msg := u.newClientError("bad port", announce.TransactionID, cerrFields{"addrPort": addrPort, "port": announce.Port})
-		u.sock.WriteToUDP(msg, remote)
-		return
+		return u.newClientError("bad port", announce.TransactionID, cerrFields{"addrPort": addrPort, "port": announce.Port})
 	}
 
 	if announce.NumWant < 1 {
@@ -26,8 +41,16 @@ func (u *UDPTracker) announce(announce *protocol.Announce, remote *net.UDPAddr,
 		announce.NumWant = int32(config.Config.Numwant.Limit)
 	}
 
+	// the peers that fit in the response, one more is requested to know if the list was trimmed
+	fit, peerSize := peersFit(addrPort.Addr())
+	if fit >= 0 && int(announce.NumWant) > fit+1 {
+		announce.NumWant = int32(fit + 1)
+	}
+
 	if announce.Event == protocol.EventStopped {
-		u.peerdb.Drop(announce.InfoHash, announce.PeerID)
+		if err := u.peerdb.Drop(announce.InfoHash, announce.PeerID, addrPort.Addr(), key); err != nil {
+			return u.newClientError(err.Error(), announce.TransactionID, cerrFields{"addrPort": addrPort, "peerid": announce.PeerID})
+		}
 
 		resp := protocol.AnnounceResp{
 			Action:        protocol.ActionAnnounce,
@@ -39,13 +62,10 @@ func (u *UDPTracker) announce(announce *protocol.Announce, remote *net.UDPAddr,
 		}
 		respBytes, err := resp.Marshall()
 		if err != nil {
-			msg := u.newServerError("AnnounceResp.Marshall()", err, announce.TransactionID)
-			u.sock.WriteToUDP(msg, remote)
-			return
+			return u.newServerError("AnnounceResp.Marshall()", err, announce.TransactionID)
 		}
 
-		u.sock.WriteToUDP(respBytes, remote)
-		return
+		return respBytes
 	}
 
 	peerComplete := false
@@ -53,10 +73,26 @@ func (u *UDPTracker) announce(announce *protocol.Announce, remote *net.UDPAddr,
 		peerComplete = true
 	}
 
-	u.peerdb.Save(addrPort.Addr(), announce.Port, peerComplete, announce.InfoHash, announce.PeerID)
+	transfer := storage.Transfer{
+		Uploaded:   counter(announce.Uploaded),
+		Downloaded: counter(announce.Downloaded),
+		Left:       counter(announce.Left),
+	}
+	response, err := u.peerdb.Announce(&storage.Announce{
+		Hash:      announce.InfoHash,
+		ID:        announce.PeerID,
+		Addr:      netip.AddrPortFrom(addrPort.Addr(), announce.Port),
+		Complete:  peerComplete,
+		Completed: announce.Event == protocol.EventCompleted,
+		Transfer:  transfer,
+		Key:       key,
+		NumWant:   uint(announce.NumWant),
+		Compact:   true,
+	})
+	if err != nil {
+		return u.newClientError(err.Error(), announce.TransactionID, cerrFields{"addrPort": addrPort, "peerid": announce.PeerID})
+	}
 
-	complete, incomplete := u.peerdb.HashStats(announce.InfoHash)
-	peers4, peers6 := u.peerdb.PeerListBytes(announce.InfoHash, uint(announce.NumWant))
 	interval := int32(config.Config.Announce.Base.Seconds())
 	if int32(config.Config.Announce.Fuzz.Seconds()) > 0 {
 		interval += rand.Int31n(int32(config.Config.Announce.Fuzz.Seconds()))
@@ -66,25 +102,61 @@ func (u *UDPTracker) announce(announce *protocol.Announce, remote *net.UDPAddr,
 		Action:        protocol.ActionAnnounce,
 		TransactionID: announce.TransactionID,
 		Interval:      interval,
-		Leechers:      int32(incomplete),
-		Seeders:       int32(complete),
+		Leechers:      count(response.Incomplete),
+		Seeders:       count(response.Complete),
 	}
 
+	peers := response.Peers6
 	if addrPort.Addr().Is4() {
-		resp.Peers = peers4
-	} else {
-		resp.Peers = peers6
+		peers = response.Peers4
+	}
+	if fit >= 0 && len(peers) > fit*peerSize {
+		peers = peers[:fit*peerSize]
+		stats.Truncated.Add(1)
 	}
+	resp.Peers = peers
 
 	respBytes, err := resp.Marshall()
-	pools.Peerlists4.Put(peers4)
-	pools.Peerlists6.Put(peers6)
+	pools.Peerlists4.Put(response.Peers4)
+	pools.Peerlists6.Put(response.Peers6)
 
 	if err != nil {
-		msg := u.newServerError("AnnounceResp.Marshall()", err, announce.TransactionID)
-		u.sock.WriteToUDP(msg, remote)
-		return
+		return u.newServerError("AnnounceResp.Marshall()", err, announce.TransactionID)
 	}
 
-	u.sock.WriteToUDP(respBytes, remote)
+	return respBytes
+}
+
+// peersFit returns the number of peers that fit in an announce response to the address within `udp.maxpayload` and the size of a peer, -1 peers if the response isn't capped.
+func peersFit(addr netip.Addr) (fit int, peerSize int) {
+	maxPayload := config.Config.UDP.MaxPayload.V6
+	peerSize = peerSize6
+	if addr.Is4() {
+		maxPayload, peerSize = config.Config.UDP.MaxPayload.V4, peerSize4
+	}
+	if maxPayload <= 0 {
+		return -1, peerSize
+	}
+
+	fit = (maxPayload - announceRespHeaderSize) / peerSize
+	if fit < 0 {
+		fit = 0
+	}
+	return fit, peerSize
+}
+
+// count converts a swarm count to the wire, counts beyond the range of int32 are clamped.
+func count(value uint32) int32 {
+	if value > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(value)
+}
+
+// counter converts a transfer counter from the wire, negative values are invalid and treated as 0.
+func counter(value int64) uint64 {
+	if value < 0 {
+		return 0
+	}
+	return uint64(value)
 }
@@ -0,0 +1,153 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/pools"
+	"github.com/crimist/trakx/tracker/stats"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/crimist/trakx/tracker/udp/protocol"
+
+	_ "github.com/crimist/trakx/tracker/storage/map"
+)
+
+func TestAnnounceMaxPayload(t *testing.T) {
+	config.Config.DB.Type = "gomap"
+	config.Config.DB.Backup.Type = "none"
+	config.Config.Numwant.Default = 50
+	config.Config.Numwant.Limit = 200
+	config.Config.UDP.MaxPayload.V4 = announceRespHeaderSize + 10*peerSize4
+	config.Config.UDP.MaxPayload.V6 = announceRespHeaderSize + 5*peerSize6 + peerSize6 - 1
+	defer func() {
+		config.Config.UDP.MaxPayload.V4 = 0
+		config.Config.UDP.MaxPayload.V6 = 0
+	}()
+	pools.Initialize(200)
+
+	db, err := storage.Open()
+	if err != nil {
+		t.Fatal("failed to open storage", err)
+	}
+	tracker := UDPTracker{peerdb: db}
+
+	large := storage.Hash{1}
+	small := storage.Hash{2}
+	for i := 0; i < 50; i++ {
+		db.Save(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 1000, false, large, storage.PeerID{byte(i), 4}, false, storage.Transfer{}, 0)
+		db.Save(netip.AddrFrom16([16]byte{0x20, 0x01, 15: byte(i)}), 1000, false, large, storage.PeerID{byte(i), 6}, false, storage.Transfer{}, 0)
+	}
+	for i := 0; i < 3; i++ {
+		db.Save(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 1000, false, small, storage.PeerID{byte(i)}, false, storage.Transfer{}, 0)
+	}
+
+	var cases = []struct {
+		name      string
+		hash      storage.Hash
+		addrPort  netip.AddrPort
+		numwant   int32
+		size      int
+		truncated int64
+	}{
+		{"v4 trimmed", large, netip.MustParseAddrPort("1.1.1.1:1234"), 200, announceRespHeaderSize + 10*peerSize4, 1},
+		{"v6 trimmed", large, netip.MustParseAddrPort("[2001:db8::1]:1234"), 0, announceRespHeaderSize + 5*peerSize6, 1},
+		{"v4 fits", small, netip.MustParseAddrPort("1.1.1.1:1234"), 200, announceRespHeaderSize + 3*peerSize4, 0},
+		{"v4 numwant fits", large, netip.MustParseAddrPort("1.1.1.1:1234"), 4, announceRespHeaderSize + 4*peerSize4, 0},
+	}
+
+	for n, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			truncated := stats.Truncated.Load()
+			response := tracker.announce(&protocol.Announce{
+				Action:        protocol.ActionAnnounce,
+				TransactionID: 1337,
+				InfoHash:      c.hash,
+				PeerID:        storage.PeerID{0xFF, byte(n)},
+				Left:          100,
+				NumWant:       c.numwant,
+				Port:          c.addrPort.Port(),
+			}, c.addrPort)
+
+			if len(response) != c.size {
+				t.Errorf("response size = %v; want %v", len(response), c.size)
+			}
+			if truncated := stats.Truncated.Load() - truncated; truncated != c.truncated {
+				t.Errorf("%v responses truncated; want %v", truncated, c.truncated)
+			}
+		})
+	}
+}
+
+func TestCounter(t *testing.T) {
+	var cases = []struct {
+		value    int64
+		expected uint64
+	}{
+		{0, 0},
+		{1234, 1234},
+		{9223372036854775807, 9223372036854775807},
+		{-1, 0},
+		{-9223372036854775808, 0},
+	}
+
+	for _, c := range cases {
+		if got := counter(c.value); got != c.expected {
+			t.Errorf("counter(%v) = %v; want %v", c.value, got, c.expected)
+		}
+	}
+}
+
+func TestAnnounceURLData(t *testing.T) {
+	config.Config.DB.Type = "gomap"
+	config.Config.DB.Backup.Type = "none"
+	pools.Initialize(200)
+
+	db, err := storage.Open()
+	if err != nil {
+		t.Fatal("failed to open storage", err)
+	}
+	tracker := UDPTracker{peerdb: db}
+
+	hash := storage.Hash{3}
+	peer := storage.PeerID{3}
+	announce := func(stop bool, key uint32, urlData string, addrPort netip.AddrPort) protocol.Action {
+		event := protocol.EventStarted
+		if stop {
+			event = protocol.EventStopped
+		}
+		response := tracker.announce(&protocol.Announce{
+			Action:        protocol.ActionAnnounce,
+			TransactionID: 1337,
+			InfoHash:      hash,
+			PeerID:        peer,
+			Left:          100,
+			Event:         event,
+			Key:           key,
+			Port:          addrPort.Port(),
+			URLData:       []byte(urlData),
+		}, addrPort)
+		return protocol.Action(binary.BigEndian.Uint32(response[0:4]))
+	}
+	first := netip.MustParseAddrPort("1.1.1.1:1234")
+	moved := netip.MustParseAddrPort("2.2.2.2:1234")
+
+	if action := announce(false, 0, "/stats", first); action != protocol.ActionError {
+		t.Errorf("announce to an unknown path answered with action %v; want an error", action)
+	}
+	if action := announce(false, 0, "/announce?key=deadbeef", first); action != protocol.ActionAnnounce {
+		t.Fatalf("announce with url data answered with action %v; want an announce", action)
+	}
+
+	// the key in the url data identifies the client like the key param of an HTTP announce
+	if action := announce(true, 0, "", moved); action != protocol.ActionError {
+		t.Errorf("stop without the key from another address answered with action %v; want an error", action)
+	}
+	if action := announce(true, 0, "/announce?key=deadbeef", moved); action != protocol.ActionAnnounce {
+		t.Errorf("stop with the url data key answered with action %v; want an announce", action)
+	}
+	if _, incomplete, _ := db.HashStats(hash); incomplete != 0 {
+		t.Errorf("%v leeches after the stop; want 0", incomplete)
+	}
+}
@@ -0,0 +1,74 @@
+package udp
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/crimist/trakx/config"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+)
+
+const batchSupported = true
+
+// serveBatch reads up to size packets per recvmmsg syscall and sends their responses with sendmmsg once the batch is processed.
+func (u *UDPTracker) serveBatch(sock *net.UDPConn, hits *atomic.Int64, size int) {
+	// the batch methods don't depend on the address family so they work on dual stack sockets as well
+	conn := ipv4.NewPacketConn(sock)
+
+	requests := make([]ipv4.Message, size)
+	for i := range requests {
+		requests[i].Buffers = [][]byte{make([]byte, requestSizeMax)}
+	}
+	responses := make([]ipv4.Message, size)
+	for i := range responses {
+		responses[i].Buffers = make([][]byte, 1)
+	}
+
+	for {
+		received, err := conn.ReadBatch(requests, 0)
+		if err != nil {
+			// if socket is closed exit loop
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			config.Logger.Error("Failed to read from UDP socket", zap.Error(err))
+			continue
+		}
+		hits.Add(int64(received))
+
+		queued := 0
+		for _, request := range requests[:received] {
+			remote, ok := request.Addr.(*net.UDPAddr)
+			if !ok || request.N < 16 { // 16 = minimum connect
+				continue
+			}
+
+			if response := u.process(request.Buffers[0][:request.N], remote.AddrPort()); response != nil {
+				responses[queued].Buffers[0] = response
+				responses[queued].Addr = remote
+				queued++
+			}
+		}
+
+		u.flush(conn, responses[:queued])
+	}
+}
+
+// flush sends the queued responses, a response that fails to send is dropped.
+func (u *UDPTracker) flush(conn *ipv4.PacketConn, responses []ipv4.Message) {
+	for len(responses) > 0 {
+		sent, err := conn.WriteBatch(responses, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			config.Logger.Error("Failed to write to UDP socket", zap.Error(err))
+			sent = 1
+		}
+		responses = responses[sent:]
+	}
+}
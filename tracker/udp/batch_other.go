@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package udp
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+const batchSupported = false
+
+func (u *UDPTracker) serveBatch(sock *net.UDPConn, hits *atomic.Int64, size int) {
+	u.serveLoop(sock, hits)
+}
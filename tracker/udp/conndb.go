@@ -5,16 +5,29 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"math/rand"
 	"net/netip"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/utils/timingwheel"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// connectionStore issues the connection ids of clients and checks the ids they send back, selected by `udp.conndb.type`.
+type connectionStore interface {
+	// connect returns a new connection id for the address
+	connect(addr netip.AddrPort) int64
+	check(id int64, addr netip.AddrPort) bool
+	// size returns the number of connections kept, -1 if the store doesn't keep any
+	size() int
+	// write saves the store to the cache directory so it can be loaded after a restart
+	write() error
+}
+
 type connectionInfo struct {
 	ID        int64
 	TimeStamp int64
@@ -24,6 +37,9 @@ type connectionDatabase struct {
 	mutex         sync.RWMutex
 	connectionMap map[netip.AddrPort]connectionInfo
 	expiry        int64
+
+	// connections at their timestamp when they were scheduled, connections refreshed since are scheduled again when they come due
+	wheel timingwheel.Wheel[netip.AddrPort]
 }
 
 func newConnectionDatabase(expiry time.Duration) *connectionDatabase {
@@ -44,14 +60,25 @@ func (db *connectionDatabase) size() (count int) {
 }
 
 func (db *connectionDatabase) add(id int64, addr netip.AddrPort) {
+	now := time.Now().Unix()
+
 	db.mutex.Lock()
+	if _, ok := db.connectionMap[addr]; !ok {
+		db.wheel.Schedule(addr, now)
+	}
 	db.connectionMap[addr] = connectionInfo{
 		ID:        id,
-		TimeStamp: time.Now().Unix(),
+		TimeStamp: now,
 	}
 	db.mutex.Unlock()
 }
 
+func (db *connectionDatabase) connect(addr netip.AddrPort) int64 {
+	id := rand.Int63()
+	db.add(id, addr)
+	return id
+}
+
 func (db *connectionDatabase) check(id int64, addr netip.AddrPort) bool {
 	db.mutex.RLock()
 	cid, ok := db.connectionMap[addr]
@@ -68,14 +95,20 @@ func (db *connectionDatabase) trim() {
 	config.Logger.Info("Trimming connection database")
 
 	start := time.Now()
-	epoch := start.Unix()
+	cutoff := start.Unix() - db.expiry
 	trimmed := 0
 
 	db.mutex.Lock()
-	for key, conn := range db.connectionMap {
-		if epoch-conn.TimeStamp > db.expiry {
-			delete(db.connectionMap, key)
+	for _, entry := range db.wheel.Expire(cutoff) {
+		conn, ok := db.connectionMap[entry.Key]
+		if !ok {
+			continue
+		}
+		if conn.TimeStamp < cutoff {
+			delete(db.connectionMap, entry.Key)
 			trimmed++
+		} else {
+			db.wheel.Schedule(entry.Key, conn.TimeStamp)
 		}
 	}
 	db.mutex.Unlock()
@@ -83,6 +116,17 @@ func (db *connectionDatabase) trim() {
 	config.Logger.Info("Trimmed connection database", zap.Int("removed", trimmed), zap.Int("left", db.size()), zap.Duration("duration", time.Since(start)))
 }
 
+// schedule puts every connection in the wheel after the map was replaced, the database must be locked or not yet shared.
+func (db *connectionDatabase) schedule() {
+	for addr, conn := range db.connectionMap {
+		db.wheel.Schedule(addr, conn.TimeStamp)
+	}
+}
+
+func (db *connectionDatabase) write() error {
+	return db.writeToFile(config.CachePath + "conn.db")
+}
+
 func (connDb *connectionDatabase) writeToFile(path string) error {
 	config.Logger.Info("Writing connection database")
 	start := time.Now()
@@ -138,7 +182,11 @@ func (db *connectionDatabase) gobDecode(data []byte) error {
 	db.make()
 	reader := bufio.NewReader(bytes.NewBuffer(data))
 
-	return gob.NewDecoder(reader).Decode(&db.connectionMap)
+	if err := gob.NewDecoder(reader).Decode(&db.connectionMap); err != nil {
+		return err
+	}
+	db.schedule()
+	return nil
 }
 
 func (db *connectionDatabase) marshallBinary() ([]byte, error) {
@@ -208,10 +256,12 @@ func (db *connectionDatabase) unmarshallBinary(data []byte) error {
 		}
 		db.connectionMap[netip.AddrPortFrom(addr, port)] = connInfo
 	}
+	db.schedule()
 
 	return nil
 }
 
 func (db *connectionDatabase) make() {
 	db.connectionMap = make(map[netip.AddrPort]connectionInfo, config.Config.UDP.ConnDB.Size)
+	db.wheel = timingwheel.Wheel[netip.AddrPort]{}
 }
@@ -85,6 +85,31 @@ func TestConnectionDatabaseTrim(t *testing.T) {
 	}
 }
 
+func TestConnectionDatabaseTrimRefreshed(t *testing.T) {
+	connDb := newConnectionDatabase(time.Hour)
+	expired := netip.MustParseAddrPort("1.1.1.1:1234")
+	refreshed := netip.MustParseAddrPort("2.2.2.2:1234")
+	old := time.Now().Add(-2 * time.Hour).Unix()
+
+	// both connections come due, one of them connected again since
+	for _, addrPort := range []netip.AddrPort{expired, refreshed} {
+		connDb.connectionMap[addrPort] = connectionInfo{ID: 1, TimeStamp: old}
+		connDb.wheel.Schedule(addrPort, old)
+	}
+	connDb.add(2, refreshed)
+	connDb.trim()
+
+	if connDb.check(1, expired) {
+		t.Error("expired check() returned true; want false")
+	}
+	if !connDb.check(2, refreshed) {
+		t.Error("refreshed check() returned false; want true")
+	}
+	if connDb.wheel.Len() != 1 {
+		t.Errorf("wheel.Len() = %v; want 1", connDb.wheel.Len())
+	}
+}
+
 func TestConnectionDatabaseWriteLoad(t *testing.T) {
 	filePath := "writetest.db"
 	connDbWrite := newConnectionDatabase(connectionTimeout)
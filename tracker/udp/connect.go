@@ -1,19 +1,16 @@
 package udp
 
 import (
-	"math/rand"
-	"net"
 	"net/netip"
 
 	"github.com/crimist/trakx/tracker/stats"
 	"github.com/crimist/trakx/tracker/udp/protocol"
 )
 
-func (u *UDPTracker) connect(connect *protocol.Connect, remote *net.UDPAddr, addr netip.AddrPort) {
+func (u *UDPTracker) connect(connect *protocol.Connect, addr netip.AddrPort) []byte {
 	stats.Connects.Add(1)
 
-	id := rand.Int63()
-	u.conndb.add(id, addr)
+	id := u.conndb.connect(addr)
 
 	resp := protocol.ConnectResp{
 		Action:        protocol.ActionConnect,
@@ -23,10 +20,8 @@ func (u *UDPTracker) connect(connect *protocol.Connect, remote *net.UDPAddr, add
 
 	respBytes, err := resp.Marshall()
 	if err != nil {
-		msg := u.newServerError("ConnectResp.Marshall()", err, connect.TransactionID)
-		u.sock.WriteToUDP(msg, remote)
-		return
+		return u.newServerError("ConnectResp.Marshall()", err, connect.TransactionID)
 	}
 
-	u.sock.WriteToUDP(respBytes, remote)
+	return respBytes
 }
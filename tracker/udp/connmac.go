@@ -0,0 +1,182 @@
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crimist/trakx/config"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	macKeySize = 32
+	// epoch (8) + current key + previous key
+	macKeysFileSize = 8 + 2*macKeySize
+)
+
+// connectionMAC derives connection ids from a keyed MAC over the client address and the epoch they were issued in, nothing is kept per connection.
+// The key is replaced every epoch and ids of the previous key are still accepted so ids are valid for between one and two epochs.
+type connectionMAC struct {
+	epoch int64 // seconds per epoch
+	keys  atomic.Pointer[macKeys]
+}
+
+// macKeys are the keys of an epoch and the one before it.
+type macKeys struct {
+	epoch    int64
+	current  *macKey
+	previous *macKey // nil if the previous epoch had no key
+}
+
+type macKey struct {
+	secret [macKeySize]byte
+	hashes sync.Pool
+}
+
+func newMACKey(secret [macKeySize]byte) *macKey {
+	key := &macKey{secret: secret}
+	key.hashes.New = func() any {
+		return hmac.New(sha256.New, key.secret[:])
+	}
+	return key
+}
+
+func randomMACKey() *macKey {
+	var secret [macKeySize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		config.Logger.Fatal("Failed to generate connection id key", zap.Error(err))
+	}
+	return newMACKey(secret)
+}
+
+func newConnectionMAC(expiry time.Duration) *connectionMAC {
+	return &connectionMAC{
+		epoch: int64(expiry.Seconds()),
+	}
+}
+
+// id returns the connection id of the address in the epoch.
+func (key *macKey) id(epoch int64, addr netip.AddrPort) []byte {
+	var message [8 + 16 + 2]byte
+	binary.BigEndian.PutUint64(message[:8], uint64(epoch))
+	ip := addr.Addr().As16()
+	copy(message[8:24], ip[:])
+	binary.BigEndian.PutUint16(message[24:], addr.Port())
+
+	mac := key.hashes.Get().(hash.Hash)
+	mac.Reset()
+	mac.Write(message[:])
+	var sum [sha256.Size]byte
+	id := mac.Sum(sum[:0])[:8]
+	key.hashes.Put(mac)
+
+	return id
+}
+
+// keysAt returns the keys of the epoch of now, replacing the keys of an earlier epoch.
+func (db *connectionMAC) keysAt(now int64) *macKeys {
+	epoch := now / db.epoch
+	for {
+		keys := db.keys.Load()
+		if keys != nil && keys.epoch >= epoch {
+			return keys
+		}
+
+		rotated := &macKeys{
+			epoch:   epoch,
+			current: randomMACKey(),
+		}
+		if keys != nil && keys.epoch == epoch-1 {
+			rotated.previous = keys.current
+		}
+		// another goroutine may beat us to it
+		if db.keys.CompareAndSwap(keys, rotated) {
+			return rotated
+		}
+	}
+}
+
+func (db *connectionMAC) connect(addr netip.AddrPort) int64 {
+	return db.issue(addr, time.Now().Unix())
+}
+
+func (db *connectionMAC) issue(addr netip.AddrPort, now int64) int64 {
+	keys := db.keysAt(now)
+	return int64(binary.BigEndian.Uint64(keys.current.id(keys.epoch, addr)))
+}
+
+func (db *connectionMAC) check(id int64, addr netip.AddrPort) bool {
+	return db.verify(id, addr, time.Now().Unix())
+}
+
+// verify returns true if the id was issued to the address in the epoch of now or the one before it.
+func (db *connectionMAC) verify(id int64, addr netip.AddrPort, now int64) bool {
+	var sent [8]byte
+	binary.BigEndian.PutUint64(sent[:], uint64(id))
+
+	keys := db.keysAt(now)
+	if hmac.Equal(sent[:], keys.current.id(keys.epoch, addr)) {
+		return true
+	}
+	return keys.previous != nil && hmac.Equal(sent[:], keys.previous.id(keys.epoch-1, addr))
+}
+
+func (db *connectionMAC) size() int {
+	return -1
+}
+
+func (db *connectionMAC) write() error {
+	return db.writeToFile(config.CachePath + "conn.key")
+}
+
+// writeToFile saves the keys so the ids issued before a restart are still accepted.
+func (db *connectionMAC) writeToFile(path string) error {
+	keys := db.keysAt(time.Now().Unix())
+
+	data := make([]byte, macKeysFileSize)
+	binary.BigEndian.PutUint64(data[:8], uint64(keys.epoch))
+	copy(data[8:], keys.current.secret[:])
+	if keys.previous != nil {
+		copy(data[8+macKeySize:], keys.previous.secret[:])
+	}
+
+	// the keys are secret
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write file")
+	}
+	return nil
+}
+
+func (db *connectionMAC) loadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read connection id keys file from disk")
+	}
+	if len(data) != macKeysFileSize {
+		return errors.New("connection id keys file has the wrong size")
+	}
+
+	var current, previous [macKeySize]byte
+	copy(current[:], data[8:])
+	copy(previous[:], data[8+macKeySize:])
+
+	keys := &macKeys{
+		epoch:   int64(binary.BigEndian.Uint64(data[:8])),
+		current: newMACKey(current),
+	}
+	if previous != [macKeySize]byte{} {
+		keys.previous = newMACKey(previous)
+	}
+	db.keys.Store(keys)
+
+	return nil
+}
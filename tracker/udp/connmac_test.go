@@ -0,0 +1,83 @@
+package udp
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnectionMACVerify(t *testing.T) {
+	connMAC := newConnectionMAC(2 * time.Minute)
+	addrPort4 := netip.MustParseAddrPort("1.1.1.1:1234")
+	addrPort6 := netip.MustParseAddrPort("[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:1234")
+	now := int64(1_700_000_040)
+
+	id4 := connMAC.issue(addrPort4, now)
+	id6 := connMAC.issue(addrPort6, now)
+	if !connMAC.verify(id4, addrPort4, now) || !connMAC.verify(id6, addrPort6, now) {
+		t.Error("verify() of an issued id returned false; want true")
+	}
+	if connMAC.verify(id4, netip.MustParseAddrPort("1.1.1.2:1234"), now) {
+		t.Error("verify() with another address returned true; want false")
+	}
+	if connMAC.verify(id4, netip.MustParseAddrPort("1.1.1.1:1235"), now) {
+		t.Error("verify() with another port returned true; want false")
+	}
+	if connMAC.verify(id4, addrPort6, now) {
+		t.Error("verify() with the id of another address returned true; want false")
+	}
+
+	// the previous key is kept for an epoch
+	now += 120
+	if !connMAC.verify(id4, addrPort4, now) {
+		t.Error("verify() an epoch later returned false; want true")
+	}
+	if connMAC.issue(addrPort4, now) == id4 {
+		t.Error("issue() in the next epoch returned the same id")
+	}
+	now += 120
+	if connMAC.verify(id4, addrPort4, now) {
+		t.Error("verify() two epochs later returned true; want false")
+	}
+}
+
+func TestConnectionMACSkippedEpoch(t *testing.T) {
+	connMAC := newConnectionMAC(time.Minute)
+	addrPort4 := netip.MustParseAddrPort("1.1.1.1:1234")
+	now := int64(1_700_000_040)
+
+	id4 := connMAC.issue(addrPort4, now)
+	// no keys were made in the epoch between so the previous key is dropped
+	if connMAC.verify(id4, addrPort4, now+120) {
+		t.Error("verify() after a skipped epoch returned true; want false")
+	}
+}
+
+func TestConnectionMACWriteLoad(t *testing.T) {
+	filePath := "writetest.key"
+	connMACWrite := newConnectionMAC(connectionTimeout)
+	connMACLoad := newConnectionMAC(connectionTimeout)
+	addrPort4 := netip.MustParseAddrPort("1.1.1.1:1234")
+	addrPort6 := netip.MustParseAddrPort("[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:1234")
+
+	id4 := connMACWrite.connect(addrPort4)
+	id6 := connMACWrite.connect(addrPort6)
+	if err := connMACWrite.writeToFile(filePath); err != nil {
+		t.Errorf("write() failed: %v", err)
+	}
+	if err := connMACLoad.loadFromFile(filePath); err != nil {
+		t.Errorf("load() failed: %v", err)
+	}
+
+	if !connMACLoad.check(id4, addrPort4) {
+		t.Error("valid check() after load() returned false; want true")
+	}
+	if !connMACLoad.check(id6, addrPort6) {
+		t.Error("valid check() after load() returned false; want true")
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		t.Logf("failed to remove key file: %v", err)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"github.com/pkg/errors"
 )
 
+// size of an announce without options
+const announceSize = 98
+
 // BitTorrent UDP tracker announce
 type Announce struct {
 	ConnectionID  int64
@@ -23,24 +26,54 @@ type Announce struct {
 	Key           uint32
 	NumWant       int32
 	Port          uint16
-	// Extensions    uint16
+	URLData       []byte // BEP 41 url data, nil if the client sent none
 }
 
-// Marshall encodes an Announce to a byte slice.
+// Marshall encodes an Announce to a byte slice, the URLData is appended as options.
 func (a *Announce) Marshall() ([]byte, error) {
-	var buff bytes.Buffer
-	buff.Grow(98)
-	if err := binary.Write(&buff, binary.BigEndian, a); err != nil {
-		return nil, errors.Wrap(err, "failed to encode announce")
-	}
-	return buff.Bytes(), nil
+	data := make([]byte, announceSize)
+	binary.BigEndian.PutUint64(data[0:8], uint64(a.ConnectionID))
+	binary.BigEndian.PutUint32(data[8:12], uint32(a.Action))
+	binary.BigEndian.PutUint32(data[12:16], uint32(a.TransactionID))
+	copy(data[16:36], a.InfoHash[:])
+	copy(data[36:56], a.PeerID[:])
+	binary.BigEndian.PutUint64(data[56:64], uint64(a.Downloaded))
+	binary.BigEndian.PutUint64(data[64:72], uint64(a.Left))
+	binary.BigEndian.PutUint64(data[72:80], uint64(a.Uploaded))
+	binary.BigEndian.PutUint32(data[80:84], uint32(a.Event))
+	binary.BigEndian.PutUint32(data[84:88], a.IP)
+	binary.BigEndian.PutUint32(data[88:92], a.Key)
+	binary.BigEndian.PutUint32(data[92:96], uint32(a.NumWant))
+	binary.BigEndian.PutUint16(data[96:98], a.Port)
+
+	return AppendURLData(data, a.URLData), nil
 }
 
-// Unmarshall decodes a byte slice into an Announce.
+// Unmarshall decodes a byte slice into an Announce, the options following it are parsed with ParseOptions.
 func (a *Announce) Unmarshall(data []byte) error {
-	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, a); err != nil {
-		errors.Wrap(err, "failed to decode announce")
+	if len(data) < announceSize {
+		return errors.New("failed to decode announce: too short")
+	}
+
+	a.ConnectionID = int64(binary.BigEndian.Uint64(data[0:8]))
+	a.Action = Action(binary.BigEndian.Uint32(data[8:12]))
+	a.TransactionID = int32(binary.BigEndian.Uint32(data[12:16]))
+	copy(a.InfoHash[:], data[16:36])
+	copy(a.PeerID[:], data[36:56])
+	a.Downloaded = int64(binary.BigEndian.Uint64(data[56:64]))
+	a.Left = int64(binary.BigEndian.Uint64(data[64:72]))
+	a.Uploaded = int64(binary.BigEndian.Uint64(data[72:80]))
+	a.Event = event(binary.BigEndian.Uint32(data[80:84]))
+	a.IP = binary.BigEndian.Uint32(data[84:88])
+	a.Key = binary.BigEndian.Uint32(data[88:92])
+	a.NumWant = int32(binary.BigEndian.Uint32(data[92:96]))
+	a.Port = binary.BigEndian.Uint16(data[96:98])
+
+	options, err := ParseOptions(data[announceSize:])
+	if err != nil {
+		return errors.Wrap(err, "failed to decode announce options")
 	}
+	a.URLData = options.URLData
 
 	return nil
 }
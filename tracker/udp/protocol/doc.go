@@ -1,5 +1,6 @@
 /*
 	Protocol contains the UDP BitTorrent tracker protcol structures with marshalling and unmarshalling capability. More information about the protocol can be found here: https://www.bittorrent.org/beps/bep_0015.html.
+	Announces and scrapes may carry BEP 41 options, as a scrape ends with a variable number of info hashes its options are the bytes past the last whole info hash.
 */
 
 package protocol
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"github.com/pkg/errors"
+)
+
+// BEP 41 option types, every other type is followed by a length byte.
+const (
+	OptionEndOfOptions byte = 0x0
+	OptionNOP          byte = 0x1
+	OptionURLData      byte = 0x2
+)
+
+// Options holds the BEP 41 extensions appended to an announce, more information can be found here: https://www.bittorrent.org/beps/bep_0041.html.
+type Options struct {
+	URLData []byte // path and query of the announce url, reassembled from every URLData option
+}
+
+// ParseOptions decodes the options following a request, unknown options are skipped.
+// The URLData is copied so it doesn't alias data.
+func ParseOptions(data []byte) (Options, error) {
+	options, _, err := parseOptions(data)
+	return options, err
+}
+
+// parseOptions decodes options like ParseOptions and returns the data following EndOfOptions.
+func parseOptions(data []byte) (Options, []byte, error) {
+	var options Options
+
+	for len(data) > 0 {
+		option := data[0]
+		data = data[1:]
+
+		switch option {
+		case OptionEndOfOptions:
+			return options, data, nil
+		case OptionNOP:
+			continue
+		}
+
+		if len(data) == 0 {
+			return options, nil, errors.New("option is missing its length")
+		}
+		length := int(data[0])
+		data = data[1:]
+		if len(data) < length {
+			return options, nil, errors.New("option is longer than the request")
+		}
+
+		if option == OptionURLData {
+			options.URLData = append(options.URLData, data[:length]...)
+		}
+		data = data[length:]
+	}
+
+	return options, nil, nil
+}
+
+// AppendURLData appends the url data to a request as URLData options followed by EndOfOptions, nothing is appended for empty url data.
+func AppendURLData(data []byte, urlData []byte) []byte {
+	if len(urlData) == 0 {
+		return data
+	}
+
+	for len(urlData) > 0 {
+		length := len(urlData)
+		if length > 0xFF {
+			length = 0xFF
+		}
+		data = append(data, OptionURLData, byte(length))
+		data = append(data, urlData[:length]...)
+		urlData = urlData[length:]
+	}
+
+	return append(data, OptionEndOfOptions)
+}
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/crimist/trakx/tracker/storage"
+)
+
+func TestParseOptions(t *testing.T) {
+	var cases = []struct {
+		name    string
+		data    []byte
+		urlData []byte
+		err     bool
+	}{
+		{"empty", nil, nil, false},
+		{"end of options", []byte{OptionEndOfOptions, OptionURLData, 1, 'a'}, nil, false},
+		{"nop", []byte{OptionNOP, OptionNOP, OptionURLData, 2, '/', 'a'}, []byte("/a"), false},
+		{"concatenated", []byte{OptionURLData, 2, '/', 'a', OptionNOP, OptionURLData, 3, '?', 'b', '=', OptionEndOfOptions}, []byte("/a?b="), false},
+		{"unknown option", []byte{0x7, 2, 'x', 'x', OptionURLData, 1, '/'}, []byte("/"), false},
+		{"missing length", []byte{OptionURLData}, nil, true},
+		{"truncated", []byte{OptionURLData, 5, '/', 'a'}, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options, err := ParseOptions(c.data)
+			if (err != nil) != c.err {
+				t.Fatalf("ParseOptions() err = %v; want error %v", err, c.err)
+			}
+			if !c.err && !bytes.Equal(options.URLData, c.urlData) {
+				t.Errorf("URLData = %q; want %q", options.URLData, c.urlData)
+			}
+		})
+	}
+}
+
+func TestAnnounceURLData(t *testing.T) {
+	// longer than a single option
+	urlData := bytes.Repeat([]byte("/announce?passkey=0123456789"), 20)
+	announce := Announce{
+		ConnectionID:  0xBEEF,
+		Action:        ActionAnnounce,
+		TransactionID: 1337,
+		Left:          100,
+		Event:         EventStarted,
+		Key:           0xDEADBEEF,
+		NumWant:       -1,
+		Port:          0xAABB,
+		URLData:       urlData,
+	}
+
+	data, err := announce.Marshall()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Announce
+	if err := decoded.Unmarshall(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, announce) {
+		t.Errorf("Unmarshall() = %+v; want %+v", decoded, announce)
+	}
+
+	// the url data must not alias the request
+	data[announceSize+2] = 'x'
+	if !bytes.Equal(decoded.URLData, urlData) {
+		t.Error("URLData changed with the request data")
+	}
+}
+
+func TestScrapeURLData(t *testing.T) {
+	var cases = []struct {
+		name    string
+		urlData []byte
+	}{
+		{"none", nil},
+		{"short", []byte("/scrape")},
+		{"padded", []byte("/scrape?k=0123456")}, // options as long as an info hash
+		{"long", bytes.Repeat([]byte("/announce?passkey=0123456789"), 20)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scrape := Scrape{
+				ConnectionID:  0xBEEF,
+				Action:        ActionScrape,
+				TransactionID: 1337,
+				InfoHashes:    []storage.Hash{{0xAA}, {0xBB}, {0xCC}},
+				URLData:       c.urlData,
+			}
+
+			data, err := scrape.Marshall()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded Scrape
+			if err := decoded.Unmarshall(data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, scrape) {
+				t.Errorf("Unmarshall() = %+v; want %+v", decoded, scrape)
+			}
+		})
+	}
+
+	// trailing bytes that aren't options are malformed
+	data := append(make([]byte, scrapeHeaderSize+20), 'x', 'y')
+	var decoded Scrape
+	if err := decoded.Unmarshall(data); err == nil {
+		t.Error("Unmarshall() of a scrape with trailing garbage threw no error")
+	}
+}
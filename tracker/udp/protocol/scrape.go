@@ -8,18 +8,52 @@ import (
 	"github.com/pkg/errors"
 )
 
+// size of a scrape without info hashes and options
+const scrapeHeaderSize = 16
+
 // BitTorrent UDP tracker announce
 type Scrape struct {
 	ConnectionID  int64
 	Action        Action
 	TransactionID int32
 	InfoHashes    []storage.Hash
+	URLData       []byte // BEP 41 url data, nil if the client sent none
+}
+
+// Marshall encodes a Scrape to a byte slice, the URLData is appended as options led by a NOP when they'd be a whole number of info hashes.
+func (s *Scrape) Marshall() ([]byte, error) {
+	data := make([]byte, scrapeHeaderSize, scrapeHeaderSize+len(s.InfoHashes)*20)
+	binary.BigEndian.PutUint64(data[0:8], uint64(s.ConnectionID))
+	binary.BigEndian.PutUint32(data[8:12], uint32(s.Action))
+	binary.BigEndian.PutUint32(data[12:16], uint32(s.TransactionID))
+	for _, hash := range s.InfoHashes {
+		data = append(data, hash[:]...)
+	}
+
+	options := AppendURLData(nil, s.URLData)
+	if len(options)%20 == 0 && len(options) > 0 {
+		data = append(data, OptionNOP)
+	}
+	data = append(data, options...)
+
+	return data, nil
 }
 
 // Unmarshall decodes a byte slice into a Scrape.
+// The number of info hashes is implied by the length so a scrape that isn't a whole number of info hashes carries options,
+// they start at the first info hash that begins a NOP or URLData option and parses up to an EndOfOptions ending the request.
 func (s *Scrape) Unmarshall(data []byte) error {
-	s.InfoHashes = make([]storage.Hash, (len(data)-16)/20)
-	reader := bytes.NewReader(data)
+	hashes := (len(data) - scrapeHeaderSize) / 20
+	var options Options
+	if (len(data)-scrapeHeaderSize)%20 != 0 {
+		var err error
+		if hashes, options, err = scrapeOptions(data); err != nil {
+			return errors.Wrap(err, "failed to decode scrape options")
+		}
+	}
+
+	s.InfoHashes = make([]storage.Hash, hashes)
+	reader := bytes.NewReader(data[:scrapeHeaderSize+hashes*20])
 
 	if err := binary.Read(reader, binary.BigEndian, &s.ConnectionID); err != nil {
 		return errors.Wrap(err, "failed to decode scrape connection id")
@@ -33,10 +67,26 @@ func (s *Scrape) Unmarshall(data []byte) error {
 	if err := binary.Read(reader, binary.BigEndian, &s.InfoHashes); err != nil {
 		return errors.Wrap(err, "failed to decode scrape infohashes")
 	}
+	s.URLData = options.URLData
 
 	return nil
 }
 
+// scrapeOptions finds the options of a scrape and returns the number of info hashes before them.
+func scrapeOptions(data []byte) (int, Options, error) {
+	for start := scrapeHeaderSize; start < len(data); start += 20 {
+		if data[start] != OptionNOP && data[start] != OptionURLData {
+			continue
+		}
+		options, rest, err := parseOptions(data[start:])
+		if err == nil && len(rest) == 0 && data[len(data)-1] == OptionEndOfOptions {
+			return (start - scrapeHeaderSize) / 20, options, nil
+		}
+	}
+
+	return 0, Options{}, errors.New("no options end the request")
+}
+
 // ScrapeInfo holds the information for each infohash in the scrape response
 type ScrapeInfo struct {
 	Complete   int32
@@ -53,7 +103,7 @@ type ScrapeResp struct {
 
 // Marshall encodes a ScrapeResp to a byte slice.
 func (sr *ScrapeResp) Marshall() ([]byte, error) {
-	buff := bytes.NewBuffer(make([]byte, 8+len(sr.Info)*12))
+	buff := bytes.NewBuffer(make([]byte, 0, 8+len(sr.Info)*12))
 
 	if err := binary.Write(buff, binary.BigEndian, sr.Action); err != nil {
 		return nil, errors.Wrap(err, "failed to encode scrape response action")
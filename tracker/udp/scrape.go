@@ -1,19 +1,21 @@
 package udp
 
 import (
-	"net"
-
 	"github.com/crimist/trakx/tracker/stats"
 	"github.com/crimist/trakx/tracker/udp/protocol"
 )
 
-func (u *UDPTracker) scrape(scrape *protocol.Scrape, remote *net.UDPAddr) {
+func (u *UDPTracker) scrape(scrape *protocol.Scrape) []byte {
 	stats.Scrapes.Add(1)
 
+	// clients scrape with the url data of the announce url or of the scrape url derived from it
+	urlData := parseURLData(scrape.URLData)
+	if !urlData.served("/announce", "/scrape") {
+		return u.newClientError("unknown path", scrape.TransactionID, cerrFields{"path": urlData.path})
+	}
+
 	if len(scrape.InfoHashes) > 74 {
-		msg := u.newClientError("74 hashes max", scrape.TransactionID)
-		u.sock.WriteToUDP(msg, remote)
-		return
+		return u.newClientError("74 hashes max", scrape.TransactionID)
 	}
 
 	resp := protocol.ScrapeResp{
@@ -23,26 +25,22 @@ func (u *UDPTracker) scrape(scrape *protocol.Scrape, remote *net.UDPAddr) {
 
 	for _, hash := range scrape.InfoHashes {
 		if len(hash) != 20 {
-			msg := u.newClientError("bad hash", scrape.TransactionID)
-			u.sock.WriteToUDP(msg, remote)
-			return
+			return u.newClientError("bad hash", scrape.TransactionID)
 		}
 
-		complete, incomplete := u.peerdb.HashStats(hash)
+		complete, incomplete, downloaded := u.peerdb.HashStats(hash)
 		info := protocol.ScrapeInfo{
-			Complete:   int32(complete),
-			Incomplete: int32(incomplete),
-			Downloaded: -1,
+			Complete:   count(complete),
+			Incomplete: count(incomplete),
+			Downloaded: count(downloaded),
 		}
 		resp.Info = append(resp.Info, info)
 	}
 
 	respBytes, err := resp.Marshall()
 	if err != nil {
-		msg := u.newServerError("ScrapeResp.Marshall()", err, scrape.TransactionID)
-		u.sock.WriteToUDP(msg, remote)
-		return
+		return u.newServerError("ScrapeResp.Marshall()", err, scrape.TransactionID)
 	}
 
-	u.sock.WriteToUDP(respBytes, remote)
+	return respBytes
 }
@@ -0,0 +1,54 @@
+package udp
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/crimist/trakx/config"
+	"github.com/crimist/trakx/tracker/storage"
+	"github.com/crimist/trakx/tracker/udp/protocol"
+
+	_ "github.com/crimist/trakx/tracker/storage/map"
+)
+
+func TestScrapeURLData(t *testing.T) {
+	config.Config.DB.Type = "gomap"
+	config.Config.DB.Backup.Type = "none"
+
+	db, err := storage.Open()
+	if err != nil {
+		t.Fatal("failed to open storage", err)
+	}
+	tracker := UDPTracker{peerdb: db}
+
+	var cases = []struct {
+		urlData string
+		action  protocol.Action
+	}{
+		{"", protocol.ActionScrape},
+		{"/announce?passkey=abc", protocol.ActionScrape},
+		{"/scrape", protocol.ActionScrape},
+		{"/stats", protocol.ActionError},
+	}
+
+	for _, c := range cases {
+		data, err := (&protocol.Scrape{
+			Action:        protocol.ActionScrape,
+			TransactionID: 1337,
+			InfoHashes:    []storage.Hash{{1}, {2}},
+			URLData:       []byte(c.urlData),
+		}).Marshall()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var scrape protocol.Scrape
+		if err := scrape.Unmarshall(data); err != nil {
+			t.Fatalf("Unmarshall() of scrape with url data %q threw error: %v", c.urlData, err)
+		}
+		response := tracker.scrape(&scrape)
+		if action := protocol.Action(binary.BigEndian.Uint32(response[0:4])); action != c.action {
+			t.Errorf("scrape with url data %q answered with action %v; want %v", c.urlData, action, c.action)
+		}
+	}
+}
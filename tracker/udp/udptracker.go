@@ -5,10 +5,12 @@
 package udp
 
 import (
+	"context"
 	"encoding/binary"
 	"net"
 	"net/netip"
-	"sync"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/crimist/trakx/config"
 	"github.com/crimist/trakx/tracker/stats"
@@ -20,85 +22,143 @@ import (
 )
 
 const (
-	errClosed      = "use of closed network connection"
 	requestSizeMax = 1496 // 1496 is max size of a scrape with 20 hashes
 )
 
 type UDPTracker struct {
-	sock     *net.UDPConn
-	conndb   *connectionDatabase
+	socks    []*net.UDPConn
+	conndb   connectionStore
 	peerdb   storage.Database
 	shutdown chan struct{}
 }
 
 // Init sets up the UDPTracker.
 func (u *UDPTracker) Init(peerdb storage.Database) {
-	u.conndb = newConnectionDatabase(config.Config.UDP.ConnDB.Expiry)
 	u.peerdb = peerdb
 	u.shutdown = make(chan struct{})
 
-	if err := u.conndb.loadFromFile(config.CachePath + "conn.db"); err != nil {
+	if config.Config.UDP.ConnDB.Type == "hmac" {
+		connMAC := newConnectionMAC(config.Config.UDP.ConnDB.Expiry)
+		if err := connMAC.loadFromFile(config.CachePath + "conn.key"); err != nil {
+			config.Logger.Warn("Failed to load connection id keys, creating new keys", zap.Error(err))
+		}
+		u.conndb = connMAC
+		return
+	}
+
+	connDb := newConnectionDatabase(config.Config.UDP.ConnDB.Expiry)
+	if err := connDb.loadFromFile(config.CachePath + "conn.db"); err != nil {
 		config.Logger.Warn("Failed to load connection database, creating empty db", zap.Error(err))
-		u.conndb.make()
+		connDb.make()
 	}
+	u.conndb = connDb
 
-	go utils.RunOn(config.Config.UDP.ConnDB.Trim, u.conndb.trim)
+	go utils.RunOn(config.Config.UDP.ConnDB.Trim, connDb.trim)
 }
 
 // Serve begins listening and serving clients.
 func (u *UDPTracker) Serve() error {
-	var err error
-
-	u.sock, err = net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.ParseIP(config.Config.UDP.IP),
-		Port: config.Config.UDP.Port,
-	})
-	if err != nil {
-		return errors.Wrap(err, "Failed to open UDP listen socket")
-	}
-
-	pool := sync.Pool{
-		New: func() interface{} {
-			slice := make([]byte, requestSizeMax)
-			return &slice
-		},
-	}
-
-	for i := 0; i < config.Config.UDP.Threads; i++ {
-		go func() {
-			for {
-				data := pool.Get().(*[]byte)
-				size, remoteAddr, err := u.sock.ReadFromUDP(*data)
-				if err != nil {
-					// if socket is closed exit loop
-					if errors.Unwrap(err).Error() == errClosed {
-						break
-					}
-
-					config.Logger.Error("Failed to read from UDP socket", zap.Error(err))
-					pool.Put(data)
-					continue
-				}
-
-				if size > 15 { // 16 = minimum connect
-					u.process((*data)[:size], remoteAddr)
-				}
-
-				pool.Put(data)
+	sockets := config.Config.UDP.Sockets
+	if sockets > 1 && !utils.ReusePortSupported {
+		config.Logger.Warn("SO_REUSEPORT isn't supported on this platform, serving a single UDP socket")
+		sockets = 1
+	}
+	if sockets < 1 {
+		sockets = 1
+	}
+
+	if err := u.listen(sockets); err != nil {
+		return err
+	}
+
+	batch := config.Config.UDP.Batch
+	if batch > 1 && !batchSupported {
+		config.Logger.Warn("Batched UDP I/O isn't supported on this platform, serving a packet per syscall")
+		batch = 0
+	}
+
+	// every socket is served by its own share of the workers
+	threads := config.Config.UDP.Threads / sockets
+	if threads < 1 {
+		threads = 1
+	}
+	hits := stats.UDPSockets.Open(sockets)
+	for socket, sock := range u.socks {
+		for i := 0; i < threads; i++ {
+			if batch > 1 {
+				go u.serveBatch(sock, &hits[socket], batch)
+			} else {
+				go u.serveLoop(sock, &hits[socket])
 			}
-		}()
+		}
 	}
 
 	<-u.shutdown
-	config.Logger.Info("Closing UDP tracker socket")
-	if err = u.sock.Close(); err != nil {
-		return errors.Wrap(err, "Failed to close UDP listen socket")
+	config.Logger.Info("Closing UDP tracker sockets", zap.Int("sockets", len(u.socks)))
+	for _, sock := range u.socks {
+		if err := sock.Close(); err != nil {
+			return errors.Wrap(err, "Failed to close UDP listen socket")
+		}
 	}
 
 	return nil
 }
 
-// Shutdown stops the UDP tracker server by closing the socket.
+// listen opens the sockets, more than one socket share the port with SO_REUSEPORT.
+func (u *UDPTracker) listen(sockets int) error {
+	if sockets == 1 {
+		sock, err := net.ListenUDP("udp", &net.UDPAddr{
+			IP:   net.ParseIP(config.Config.UDP.IP),
+			Port: config.Config.UDP.Port,
+		})
+		if err != nil {
+			return errors.Wrap(err, "Failed to open UDP listen socket")
+		}
+		u.socks = []*net.UDPConn{sock}
+		return nil
+	}
+
+	listenConfig := utils.ReusePort()
+	address := net.JoinHostPort(config.Config.UDP.IP, strconv.Itoa(config.Config.UDP.Port))
+	for i := 0; i < sockets; i++ {
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			for _, sock := range u.socks {
+				sock.Close()
+			}
+			return errors.Wrap(err, "Failed to open UDP listen socket")
+		}
+		u.socks = append(u.socks, conn.(*net.UDPConn))
+	}
+
+	return nil
+}
+
+// serveLoop reads and answers a packet per syscall.
+func (u *UDPTracker) serveLoop(sock *net.UDPConn, hits *atomic.Int64) {
+	data := make([]byte, requestSizeMax)
+	for {
+		size, remote, err := sock.ReadFromUDPAddrPort(data)
+		if err != nil {
+			// if socket is closed exit loop
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			config.Logger.Error("Failed to read from UDP socket", zap.Error(err))
+			continue
+		}
+		hits.Add(1)
+
+		if size > 15 { // 16 = minimum connect
+			if response := u.process(data[:size], remote); response != nil {
+				sock.WriteToUDPAddrPort(response, remote)
+			}
+		}
+	}
+}
+
+// Shutdown stops the UDP tracker server by closing the sockets.
 func (u *UDPTracker) Shutdown() {
 	if u == nil || u.shutdown == nil {
 		return
@@ -107,7 +167,7 @@ func (u *UDPTracker) Shutdown() {
 	u.shutdown <- die
 }
 
-// Connections returns the number of BitTorrent UDP protocol connections in the connection database.
+// Connections returns the number of BitTorrent UDP protocol connections in the connection database, -1 if they aren't kept.
 func (u *UDPTracker) Connections() int {
 	if u == nil || u.conndb == nil {
 		return -1
@@ -121,78 +181,66 @@ func (u *UDPTracker) WriteConns() error {
 		return nil
 	}
 
-	if err := u.conndb.writeToFile(config.CachePath + "conn.db"); err != nil {
+	if err := u.conndb.write(); err != nil {
 		return errors.Wrap(err, "Failed to write connections database to disk")
 	}
 
 	return nil
 }
 
-func (u *UDPTracker) process(data []byte, remote *net.UDPAddr) {
+// process handles a request from the address and returns the response, nil if there's nothing to send.
+func (u *UDPTracker) process(data []byte, remote netip.AddrPort) []byte {
 	stats.Hits.Add(1)
 
 	action := protocol.Action(data[11])
 	txid := int32(binary.BigEndian.Uint32(data[12:16]))
 
-	addr, ok := netip.AddrFromSlice(remote.IP)
-	if !ok {
-		u.newServerError("failed to parse ip", errors.New("failed to parse remote ip slice as netip"), txid)
-	}
-	addr = addr.Unmap() // use ipv4 instead of ipv6 mapped ipv4
-	addrPort := netip.AddrPortFrom(addr, uint16(remote.Port))
+	// use ipv4 instead of ipv6 mapped ipv4
+	addrPort := netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
 
 	if action > protocol.ActionHeartbeat {
-		msg := u.newClientError("bad action", txid, cerrFields{"action": data[11], "addrPort": addrPort})
-		u.sock.WriteToUDP(msg, remote)
-		return
+		return u.newClientError("bad action", txid, cerrFields{"action": data[11], "addrPort": addrPort})
 	}
 
 	if action == protocol.ActionHeartbeat {
-		u.sock.WriteToUDP(protocol.HeartbeatOk, remote)
-		return
+		return protocol.HeartbeatOk
 	}
 
 	if action == protocol.ActionConnect {
 		c := protocol.Connect{}
 		if err := c.Unmarshall(data); err != nil {
-			msg := u.newServerError("base.unmarshall()", err, txid)
-			u.sock.WriteToUDP(msg, remote)
+			return u.newServerError("base.unmarshall()", err, txid)
 		}
-		u.connect(&c, remote, addrPort)
-		return
+		return u.connect(&c, addrPort)
 	}
 
 	connid := int64(binary.BigEndian.Uint64(data[0:8]))
 	if ok := u.conndb.check(connid, addrPort); !ok && config.Config.UDP.ConnDB.Validate {
-		msg := u.newClientError("bad connection id", txid, cerrFields{"clientID": connid, "addrPort": addrPort})
-		u.sock.WriteToUDP(msg, remote)
-		return
+		return u.newClientError("bad connection id", txid, cerrFields{"clientID": connid, "addrPort": addrPort})
 	}
 
 	switch action {
 	case protocol.ActionAnnounce:
 		if len(data) < 98 {
-			msg := u.newClientError("bad announce size", txid, cerrFields{"size": len(data)})
-			u.sock.WriteToUDP(msg, remote)
-			return
+			return u.newClientError("bad announce size", txid, cerrFields{"size": len(data)})
 		}
 
 		announce := protocol.Announce{}
+		// the fixed fields were size checked so only malformed options fail
 		if err := announce.Unmarshall(data); err != nil {
-			msg := u.newServerError("announce.unmarshall()", err, txid)
-			u.sock.WriteToUDP(msg, remote)
-			return
+			return u.newClientError("bad announce options", txid, cerrFields{"error": err, "addrPort": addrPort})
 		}
 
-		u.announce(&announce, remote, addrPort)
+		return u.announce(&announce, addrPort)
 	case protocol.ActionScrape:
 		scrape := protocol.Scrape{}
+		// the info hashes are read whole so only malformed options fail
 		if err := scrape.Unmarshall(data); err != nil {
-			msg := u.newServerError("scrape.unmarshall()", err, txid)
-			u.sock.WriteToUDP(msg, remote)
-			return
+			return u.newClientError("bad scrape options", txid, cerrFields{"error": err, "addrPort": addrPort})
 		}
 
-		u.scrape(&scrape, remote)
+		return u.scrape(&scrape)
 	}
+
+	return nil
 }
@@ -0,0 +1,32 @@
+package udp
+
+import (
+	"net/url"
+	"strings"
+)
+
+// urlData is the BEP 41 url data of a request split into the path and query an HTTP request has.
+type urlData struct {
+	path  string
+	query url.Values
+}
+
+// parseURLData splits url data into its path and query, params that don't parse are left out like the HTTP tracker leaves them out.
+func parseURLData(data []byte) urlData {
+	path, query, _ := strings.Cut(string(data), "?")
+	values, _ := url.ParseQuery(query)
+	return urlData{path: path, query: values}
+}
+
+// served returns true if the path is one of paths, no path is served by every handler as the url data is optional.
+func (data *urlData) served(paths ...string) bool {
+	if data.path == "" || data.path == "/" {
+		return true
+	}
+	for _, path := range paths {
+		if data.path == path {
+			return true
+		}
+	}
+	return false
+}
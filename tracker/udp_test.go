@@ -194,6 +194,7 @@ func TestUDPAnnounce6(t *testing.T) {
 		Key:           0xDEADBEEF,
 		NumWant:       1,
 		Port:          0xAABB,
+		URLData:       []byte("/announce?passkey=1337"),
 	}
 
 	data, err = a.Marshall()
@@ -0,0 +1,30 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package utils
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReusePortSupported is true if sockets can share a port with SO_REUSEPORT on this platform.
+const ReusePortSupported = true
+
+// ReusePort returns a ListenConfig that sets SO_REUSEPORT so several sockets can be bound to the same port, the kernel spreads the packets and connections between them.
+func ReusePort() net.ListenConfig {
+	return net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var err error
+			controlErr := conn.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package utils
+
+import (
+	"net"
+)
+
+// ReusePortSupported is true if sockets can share a port with SO_REUSEPORT on this platform.
+const ReusePortSupported = false
+
+// ReusePort returns a plain ListenConfig as SO_REUSEPORT isn't supported on this platform.
+func ReusePort() net.ListenConfig {
+	return net.ListenConfig{}
+}
@@ -0,0 +1,112 @@
+/*
+	Timingwheel schedules keys at unix times in buckets so expiring them only touches the keys that are due.
+
+	The wheel is hierarchical: the first level has a bucket per second and every level above has buckets covering a full lap of the level below.
+	Keys far from the current time wait in the upper levels and are cascaded down as their time approaches.
+*/
+
+package timingwheel
+
+const (
+	levelBits = 6
+	buckets   = 1 << levelBits // buckets per level
+	levels    = 4              // levels cover 64s, ~68m, ~73h and ~194d
+
+	// keys scheduled further ahead wait in the last bucket of the top level
+	span = 1 << (levelBits * levels)
+)
+
+// Entry is a key and the time it was scheduled at.
+type Entry[K comparable] struct {
+	Key  K
+	Time int64
+}
+
+// Wheel is a hierarchical timing wheel, the zero value is an empty wheel.
+// It isn't safe for concurrent use.
+type Wheel[K comparable] struct {
+	current int64 // every time before current has been expired
+	count   int
+	levels  [levels][buckets][]Entry[K]
+	late    []Entry[K] // entries scheduled before current
+}
+
+// Schedule adds the key to the wheel at time, it's returned by the first call to Expire with a later time.
+func (wheel *Wheel[K]) Schedule(key K, time int64) {
+	// empty buckets have nothing to expire before the key so the wheel starts at it
+	if wheel.count == len(wheel.late) && time > wheel.current {
+		wheel.current = time
+	}
+
+	wheel.count++
+	if time < wheel.current {
+		wheel.late = append(wheel.late, Entry[K]{key, time})
+		return
+	}
+	wheel.place(Entry[K]{key, time})
+}
+
+// place puts the entry in the bucket of the lowest level whose lap covers its time, which must not be before current.
+func (wheel *Wheel[K]) place(entry Entry[K]) {
+	time := entry.Time
+	if time-wheel.current >= span {
+		time = wheel.current + span - 1
+	}
+
+	delta := time - wheel.current
+	level := 0
+	for level < levels-1 && delta >= 1<<(levelBits*(level+1)) {
+		level++
+	}
+
+	bucket := &wheel.levels[level][(time>>(levelBits*level))&(buckets-1)]
+	*bucket = append(*bucket, entry)
+}
+
+// Expire removes and returns the entries scheduled before time.
+func (wheel *Wheel[K]) Expire(time int64) (expired []Entry[K]) {
+	if len(wheel.late) > 0 {
+		kept := wheel.late[:0]
+		for _, entry := range wheel.late {
+			if entry.Time < time {
+				expired = append(expired, entry)
+			} else {
+				kept = append(kept, entry)
+			}
+		}
+		wheel.count -= len(wheel.late) - len(kept)
+		wheel.late = kept
+	}
+
+	for wheel.current < time {
+		// nothing left in the buckets
+		if wheel.count == len(wheel.late) {
+			wheel.current = time
+			break
+		}
+
+		// cascade the upper levels down at the start of every lap of the level below
+		for level := 1; level < levels && wheel.current&(1<<(levelBits*level)-1) == 0; level++ {
+			bucket := &wheel.levels[level][(wheel.current>>(levelBits*level))&(buckets-1)]
+			entries := *bucket
+			*bucket = nil
+			for _, entry := range entries {
+				wheel.place(entry)
+			}
+		}
+
+		bucket := &wheel.levels[0][wheel.current&(buckets-1)]
+		expired = append(expired, *bucket...)
+		wheel.count -= len(*bucket)
+		*bucket = nil
+
+		wheel.current++
+	}
+
+	return
+}
+
+// Len returns the number of scheduled entries.
+func (wheel *Wheel[K]) Len() int {
+	return wheel.count
+}
@@ -0,0 +1,56 @@
+package timingwheel
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestExpire(t *testing.T) {
+	var wheel Wheel[int]
+	scheduled := make(map[int]int64)
+
+	now := int64(1_700_000_000)
+	key := 0
+	for round := 0; round < 2000; round++ {
+		// times behind, near and far ahead of the wheel across every level
+		for i := 0; i < 20; i++ {
+			time := now + rand.Int63n(1<<(levelBits*(rand.Intn(levels+1)+1))) - 100
+			wheel.Schedule(key, time)
+			scheduled[key] = time
+			key++
+		}
+
+		now += rand.Int63n(1 << (levelBits * rand.Intn(levels)))
+		for _, entry := range wheel.Expire(now) {
+			time, ok := scheduled[entry.Key]
+			if !ok {
+				t.Fatalf("Expire(%v) returned %v twice", now, entry.Key)
+			}
+			if time != entry.Time || time >= now {
+				t.Fatalf("Expire(%v) returned %v at %v; want it scheduled at %v before %v", now, entry.Key, entry.Time, time, now)
+			}
+			delete(scheduled, entry.Key)
+		}
+		for key, time := range scheduled {
+			if time < now {
+				t.Fatalf("Expire(%v) kept %v scheduled at %v", now, key, time)
+			}
+		}
+		if wheel.Len() != len(scheduled) {
+			t.Fatalf("Len() = %v; want %v", wheel.Len(), len(scheduled))
+		}
+	}
+}
+
+func TestExpireEmpty(t *testing.T) {
+	var wheel Wheel[int]
+	if expired := wheel.Expire(1_700_000_000); len(expired) != 0 {
+		t.Errorf("Expire() on an empty wheel = %v; want none", expired)
+	}
+
+	// keys scheduled before the current time are expired next
+	wheel.Schedule(1, 1_600_000_000)
+	if expired := wheel.Expire(1_700_000_000); len(expired) != 1 || expired[0].Key != 1 {
+		t.Errorf("Expire() = %v; want key 1", expired)
+	}
+}